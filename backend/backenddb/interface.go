@@ -16,6 +16,8 @@ var (
 	ErrBlockHeightNotFound = errors.New("block height not found")
 
 	ErrNotTip = errors.New("specified block was not the tip")
+
+	ErrHeightProcessed = errors.New("height already has a processed block")
 )
 
 type ReadTx interface {
@@ -30,12 +32,28 @@ type WriteTx interface {
 type DB interface {
 	Balance(tx ReadTx, accountAddr string, height int64) (dcrutil.Amount, error)
 
+	// Balances calls f for every account tracked by the db with its
+	// balance as of the given height.
+	Balances(tx ReadTx, height int64, f func(accountAddr string, balance dcrutil.Amount) error) error
+
 	LastProcessedBlock(tx ReadTx) (chainhash.Hash, int64, error)
 
 	ProcessedBlockHash(tx ReadTx, height int64) (chainhash.Hash, error)
 
+	// AccountFormat returns the version of the format of the account
+	// addresses stored in the db or zero if no version was stored.
+	AccountFormat(tx ReadTx) (uint32, error)
+
+	// StoreAccountFormat stores the version of the format of the account
+	// addresses stored in the db.
+	StoreAccountFormat(tx WriteTx, version uint32) error
+
 	RollbackTip(tx WriteTx, height int64, blockHash chainhash.Hash) error
 
+	// StoreBalances stores the balances modified by the given block and
+	// makes it the processed block at its height. It returns
+	// ErrHeightProcessed if a block was already processed at that height
+	// and not rolled back, so data of a previous chain is never reused.
 	StoreBalances(tx WriteTx, blockHash chainhash.Hash, height int64, balances map[string]dcrutil.Amount) error
 
 	View(ctx context.Context, f func(tx ReadTx) error) error
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backenddb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v3"
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+// snapshotMagic is the prefix of every serialized snapshot. The last byte is
+// the version of the serialization format.
+var snapshotMagic = []byte{'d', 'r', 's', 'n', 'a', 'p', 0x01}
+
+// Snapshot is a point-in-time view of the balances of all accounts tracked by
+// a db, as of a given processed block.
+type Snapshot struct {
+	BlockHash chainhash.Hash
+	Height    int64
+	Balances  map[string]dcrutil.Amount
+}
+
+// WriteSnapshot serializes the given snapshot into w.
+//
+// The snapshot is serialized as:
+//
+// [0:7]:   Magic and version
+// [7:39]:  Block Hash
+// [39:47]: Block Height
+// [47:55]: Number of accounts
+//
+// Followed by each account serialized as:
+//
+// [0:2]:      Length of the account string (n)
+// [2:2+n]:    Account string
+// [2+n:10+n]: Balance
+func WriteSnapshot(w io.Writer, snap *Snapshot) error {
+	bw := bufio.NewWriter(w)
+	var b [8]byte
+
+	bw.Write(snapshotMagic)
+	bw.Write(snap.BlockHash[:])
+	binary.BigEndian.PutUint64(b[:], uint64(snap.Height))
+	bw.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], uint64(len(snap.Balances)))
+	bw.Write(b[:])
+
+	for account, balance := range snap.Balances {
+		if len(account) > 0xffff {
+			return fmt.Errorf("account %q too large for snapshot", account)
+		}
+		binary.BigEndian.PutUint16(b[:2], uint16(len(account)))
+		bw.Write(b[:2])
+		bw.WriteString(account)
+		binary.BigEndian.PutUint64(b[:], uint64(balance))
+		bw.Write(b[:])
+	}
+
+	return bw.Flush()
+}
+
+// ReadSnapshot deserializes a snapshot previously written with WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	var b [8]byte
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(snapshotMagic) {
+		return nil, fmt.Errorf("%w: unknown magic or version", ErrInvalidSnapshot)
+	}
+
+	snap := new(Snapshot)
+	if _, err := io.ReadFull(br, snap.BlockHash[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return nil, err
+	}
+	snap.Height = int64(binary.BigEndian.Uint64(b[:]))
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return nil, err
+	}
+	nbAccounts := binary.BigEndian.Uint64(b[:])
+
+	snap.Balances = make(map[string]dcrutil.Amount)
+	for i := uint64(0); i < nbAccounts; i++ {
+		if _, err := io.ReadFull(br, b[:2]); err != nil {
+			return nil, err
+		}
+		account := make([]byte, binary.BigEndian.Uint16(b[:2]))
+		if _, err := io.ReadFull(br, account); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return nil, err
+		}
+		snap.Balances[string(account)] = dcrutil.Amount(binary.BigEndian.Uint64(b[:]))
+	}
+
+	if len(snap.Balances) != int(nbAccounts) {
+		return nil, fmt.Errorf("%w: duplicated accounts", ErrInvalidSnapshot)
+	}
+
+	return snap, nil
+}
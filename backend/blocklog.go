@@ -0,0 +1,234 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"decred.org/dcrros/backend/backenddb"
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+)
+
+var (
+	errInvalidBlockLog = errors.New("invalid block log")
+)
+
+// blockLogMagic is the prefix of every block log file. The last byte is the
+// version of the serialization format.
+var blockLogMagic = []byte{'d', 'r', 'b', 'l', 'o', 'g', 0x01}
+
+// The block log is an append-only file with every block processed by the
+// server, which can be used to rebuild a db without downloading the blocks
+// from dcrd again.
+//
+// After the magic, each block is serialized as:
+//
+// [0:32]:    Block Hash
+// [32:40]:   Block Height
+// [40:44]:   Length of the serialized block (n)
+// [44:44+n]: Serialized block
+//
+// Blocks are appended as they are processed, therefore the log may include
+// blocks that were later reorged out of the main chain.
+
+// openBlockLog opens the given block log file for appending, writing the
+// magic if the file is empty.
+func openBlockLog(fname string) (*os.File, error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		if _, err := f.Write(blockLogMagic); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// appendBlockLog appends the given block to the block log, if one is
+// configured.
+func (s *Server) appendBlockLog(bh *chainhash.Hash, b *wire.MsgBlock) error {
+	if s.blockLog == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(44 + b.SerializeSize())
+	var hdr [44]byte
+	copy(hdr[:32], bh[:])
+	binary.BigEndian.PutUint64(hdr[32:40], uint64(b.Header.Height))
+	binary.BigEndian.PutUint32(hdr[40:44], uint32(b.SerializeSize()))
+	buf.Write(hdr[:])
+	if err := b.Serialize(&buf); err != nil {
+		return err
+	}
+
+	// Write the entire record at once so that a failure doesn't leave a
+	// partially written record in the middle of the log.
+	_, err := s.blockLog.Write(buf.Bytes())
+	return err
+}
+
+// replayBlockLogFile replays the blocks stored in the given block log file
+// into the server's db.
+//
+// Blocks must extend the current db tip. Blocks that were already processed
+// are skipped, while other blocks at or below the current tip cause the db to
+// be rolled back to their parent, which handles reorgs recorded in the log.
+//
+// The log is not as trustworthy as dcrd, therefore the merkle roots of every
+// block are verified against its header, regardless of the
+// VerifyBlockRoots option.
+func (s *Server) replayBlockLogFile(ctx context.Context, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(blockLogMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, blockLogMagic) {
+		return fmt.Errorf("%w: unknown magic or version", errInvalidBlockLog)
+	}
+
+	var tipHash chainhash.Hash
+	var tipHeight int64
+	err = s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var prev *wire.MsgBlock
+	utxoSet := make(map[wire.OutPoint]*types.PrevInput)
+	var nbBlocks int
+	var hdr [44]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var bh chainhash.Hash
+		copy(bh[:], hdr[:32])
+		height := int64(binary.BigEndian.Uint64(hdr[32:40]))
+		size := binary.BigEndian.Uint32(hdr[40:44])
+		if size > wire.MaxBlockPayload {
+			return fmt.Errorf("%w: block %s too large", errInvalidBlockLog, bh)
+		}
+
+		rawBlock := make([]byte, size)
+		if _, err := io.ReadFull(r, rawBlock); err != nil {
+			return err
+		}
+		b := new(wire.MsgBlock)
+		if err := b.FromBytes(rawBlock); err != nil {
+			return err
+		}
+		if b.Header.BlockHash() != bh || int64(b.Header.Height) != height {
+			return fmt.Errorf("%w: block %s does not match its record",
+				errInvalidBlockLog, bh)
+		}
+		if err := types.VerifyBlockRoots(b); err != nil {
+			return fmt.Errorf("block log: %w", err)
+		}
+
+		// Skip blocks that were already processed.
+		emptyDB := tipHash == (chainhash.Hash{})
+		if !emptyDB && height <= tipHeight {
+			var processedHash chainhash.Hash
+			err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+				var err error
+				processedHash, err = s.db.ProcessedBlockHash(dbtx, height)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if processedHash == bh {
+				prev = b
+				continue
+			}
+		}
+
+		// Roll back blocks that were reorged out of the main chain.
+		if !emptyDB && height <= tipHeight {
+			err := s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+				for tipHeight >= height && tipHeight > 0 {
+					err := s.db.RollbackTip(dbtx, tipHeight, tipHash)
+					if err != nil {
+						return err
+					}
+					tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// The utxo set may include outputs of the rolled back
+			// blocks, so start from scratch.
+			utxoSet = make(map[wire.OutPoint]*types.PrevInput)
+			prev = nil
+		}
+
+		// Ensure the block extends the current tip.
+		switch {
+		case emptyDB && height == 0:
+		case height == tipHeight+1 && b.Header.PrevBlock == tipHash:
+		default:
+			return fmt.Errorf("%w: block %s at height %d does not "+
+				"extend tip %s at height %d", errInvalidBlockLog,
+				bh, height, tipHash, tipHeight)
+		}
+
+		if prev == nil && height > 0 {
+			if prev, err = s.getBlock(ctx, &b.Header.PrevBlock); err != nil {
+				return err
+			}
+		}
+		if err := s.preProcessAccountBlock(ctx, &bh, b, prev, utxoSet, nil); err != nil {
+			return err
+		}
+
+		prev = b
+		tipHash, tipHeight = bh, height
+		nbBlocks++
+		if tipHeight%2000 == 0 {
+			svrLog.Infof("Imported blocks up to height %d", tipHeight)
+		}
+	}
+
+	svrLog.Infof("Imported %d blocks from block log. Tip is %d %s",
+		nbBlocks, tipHeight, tipHash)
+	return nil
+}
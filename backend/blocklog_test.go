@@ -0,0 +1,197 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestBlockLogRoundTrip ensures a db rebuilt from the block log of a server
+// matches the db of that server, including when the log records a reorg.
+func TestBlockLogRoundTrip(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(true, 4)
+	c.addBlock(true, 5)
+
+	// Chain that reorgs out blocks 3 and 4, spending the same output in
+	// a different way.
+	fork3 := c.newBlock(c.blocks[2], true, 6)
+	fork4 := c.newBlock(fork3, true, 7, c.spendTx(c.blocks[2].Transactions[1],
+		0, 8, 5e8))
+	fork5 := c.newBlock(fork4, true, 9)
+	forkChain := append(append([]*wire.MsgBlock{}, c.blocks[:3]...), fork3,
+		fork4, fork5)
+
+	// Process the chain and the reorg on a server that records the
+	// processed blocks. The log is reopened midway to ensure appending to
+	// an existing log works.
+	logFile := testTempFile(t, "blocks.log")
+	src := newTestServer(t, nil)
+	newFakeDcrd(t, src, forkChain)
+	f, err := openBlockLog(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.blockLog = f
+	processTestBlocks(t, src, nil, c.blocks[:3]...)
+	src.blockLog.Close()
+	if src.blockLog, err = openBlockLog(logFile); err != nil {
+		t.Fatal(err)
+	}
+	processTestBlocks(t, src, c.blocks[2], c.blocks[3:]...)
+	for _, b := range []*wire.MsgBlock{c.blocks[4], c.blocks[3]} {
+		if err := src.handleBlockDisconnected(src.ctx, &b.Header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	processTestBlocks(t, src, c.blocks[2], fork3, fork4, fork5)
+	src.blockLog.Close()
+	src.blockLog = nil
+
+	// Rebuild a db from the log.
+	dst := newTestServer(t, nil)
+	newFakeDcrd(t, dst, forkChain)
+	if err := dst.replayBlockLogFile(dst.ctx, logFile); err != nil {
+		t.Fatalf("unable to replay block log: %v", err)
+	}
+
+	wantHash, wantHeight := testTip(t, src)
+	if wantHash != fork5.BlockHash() {
+		t.Fatalf("unexpected source tip %d %s", wantHeight, wantHash)
+	}
+	gotHash, gotHeight := testTip(t, dst)
+	if gotHash != wantHash || gotHeight != wantHeight {
+		t.Fatalf("unexpected tip: got %d %s, want %d %s", gotHeight,
+			gotHash, wantHeight, wantHash)
+	}
+	wantBals := testBalances(t, src)
+	if gotBals := testBalances(t, dst); !reflect.DeepEqual(gotBals, wantBals) {
+		t.Fatalf("unexpected balances: got %v, want %v", gotBals,
+			wantBals)
+	}
+
+	// Replaying the log again skips the processed blocks.
+	if err := dst.replayBlockLogFile(dst.ctx, logFile); err != nil {
+		t.Fatalf("unable to replay block log again: %v", err)
+	}
+	gotHash, gotHeight = testTip(t, dst)
+	if gotHash != wantHash || gotHeight != wantHeight {
+		t.Fatalf("unexpected tip after replaying again: got %d %s, "+
+			"want %d %s", gotHeight, gotHash, wantHeight, wantHash)
+	}
+}
+
+// TestBlockLogInvalid ensures invalid block logs are rejected.
+func TestBlockLogInvalid(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	c.addBlock(true, 2)
+
+	// Helper to write a log with the given blocks, tampering with the
+	// last one.
+	writeLog := func(t *testing.T, tamper func(b *wire.MsgBlock)) string {
+		logFile := testTempFile(t, "blocks.log")
+		s := newTestServer(t, nil)
+		f, err := openBlockLog(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		s.blockLog = f
+		for i, b := range c.blocks {
+			if i == len(c.blocks)-1 {
+				var bcopy wire.MsgBlock
+				raw, err := b.Bytes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := bcopy.FromBytes(raw); err != nil {
+					t.Fatal(err)
+				}
+				tamper(&bcopy)
+				b = &bcopy
+			}
+			bh := b.BlockHash()
+			if err := s.appendBlockLog(&bh, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return logFile
+	}
+
+	t.Run("tampered tx", func(t *testing.T) {
+		logFile := writeLog(t, func(b *wire.MsgBlock) {
+			b.Transactions[0].TxOut[0].Value++
+		})
+		s := newTestServer(t, nil)
+		err := s.replayBlockLogFile(s.ctx, logFile)
+		if !errors.Is(err, types.ErrMerkleRootMismatch) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				types.ErrMerkleRootMismatch)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		logFile := writeLog(t, func(b *wire.MsgBlock) {})
+		raw, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(logFile, raw[:len(raw)-1], 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestServer(t, nil)
+		if err := s.replayBlockLogFile(s.ctx, logFile); err == nil {
+			t.Fatal("expected an error replaying a truncated log")
+		}
+	})
+
+	t.Run("unknown magic", func(t *testing.T) {
+		logFile := testTempFile(t, "blocks.log")
+		if err := ioutil.WriteFile(logFile, []byte("drblog\x02"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestServer(t, nil)
+		err := s.replayBlockLogFile(s.ctx, logFile)
+		if !errors.Is(err, errInvalidBlockLog) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBlockLog)
+		}
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		logFile := testTempFile(t, "blocks.log")
+		s := newTestServer(t, nil)
+		f, err := openBlockLog(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.blockLog = f
+		for _, b := range []*wire.MsgBlock{c.blocks[0], c.blocks[2]} {
+			bh := b.BlockHash()
+			if err := s.appendBlockLog(&bh, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+		s.blockLog = nil
+		err = s.replayBlockLogFile(s.ctx, logFile)
+		if !errors.Is(err, errInvalidBlockLog) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBlockLog)
+		}
+	})
+}
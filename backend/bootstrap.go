@@ -0,0 +1,133 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"decred.org/dcrros/backend/backenddb"
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+)
+
+var (
+	errInvalidBootstrapFile = errors.New("invalid bootstrap file")
+)
+
+// importBootstrapFile processes the blocks stored in the given bootstrap file
+// into the server's db.
+//
+// A bootstrap file is a sequence of serialized mainchain blocks (in wire
+// format, without any framing) in increasing height order, such that an
+// initial sync can be performed without fetching every block from dcrd.
+// Blocks that were already processed are skipped, while the remaining ones
+// must extend the current db tip. Any blocks after the last one in the file
+// are fetched from dcrd as usual.
+//
+// The file is not as trustworthy as dcrd, therefore the merkle roots of every
+// block are verified against its header, regardless of the
+// VerifyBlockRoots option.
+func (s *Server) importBootstrapFile(ctx context.Context, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var tipHash chainhash.Hash
+	var tipHeight int64
+	err = s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var prev *wire.MsgBlock
+	utxoSet := make(map[wire.OutPoint]*types.PrevInput)
+	var nbBlocks int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The file only ends cleanly at a block boundary. Deserialize
+		// returns io.EOF whenever a field is entirely missing, which
+		// includes blocks truncated right before one of their fields.
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+		b := new(wire.MsgBlock)
+		if err := b.Deserialize(r); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidBootstrapFile, err)
+		}
+		if err := types.VerifyBlockRoots(b); err != nil {
+			return fmt.Errorf("bootstrap file: %w", err)
+		}
+		bh := b.BlockHash()
+		height := int64(b.Header.Height)
+
+		// Skip blocks that were already processed.
+		emptyDB := tipHash == (chainhash.Hash{})
+		if !emptyDB && height <= tipHeight {
+			var processedHash chainhash.Hash
+			err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+				var err error
+				processedHash, err = s.db.ProcessedBlockHash(dbtx, height)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if processedHash != bh {
+				return fmt.Errorf("%w: block %s at height %d does "+
+					"not match processed block %s",
+					errInvalidBootstrapFile, bh, height,
+					processedHash)
+			}
+			prev = b
+			continue
+		}
+
+		// Ensure the block extends the current tip.
+		switch {
+		case emptyDB && height == 0:
+		case height == tipHeight+1 && b.Header.PrevBlock == tipHash:
+		default:
+			return fmt.Errorf("%w: block %s at height %d does not "+
+				"extend tip %s at height %d", errInvalidBootstrapFile,
+				bh, height, tipHash, tipHeight)
+		}
+
+		if prev == nil && height > 0 {
+			if prev, err = s.getBlock(ctx, &b.Header.PrevBlock); err != nil {
+				return err
+			}
+		}
+		if err := s.preProcessAccountBlock(ctx, &bh, b, prev, utxoSet, nil); err != nil {
+			return err
+		}
+
+		prev = b
+		tipHash, tipHeight = bh, height
+		nbBlocks++
+		if tipHeight%2000 == 0 {
+			svrLog.Infof("Bootstrapped blocks up to height %d", tipHeight)
+		}
+	}
+
+	svrLog.Infof("Processed %d blocks from bootstrap file. Tip is %d %s",
+		nbBlocks, tipHeight, tipHash)
+	return nil
+}
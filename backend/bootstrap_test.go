@@ -0,0 +1,182 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// writeBootstrapFile writes the given blocks to a bootstrap file and returns
+// its name.
+func writeBootstrapFile(t *testing.T, blocks []*wire.MsgBlock) string {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		if err := b.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fname := testTempFile(t, "bootstrap.dat")
+	if err := ioutil.WriteFile(fname, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// TestImportBootstrapFile ensures the blocks of a bootstrap file are processed
+// into the db, skipping the ones that were already processed.
+func TestImportBootstrapFile(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(false, 4)
+	c.addBlock(true, 5, c.spendTx(b1.Transactions[0], 0, 6, 9e8))
+	fname := writeBootstrapFile(t, c.blocks)
+
+	ref := newTestServer(t, nil)
+	processTestBlocks(t, ref, nil, c.blocks...)
+	wantHash, wantHeight := testTip(t, ref)
+	wantBals := testBalances(t, ref)
+
+	tests := []struct {
+		name      string
+		processed int
+	}{{
+		name: "empty db",
+	}, {
+		name:      "partially processed db",
+		processed: 3,
+	}, {
+		name:      "fully processed db",
+		processed: len(c.blocks),
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			processTestBlocks(t, s, nil, c.blocks[:tc.processed]...)
+
+			// Importing the file twice is the same as importing it
+			// once.
+			for i := 0; i < 2; i++ {
+				if err := s.importBootstrapFile(s.ctx, fname); err != nil {
+					t.Fatalf("unable to import bootstrap file: %v",
+						err)
+				}
+				gotHash, gotHeight := testTip(t, s)
+				if gotHash != wantHash || gotHeight != wantHeight {
+					t.Fatalf("unexpected tip: got %d %s, want "+
+						"%d %s", gotHeight, gotHash,
+						wantHeight, wantHash)
+				}
+				gotBals := testBalances(t, s)
+				if !reflect.DeepEqual(gotBals, wantBals) {
+					t.Fatalf("unexpected balances: got %v, "+
+						"want %v", gotBals, wantBals)
+				}
+			}
+		})
+	}
+}
+
+// TestImportBootstrapFileInvalid ensures invalid bootstrap files are rejected.
+func TestImportBootstrapFileInvalid(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	c.addBlock(true, 2)
+	c.addBlock(true, 3)
+	fork2 := c.newBlock(c.blocks[1], true, 4)
+
+	// Helper to copy a block so it can be tampered with.
+	copyBlock := func(b *wire.MsgBlock) *wire.MsgBlock {
+		var bcopy wire.MsgBlock
+		raw, err := b.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bcopy.FromBytes(raw); err != nil {
+			t.Fatal(err)
+		}
+		return &bcopy
+	}
+
+	t.Run("tampered tx", func(t *testing.T) {
+		tampered := copyBlock(c.blocks[2])
+		tampered.Transactions[0].TxOut[0].Value++
+		fname := writeBootstrapFile(t, append(c.blocks[:2:2], tampered))
+		s := newTestServer(t, nil)
+		err := s.importBootstrapFile(s.ctx, fname)
+		if !errors.Is(err, types.ErrMerkleRootMismatch) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				types.ErrMerkleRootMismatch)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		fname := writeBootstrapFile(t, c.blocks)
+		raw, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, raw[:len(raw)-1], 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestServer(t, nil)
+		err = s.importBootstrapFile(s.ctx, fname)
+		if !errors.Is(err, errInvalidBootstrapFile) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBootstrapFile)
+		}
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		fname := writeBootstrapFile(t, []*wire.MsgBlock{c.blocks[0],
+			c.blocks[2]})
+		s := newTestServer(t, nil)
+		err := s.importBootstrapFile(s.ctx, fname)
+		if !errors.Is(err, errInvalidBootstrapFile) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBootstrapFile)
+		}
+	})
+
+	t.Run("not starting at genesis", func(t *testing.T) {
+		fname := writeBootstrapFile(t, c.blocks[1:])
+		s := newTestServer(t, nil)
+		err := s.importBootstrapFile(s.ctx, fname)
+		if !errors.Is(err, errInvalidBootstrapFile) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBootstrapFile)
+		}
+	})
+
+	t.Run("fork of processed chain", func(t *testing.T) {
+		fname := writeBootstrapFile(t, append(c.blocks[:2:2], fork2))
+		s := newTestServer(t, nil)
+		processTestBlocks(t, s, nil, c.blocks...)
+		err := s.importBootstrapFile(s.ctx, fname)
+		if !errors.Is(err, errInvalidBootstrapFile) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errInvalidBootstrapFile)
+		}
+
+		// The processed chain is left untouched.
+		gotHash, gotHeight := testTip(t, s)
+		if wantHash := c.tip().BlockHash(); gotHash != wantHash {
+			t.Fatalf("unexpected tip: got %d %s, want %s",
+				gotHeight, gotHash, wantHash)
+		}
+	})
+}
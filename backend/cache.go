@@ -0,0 +1,162 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats tracks statistics about the usage of one of the server's
+// in-memory caches.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Expired uint64
+}
+
+// ttlEntry is an entry stored in a ttlCache.
+type ttlEntry struct {
+	key   interface{}
+	value interface{}
+	added time.Time
+
+	// lruElem is the entry's element in the list ordered by use and
+	// ageElem its element in the list ordered by insertion time.
+	lruElem *list.Element
+	ageElem *list.Element
+}
+
+// ttlCache is an LRU key-value cache where entries are additionally evicted
+// once they are older than a maximum age.
+//
+// The cache never holds more than its limit of entries. Expired entries are
+// evicted on lookup and swept from the oldest ones every time a new entry is
+// added, so they don't linger in the cache until the limit is reached.
+//
+// A zero ttl disables time-based eviction.
+type ttlCache struct {
+	// The following fields must only be accessed atomically.
+	hits    uint64
+	misses  uint64
+	expired uint64
+
+	mtx     sync.Mutex
+	entries map[interface{}]*ttlEntry
+	lru     *list.List // Most recently used at the front.
+	age     *list.List // Oldest at the front.
+	limit   uint
+	ttl     time.Duration
+}
+
+func newTTLCache(limit uint, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		entries: make(map[interface{}]*ttlEntry),
+		lru:     list.New(),
+		age:     list.New(),
+		limit:   limit,
+		ttl:     ttl,
+	}
+}
+
+// remove removes the entry from the cache. It must be called with the mutex
+// held.
+func (c *ttlCache) remove(entry *ttlEntry) {
+	c.lru.Remove(entry.lruElem)
+	c.age.Remove(entry.ageElem)
+	delete(c.entries, entry.key)
+}
+
+// isExpired returns whether the entry is older than the ttl as of now.
+func (c *ttlCache) isExpired(entry *ttlEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(entry.added) > c.ttl
+}
+
+// sweep evicts all expired entries. It must be called with the mutex held.
+func (c *ttlCache) sweep(now time.Time) {
+	for e := c.age.Front(); e != nil; e = c.age.Front() {
+		entry := e.Value.(*ttlEntry)
+		if !c.isExpired(entry, now) {
+			return
+		}
+		c.remove(entry)
+		atomic.AddUint64(&c.expired, 1)
+	}
+}
+
+// Lookup returns the value associated with the given key if it exists in the
+// cache and has not yet expired.
+func (c *ttlCache) Lookup(key interface{}) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	if c.isExpired(entry, time.Now()) {
+		c.remove(entry)
+		atomic.AddUint64(&c.expired, 1)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(entry.lruElem)
+	atomic.AddUint64(&c.hits, 1)
+	return entry.value, true
+}
+
+// Add adds the given key and value to the cache, replacing any existing value
+// and restarting its ttl.
+func (c *ttlCache) Add(key, value interface{}) {
+	if c.limit == 0 {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	if entry, ok := c.entries[key]; ok {
+		entry.value = value
+		entry.added = now
+		c.lru.MoveToFront(entry.lruElem)
+		c.age.MoveToBack(entry.ageElem)
+		return
+	}
+
+	// Evict the least recently used entry when the cache is full.
+	if uint(len(c.entries)) >= c.limit {
+		c.remove(c.lru.Back().Value.(*ttlEntry))
+	}
+
+	entry := &ttlEntry{key: key, value: value, added: now}
+	entry.lruElem = c.lru.PushFront(entry)
+	entry.ageElem = c.age.PushBack(entry)
+	c.entries[key] = entry
+}
+
+// Len returns the number of entries in the cache, including expired entries
+// that have not been evicted yet.
+func (c *ttlCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.entries)
+}
+
+// Stats returns the current usage statistics of the cache.
+func (c *ttlCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Expired: atomic.LoadUint64(&c.expired),
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTTLCacheExpiry ensures entries older than the ttl are not returned and
+// are swept from the cache when new entries are added.
+func TestTTLCacheExpiry(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	c := newTTLCache(10, ttl)
+	c.Add(1, "one")
+	c.Add(2, "two")
+	if v, ok := c.Lookup(1); !ok || v != "one" {
+		t.Fatalf("unexpected lookup result: got %v %v, want one true",
+			v, ok)
+	}
+
+	time.Sleep(2 * ttl)
+
+	// Adding a new entry sweeps the expired ones, even if they were never
+	// looked up again.
+	c.Add(3, "three")
+	if got := c.Len(); got != 1 {
+		t.Fatalf("unexpected len after sweep: got %d, want 1", got)
+	}
+	for _, key := range []int{1, 2} {
+		if _, ok := c.Lookup(key); ok {
+			t.Fatalf("expired key %d was returned", key)
+		}
+	}
+	if v, ok := c.Lookup(3); !ok || v != "three" {
+		t.Fatalf("unexpected lookup result: got %v %v, want three true",
+			v, ok)
+	}
+
+	// Re-adding an entry restarts its ttl.
+	c.Add(3, "three")
+	time.Sleep(ttl / 2)
+	c.Add(3, "new three")
+	time.Sleep(ttl * 3 / 4)
+	if v, ok := c.Lookup(3); !ok || v != "new three" {
+		t.Fatalf("unexpected lookup result: got %v %v, want new three "+
+			"true", v, ok)
+	}
+
+	want := CacheStats{Hits: 3, Misses: 2, Expired: 2}
+	if got := c.Stats(); got != want {
+		t.Fatalf("unexpected stats: got %+v, want %+v", got, want)
+	}
+}
+
+// TestTTLCacheLimit ensures the cache never holds more than its limit of
+// entries, evicting the least recently used ones.
+func TestTTLCacheLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   uint
+		ttl     time.Duration
+		lookup  int
+		wantLen int
+		want    []int
+		evicted []int
+	}{{
+		name:    "no ttl",
+		limit:   3,
+		lookup:  1,
+		wantLen: 3,
+		want:    []int{1, 4, 5},
+		evicted: []int{2, 3},
+	}, {
+		name:    "with ttl",
+		limit:   3,
+		ttl:     time.Hour,
+		lookup:  1,
+		wantLen: 3,
+		want:    []int{1, 4, 5},
+		evicted: []int{2, 3},
+	}, {
+		name:    "zero limit",
+		limit:   0,
+		wantLen: 0,
+		evicted: []int{1, 2, 3, 4, 5},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTTLCache(tc.limit, tc.ttl)
+			for i := 1; i <= 3; i++ {
+				c.Add(i, i)
+			}
+			// Using an entry protects it from eviction.
+			c.Lookup(tc.lookup)
+			for i := 4; i <= 5; i++ {
+				c.Add(i, i)
+			}
+			if got := c.Len(); got != tc.wantLen {
+				t.Fatalf("unexpected len: got %d, want %d", got,
+					tc.wantLen)
+			}
+			for _, key := range tc.want {
+				if _, ok := c.Lookup(key); !ok {
+					t.Fatalf("key %d was evicted", key)
+				}
+			}
+			for _, key := range tc.evicted {
+				if _, ok := c.Lookup(key); ok {
+					t.Fatalf("key %d was not evicted", key)
+				}
+			}
+		})
+	}
+}
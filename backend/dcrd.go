@@ -8,7 +8,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"runtime"
 	"time"
 
 	"decred.org/dcrros/backend/backenddb"
@@ -17,11 +16,16 @@ import (
 	"github.com/decred/dcrd/chaincfg/chainhash"
 	"github.com/decred/dcrd/chaincfg/v3"
 	"github.com/decred/dcrd/dcrjson/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
 	"github.com/decred/dcrd/rpcclient/v6"
 	"github.com/decred/dcrd/wire"
 )
 
 const (
+	// maxDcrdTimeouts is the number of consecutive timed out dcrd requests
+	// after which the server is considered inactive.
+	maxDcrdTimeouts = 3
+
 	// The following define the minium json rpc server the underlying dcrd
 	// instance should be running on. These are interpreted according to
 	// semver, so any difference in major versions causes an error while we
@@ -114,6 +118,15 @@ func isErrRPCOutOfRange(err error) bool {
 	return false
 }
 
+// isErrRPCNoTxInfo returns true if the given error is the one returned by dcrd
+// when it doesn't know about a tx.
+func isErrRPCNoTxInfo(err error) bool {
+	if rpcerr, ok := err.(*dcrjson.RPCError); ok && rpcerr.Code == dcrjson.ErrRPCNoTxInfo {
+		return true
+	}
+	return false
+}
+
 // waitForBlockchainSync blocks until the underlying dcrd node is synced to the
 // best known chain.
 func (s *Server) waitForBlockchainSync(ctx context.Context) error {
@@ -179,6 +192,66 @@ func (s *Server) bestBlock(ctx context.Context) (*chainhash.Hash, int64, *wire.M
 	return hash, int64(block.Header.Height), block, nil
 }
 
+// dcrdCall calls f with a context that is canceled after the configured dcrd
+// request timeout.
+//
+// Calls that time out return types.ErrDcrdTimeout. A call is classified as
+// timed out based on the error returned by f, so calls that complete right at
+// the deadline are not counted: either f fails with context.DeadlineExceeded
+// or with the rpcclient error for canceled requests (which doesn't wrap the
+// reason) after the call deadline, but not the parent one, expired. After
+// maxDcrdTimeouts consecutive timeouts, the server is marked as inactive until
+// either dcrd reconnects or a later call succeeds.
+func (s *Server) dcrdCall(ctx context.Context, f func(context.Context) error) error {
+	if s.dcrdTimeout == 0 {
+		return f(ctx)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, s.dcrdTimeout)
+	err := f(rctx)
+	canceled := errors.Is(err, context.DeadlineExceeded) ||
+		(errors.Is(err, rpcclient.ErrRequestCanceled) &&
+			errors.Is(rctx.Err(), context.DeadlineExceeded))
+	timedOut := canceled && ctx.Err() == nil
+	cancel()
+
+	s.mtx.Lock()
+	if !timedOut {
+		s.dcrdTimeouts = 0
+		if err == nil && !s.active && errors.Is(s.dcrdErr, types.ErrDcrdTimeout) {
+			svrLog.Infof("dcrd is responsive again. Enabling server " +
+				"operations")
+			s.active = true
+			s.dcrdErr = nil
+			s.cachedStatus = nil
+		}
+		s.mtx.Unlock()
+		return err
+	}
+	s.dcrdTimeouts++
+	if s.dcrdTimeouts == maxDcrdTimeouts {
+		svrLog.Errorf("Disabling server operations after %d "+
+			"consecutive dcrd timeouts", s.dcrdTimeouts)
+		s.active = false
+		s.dcrdErr = types.ErrDcrdTimeout
+		s.cachedStatus = nil
+	}
+	s.mtx.Unlock()
+	return types.ErrDcrdTimeout
+}
+
+// getChainBlockHash returns the hash of the block at the given height of the
+// chain currently followed by dcrd, which may not have been processed yet.
+func (s *Server) getChainBlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	var bh *chainhash.Hash
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		bh, err = s.c.GetBlockHash(ctx, height)
+		return err
+	})
+	return bh, err
+}
+
 // getBlockByHeight returns the given block identified by its hash.
 //
 // It returns a types.ErrBlockNotFound if the given block is not found.
@@ -190,7 +263,19 @@ func (s *Server) getBlock(ctx context.Context, bh *chainhash.Hash) (*wire.MsgBlo
 		return bl.(*wire.MsgBlock), nil
 	}
 
-	b, err := s.c.GetBlock(ctx, bh)
+	var b *wire.MsgBlock
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		b, err = s.c.GetBlock(ctx, bh)
+		return err
+	})
+	if err == nil && s.verifyBlockRoots {
+		err = types.VerifyBlockRoots(b)
+		if err != nil {
+			svrLog.Errorf("Received corrupted block from dcrd: %v", err)
+			return nil, err
+		}
+	}
 	if err == nil {
 		s.cacheBlocks.Add(*bh, b)
 		return b, err
@@ -305,7 +390,12 @@ func (s *Server) getRawTx(ctx context.Context, txh *chainhash.Hash) (*wire.MsgTx
 		return tx.(*wire.MsgTx), nil
 	}
 
-	tx, err := s.c.GetRawTransaction(ctx, txh)
+	var tx *dcrutil.Tx
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		tx, err = s.c.GetRawTransaction(ctx, txh)
+		return err
+	})
 	if err == nil {
 		s.cacheRawTxs.Add(*txh, tx.MsgTx())
 		return tx.MsgTx(), nil
@@ -315,7 +405,7 @@ func (s *Server) getRawTx(ctx context.Context, txh *chainhash.Hash) (*wire.MsgTx
 }
 
 func (s *Server) processSequentialBlocks(ctx context.Context, startHeight int64, f func(*chainhash.Hash, *wire.MsgBlock) error) error {
-	concurrency := int64(runtime.NumCPU())
+	concurrency := int64(s.concurrency())
 	type gbbhReply struct {
 		block *wire.MsgBlock
 		hash  *chainhash.Hash
@@ -331,7 +421,12 @@ func (s *Server) processSequentialBlocks(ctx context.Context, startHeight int64,
 			i := int64(0)
 			for {
 				var bl *wire.MsgBlock
-				bh, err := s.c.GetBlockHash(gctx, start+i)
+				var bh *chainhash.Hash
+				err := s.dcrdCall(gctx, func(ctx context.Context) error {
+					var err error
+					bh, err = s.c.GetBlockHash(ctx, start+i)
+					return err
+				})
 				if isErrRPCOutOfRange(err) {
 					err = types.ErrBlockIndexAfterTip
 				}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/rpcclient/v6"
+)
+
+// TestDcrdCallTimeout ensures dcrd calls are classified as timed out based on
+// the error returned by the call.
+func TestDcrdCallTimeout(t *testing.T) {
+	errOther := errors.New("other error")
+
+	// Helper that waits for the call deadline and then returns err.
+	afterDeadline := func(err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			<-ctx.Done()
+			if err == nil {
+				return nil
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+
+	tests := []struct {
+		name         string
+		f            func(context.Context) error
+		cancelParent bool
+		wantErr      error
+	}{{
+		name:    "deadline exceeded",
+		f:       afterDeadline(context.DeadlineExceeded),
+		wantErr: types.ErrDcrdTimeout,
+	}, {
+		name:    "rpcclient canceled at deadline",
+		f:       afterDeadline(rpcclient.ErrRequestCanceled),
+		wantErr: types.ErrDcrdTimeout,
+	}, {
+		name: "rpcclient canceled before deadline",
+		f: func(ctx context.Context) error {
+			return rpcclient.ErrRequestCanceled
+		},
+		wantErr: rpcclient.ErrRequestCanceled,
+	}, {
+		name:    "completes at deadline",
+		f:       afterDeadline(nil),
+		wantErr: nil,
+	}, {
+		name:    "other error at deadline",
+		f:       afterDeadline(errOther),
+		wantErr: errOther,
+	}, {
+		name: "parent canceled",
+		f: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		cancelParent: true,
+		wantErr:      context.Canceled,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				DcrdTimeout: 10 * time.Millisecond,
+			})
+			ctx, cancel := context.WithCancel(s.ctx)
+			defer cancel()
+			if tc.cancelParent {
+				cancel()
+			}
+			err := s.dcrdCall(ctx, tc.f)
+			if !errors.Is(err, tc.wantErr) || (err == nil) != (tc.wantErr == nil) {
+				t.Fatalf("unexpected error: got %v, want %v", err,
+					tc.wantErr)
+			}
+			wantTimeouts := 0
+			if errors.Is(tc.wantErr, types.ErrDcrdTimeout) {
+				wantTimeouts = 1
+			}
+			if s.dcrdTimeouts != wantTimeouts {
+				t.Fatalf("unexpected timeout count: got %d, want %d",
+					s.dcrdTimeouts, wantTimeouts)
+			}
+		})
+	}
+}
+
+// TestDcrdCallSlowDcrd ensures calls to a dcrd instance that delays its
+// replies past the dcrd timeout fail with ErrDcrdTimeout, disabling the server
+// after maxDcrdTimeouts consecutive ones, and that the server is enabled again
+// once dcrd replies in time.
+func TestDcrdCallSlowDcrd(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+
+	s := newTestServer(t, &ServerConfig{DcrdTimeout: 20 * time.Millisecond})
+	d := newFakeDcrd(t, s, c.blocks)
+	s.active = true
+	d.setDelay(time.Second)
+
+	for i := 1; i <= maxDcrdTimeouts; i++ {
+		_, err := s.getChainBlockHash(s.ctx, 1)
+		if !errors.Is(err, types.ErrDcrdTimeout) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				types.ErrDcrdTimeout)
+		}
+		if wantActive := i < maxDcrdTimeouts; s.Active() != wantActive {
+			t.Fatalf("unexpected active state after %d timeouts: "+
+				"got %v, want %v", i, !wantActive, wantActive)
+		}
+	}
+
+	d.setDelay(0)
+	bh, err := s.getChainBlockHash(s.ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *bh != c.tip().BlockHash() {
+		t.Fatalf("unexpected block hash: got %s, want %s", bh,
+			c.tip().BlockHash())
+	}
+	if !s.Active() {
+		t.Fatal("server not enabled after dcrd replied in time")
+	}
+}
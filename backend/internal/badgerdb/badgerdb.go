@@ -8,7 +8,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"decred.org/dcrros/backend/backenddb"
 	"github.com/decred/dcrd/chaincfg/chainhash"
@@ -30,12 +33,26 @@ func (tx *transaction) Writable() bool {
 	return tx.writable
 }
 
+// gcDiscardRatio is the fraction of a value log file that must be stale for
+// it to be rewritten during value log GC.
+const gcDiscardRatio = 0.5
+
 type BadgerDB struct {
 	mtx sync.Mutex
 	db  *badger.DB
+
+	// gcQuit and gcDone are used to stop the value log GC goroutine.
+	gcQuit chan struct{}
+	gcDone chan struct{}
 }
 
-func NewBadgerDB(filepath string) (*BadgerDB, error) {
+// NewBadgerDB opens the badger db at the given path, or an in-memory db if the
+// path is empty.
+//
+// When gcInterval is not zero, the value log of on-disk dbs is garbage
+// collected in the background at the given interval, which reclaims the disk
+// space used by overwritten and deleted entries.
+func NewBadgerDB(filepath string, gcInterval time.Duration) (*BadgerDB, error) {
 	var db *badger.DB
 	var err error
 	var opts badger.Options
@@ -51,9 +68,51 @@ func NewBadgerDB(filepath string) (*BadgerDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &BadgerDB{
+	bdb := &BadgerDB{
 		db: db,
-	}, nil
+	}
+	if gcInterval > 0 && filepath != "" {
+		bdb.gcQuit = make(chan struct{})
+		bdb.gcDone = make(chan struct{})
+		go bdb.runValueLogGC(gcInterval)
+	}
+	return bdb, nil
+}
+
+// runValueLogGC periodically garbage collects the value log until Close is
+// called.
+func (db *BadgerDB) runValueLogGC(interval time.Duration) {
+	defer close(db.gcDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.gcQuit:
+			return
+		case <-ticker.C:
+		}
+
+		// Each call rewrites at most one file, so keep going until
+		// there's nothing left to collect.
+		var nbRewrites int
+		var err error
+		for err == nil {
+			select {
+			case <-db.gcQuit:
+				return
+			default:
+			}
+			if err = db.db.RunValueLogGC(gcDiscardRatio); err == nil {
+				nbRewrites++
+			}
+		}
+		if !errors.Is(err, badger.ErrNoRewrite) {
+			log.Warnf("Unable to garbage collect value log: %v", err)
+		}
+		if nbRewrites > 0 {
+			log.Debugf("Rewrote %d value log files during GC", nbRewrites)
+		}
+	}
 }
 
 func (db *BadgerDB) Balance(rtx backenddb.ReadTx, accountAddr string, height int64) (dcrutil.Amount, error) {
@@ -62,6 +121,11 @@ func (db *BadgerDB) Balance(rtx backenddb.ReadTx, accountAddr string, height int
 	return balance, err
 }
 
+func (db *BadgerDB) Balances(rtx backenddb.ReadTx, height int64, f func(string, dcrutil.Amount) error) error {
+	tx := rtx.(*transaction)
+	return fetchAccountBalances(tx.tx, height, f)
+}
+
 func (db *BadgerDB) LastProcessedBlock(rtx backenddb.ReadTx) (chainhash.Hash, int64, error) {
 	tx := rtx.(*transaction)
 	return fetchLastProcessedAccountBlock(tx.tx)
@@ -78,12 +142,32 @@ func (db *BadgerDB) ProcessedBlockHash(rtx backenddb.ReadTx, height int64) (chai
 	return hash, nil
 }
 
+func (db *BadgerDB) AccountFormat(rtx backenddb.ReadTx) (uint32, error) {
+	tx := rtx.(*transaction)
+	return fetchAccountFormat(tx.tx)
+}
+
+func (db *BadgerDB) StoreAccountFormat(wtx backenddb.WriteTx, version uint32) error {
+	if !wtx.Writable() {
+		return fmt.Errorf("unwritable tx")
+	}
+	tx := wtx.(*transaction)
+	return putAccountFormat(tx.tx, version)
+}
+
 func (db *BadgerDB) RollbackTip(wtx backenddb.WriteTx, height int64, blockHash chainhash.Hash) error {
 	tx := wtx.(*transaction)
 	if !wtx.Writable() {
 		return fmt.Errorf("unwritable tx")
 	}
 
+	// Every piece of data stored for a block (the processed block hash,
+	// the balances modified by it and the list of modified accounts) is
+	// keyed by its height, and the processed block hash at each height
+	// identifies the canonical block. Deleting the keys at the rolled back
+	// height is therefore sufficient for a block later stored at the same
+	// height, even one previously rolled back (A->B->A reorgs), to be
+	// processed from scratch without reusing stale data.
 	tipHash, tipHeight, err := fetchLastProcessedAccountBlock(tx.tx)
 	if err != nil {
 		return err
@@ -99,11 +183,16 @@ func (db *BadgerDB) RollbackTip(wtx backenddb.WriteTx, height int64, blockHash c
 		return err
 	}
 
-	// Go over each one and remove the balance at that height.
+	// Go over each one and remove the balance at that height. The list of
+	// modified accounts is also removed, so that it doesn't leak into the
+	// block that replaces the rolled back one at this height.
 	for _, acct := range accounts {
 		if err := delAccountBalanceAt(tx.tx, acct, height); err != nil {
 			return err
 		}
+		if err := delBlockAccount(tx.tx, height, acct); err != nil {
+			return err
+		}
 	}
 
 	// Find out the block hash at the previous height. This assumes we
@@ -128,6 +217,14 @@ func (db *BadgerDB) StoreBalances(wtx backenddb.WriteTx, blockHash chainhash.Has
 	}
 
 	tx := wtx.(*transaction)
+	_, err := fetchProcessedBlockHash(tx.tx, height)
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: %d", backenddb.ErrHeightProcessed, height)
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+
 	for account, balance := range balances {
 		if err := putAccountBalanceAt(tx.tx, account, height, balance); err != nil {
 			return err
@@ -152,13 +249,32 @@ func (db *BadgerDB) View(ctx context.Context, f func(tx backenddb.ReadTx) error)
 	})
 }
 
+// wrapNoSpace returns an error that wraps syscall.ENOSPC when the given error
+// was caused by running out of disk space, so callers can detect it with
+// errors.Is. Badger flattens the errors it wraps into their message when not
+// built in debug mode, so they can't always be unwrapped.
+func wrapNoSpace(err error) error {
+	if err == nil || errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if strings.Contains(err.Error(), syscall.ENOSPC.Error()) {
+		return fmt.Errorf("%w: %v", syscall.ENOSPC, err)
+	}
+	return err
+}
+
 func (db *BadgerDB) Update(ctx context.Context, f func(tx backenddb.WriteTx) error) error {
-	return db.db.Update(func(dbtx *badger.Txn) error {
+	err := db.db.Update(func(dbtx *badger.Txn) error {
 		tx := &transaction{ctx: ctx, tx: dbtx, writable: true}
 		return f(tx)
 	})
+	return wrapNoSpace(err)
 }
 
 func (db *BadgerDB) Close() error {
+	if db.gcQuit != nil {
+		close(db.gcQuit)
+		<-db.gcDone
+	}
 	return db.db.Close()
 }
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package badgerdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"decred.org/dcrros/backend/backenddb"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v3"
+)
+
+// TestValueLogGC ensures the value log GC goroutine only runs for on-disk dbs
+// when configured, doesn't change the stored data and stops when the db is
+// closed.
+func TestValueLogGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcrros-badgerdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// GC is disabled for in-memory dbs and without an interval.
+	noGC := []struct {
+		path       string
+		gcInterval time.Duration
+	}{
+		{"", time.Millisecond},
+		{dir, 0},
+	}
+	for _, tc := range noGC {
+		db, err := NewBadgerDB(tc.path, tc.gcInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.gcQuit != nil {
+			t.Fatalf("unexpected GC goroutine for db %q with "+
+				"interval %s", tc.path, tc.gcInterval)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewBadgerDB(dir, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Store the balances of a few blocks, rolling back some of them so
+	// that the value log has stale entries.
+	const nbBlocks = 50
+	blockHash := func(height int64, fork bool) chainhash.Hash {
+		var hash chainhash.Hash
+		hash[0], hash[1] = byte(height), byte(height>>8)
+		if fork {
+			hash[2] = 1
+		}
+		return hash
+	}
+	balance := func(height int64) dcrutil.Amount {
+		return dcrutil.Amount(height * 1e8)
+	}
+	accounts := []string{"acct1", "acct2"}
+	for height := int64(0); height < nbBlocks; height++ {
+		err := db.Update(ctx, func(tx backenddb.WriteTx) error {
+			if height%10 == 5 {
+				// Store and roll back a fork block first.
+				err := db.StoreBalances(tx, blockHash(height, true),
+					height, map[string]dcrutil.Amount{
+						accounts[0]: 1,
+					})
+				if err != nil {
+					return err
+				}
+				err = db.RollbackTip(tx, height, blockHash(height, true))
+				if err != nil {
+					return err
+				}
+			}
+			return db.StoreBalances(tx, blockHash(height, false), height,
+				map[string]dcrutil.Amount{
+					accounts[height%2]: balance(height),
+				})
+		})
+		if err != nil {
+			t.Fatalf("unable to store block %d: %v", height, err)
+		}
+	}
+
+	// Helper to verify the stored data.
+	verify := func(db *BadgerDB) {
+		t.Helper()
+		err := db.View(ctx, func(tx backenddb.ReadTx) error {
+			tipHash, tipHeight, err := db.LastProcessedBlock(tx)
+			if err != nil {
+				return err
+			}
+			if tipHeight != nbBlocks-1 || tipHash != blockHash(nbBlocks-1, false) {
+				t.Fatalf("unexpected tip: got %d %s", tipHeight,
+					tipHash)
+			}
+			for height := int64(0); height < nbBlocks; height++ {
+				hash, err := db.ProcessedBlockHash(tx, height)
+				if err != nil {
+					return err
+				}
+				if hash != blockHash(height, false) {
+					t.Fatalf("unexpected block at height %d: "+
+						"got %s", height, hash)
+				}
+				got, err := db.Balance(tx, accounts[height%2], height)
+				if err != nil {
+					return err
+				}
+				if got != balance(height) {
+					t.Fatalf("unexpected balance at height %d: "+
+						"got %v, want %v", height, got,
+						balance(height))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Let GC run a few times.
+	time.Sleep(100 * time.Millisecond)
+	verify(db)
+
+	// Closing the db stops the GC goroutine.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-db.gcDone:
+	default:
+		t.Fatal("GC goroutine still running after closing the db")
+	}
+
+	// The data is intact after reopening the db.
+	db, err = NewBadgerDB(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+}
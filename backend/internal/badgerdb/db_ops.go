@@ -23,6 +23,11 @@ var (
 	// [0:32]:  Block Hash
 	// [32:40]: Block Height
 	lastProcessedBlockKey = []byte("last-processed-block")
+
+	// accountFormatKey is the key to the value that holds the version of
+	// the format of the stored account addresses, serialized as a 4 byte
+	// big endian integer.
+	accountFormatKey = []byte("account-format")
 )
 
 const (
@@ -88,6 +93,61 @@ func fetchAccountBalanceAt(dbtx *badger.Txn, account string, height int64) (dcru
 	return balance, lastHeight, nil
 }
 
+// fetchAccountBalances calls f with the balance of every account as of the
+// given height.
+func fetchAccountBalances(dbtx *badger.Txn, height int64, f func(string, dcrutil.Amount) error) error {
+	keyPrefix := []byte(accountBalanceKeyPrefix)
+	itOpts := badger.DefaultIteratorOptions
+	itOpts.Prefix = keyPrefix
+	it := dbtx.NewIterator(itOpts)
+	defer it.Close()
+
+	// Keys are sorted by account then height, so track the last balance
+	// seen for the current account and report it once all of its entries
+	// have been iterated over.
+	var account string
+	var balance dcrutil.Amount
+	var found bool
+	for it.Rewind(); it.ValidForPrefix(keyPrefix); it.Next() {
+		item := it.Item()
+		k := item.Key()
+		if len(k) < len(keyPrefix)+1+8 {
+			return fmt.Errorf("wrong size in balance key")
+		}
+		keyAccount := string(k[len(keyPrefix) : len(k)-1-8])
+		if keyAccount != account {
+			if found {
+				if err := f(account, balance); err != nil {
+					return err
+				}
+			}
+			account = keyAccount
+			found = false
+		}
+
+		if extractAccountBalanceKeyHeight(k) > height {
+			continue
+		}
+
+		err := item.Value(func(v []byte) error {
+			if len(v) != 8 {
+				return fmt.Errorf("wrong size in balance value")
+			}
+			balance = dcrutil.Amount(binary.BigEndian.Uint64(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+
+	if found {
+		return f(account, balance)
+	}
+	return nil
+}
+
 func putAccountBalanceAt(dbtx *badger.Txn, account string, height int64, balance dcrutil.Amount) error {
 	k := accountBalanceAtHeightKey(account, height)
 	var v [8]byte
@@ -125,6 +185,31 @@ func fetchLastProcessedAccountBlock(dbtx *badger.Txn) (chainhash.Hash, int64, er
 	return hash, height, err
 }
 
+func putAccountFormat(dbtx *badger.Txn, version uint32) error {
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], version)
+	return dbtx.Set(accountFormatKey, v[:])
+}
+
+func fetchAccountFormat(dbtx *badger.Txn) (uint32, error) {
+	item, err := dbtx.Get(accountFormatKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var version uint32
+	err = item.Value(func(v []byte) error {
+		if len(v) != 4 {
+			return fmt.Errorf("invalid account format value length %d", len(v))
+		}
+		version = binary.BigEndian.Uint32(v)
+		return nil
+	})
+	return version, err
+}
+
 func processedBlockKey(height int64) []byte {
 	key := make([]byte, len(processedBlockHashKeyPrefix)+8)
 	k := key[copy(key[:], processedBlockHashKeyPrefix):]
@@ -171,6 +256,10 @@ func putBlockAccount(dbtx *badger.Txn, height int64, account string) error {
 	return dbtx.Set(blockAccountKey(height, account), nil)
 }
 
+func delBlockAccount(dbtx *badger.Txn, height int64, account string) error {
+	return dbtx.Delete(blockAccountKey(height, account))
+}
+
 func fetchBlockAccounts(dbtx *badger.Txn, height int64) ([]string, error) {
 	keyPrefix := blockAccountKey(height, "")
 	accounts := make([]string, 0)
@@ -33,6 +33,7 @@ type transaction struct {
 	blockHash       chainhash.Hash
 	blockHeight     int64
 	processedBlocks map[int64]*processedBlock
+	accountFormat   uint32
 }
 
 func (t *transaction) Context() context.Context {
@@ -48,6 +49,7 @@ type MemDB struct {
 	lastBlockHash   chainhash.Hash
 	lastHeight      int64
 	processedBlocks map[int64]*processedBlock
+	accountFormat   uint32
 	mtx             sync.Mutex
 }
 
@@ -95,6 +97,28 @@ func (db *MemDB) Balance(rtx backenddb.ReadTx, accountAddr string, height int64)
 	return balance, nil
 }
 
+// Balances calls f for every account with its balance as of the given height.
+//
+// The accounts are copied before calling f, so that f may modify the db
+// through the same tx. The tx holds the db mutex, so the copy is consistent
+// with the balances.
+func (db *MemDB) Balances(rtx backenddb.ReadTx, height int64, f func(string, dcrutil.Amount) error) error {
+	accounts := make([]string, 0, len(db.balances))
+	for account := range db.balances {
+		accounts = append(accounts, account)
+	}
+	for _, account := range accounts {
+		balance, err := db.Balance(rtx, account, height)
+		if err != nil {
+			return err
+		}
+		if err := f(account, balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *MemDB) LastProcessedBlock(rtx backenddb.ReadTx) (chainhash.Hash, int64, error) {
 	tx := rtx.(*transaction)
 	if tx.updatedBlock {
@@ -109,6 +133,12 @@ func (db *MemDB) StoreBalances(wtx backenddb.WriteTx, blockHash chainhash.Hash,
 	}
 
 	tx := wtx.(*transaction)
+	_, inTx := tx.processedBlocks[height]
+	_, inDb := db.processedBlocks[height]
+	if inTx || inDb {
+		return fmt.Errorf("%w: %d", backenddb.ErrHeightProcessed, height)
+	}
+
 	accounts := make([]string, 0, len(balances))
 	for account, balance := range balances {
 		bh := balanceHeight{height: height, balance: balance}
@@ -143,6 +173,22 @@ func (db *MemDB) ProcessedBlockHash(rtx backenddb.ReadTx, height int64) (chainha
 	return b.hash, nil
 }
 
+func (db *MemDB) AccountFormat(rtx backenddb.ReadTx) (uint32, error) {
+	tx := rtx.(*transaction)
+	if tx.accountFormat != 0 {
+		return tx.accountFormat, nil
+	}
+	return db.accountFormat, nil
+}
+
+func (db *MemDB) StoreAccountFormat(wtx backenddb.WriteTx, version uint32) error {
+	if !wtx.Writable() {
+		return fmt.Errorf("unwritable tx")
+	}
+	wtx.(*transaction).accountFormat = version
+	return nil
+}
+
 // RollbackTip rolls back the current tip. Note this only works if the
 // transaction hasn't already modified the tip.
 func (db *MemDB) RollbackTip(wtx backenddb.WriteTx, height int64, blockHash chainhash.Hash) error {
@@ -162,6 +208,13 @@ func (db *MemDB) RollbackTip(wtx backenddb.WriteTx, height int64, blockHash chai
 		return backenddb.ErrNotTip
 	}
 
+	// The previous block might not exist if the db was bootstrapped from
+	// a snapshot.
+	prev, ok := db.processedBlocks[height-1]
+	if !ok {
+		return backenddb.ErrBlockHeightNotFound
+	}
+
 	// Remove balance changes from the accounts. This is technically wrong,
 	// in that it removes directly from the db struct instead of storing
 	// the change in a journal-like fashion in the tx, but suffices for the
@@ -185,7 +238,6 @@ func (db *MemDB) RollbackTip(wtx backenddb.WriteTx, height int64, blockHash chai
 	delete(db.processedBlocks, height)
 
 	// Store the previous block as the new tip.
-	prev := db.processedBlocks[height-1]
 	tx.blockHash = prev.hash
 	tx.blockHeight = height - 1
 	tx.updatedBlock = true
@@ -225,6 +277,10 @@ func (db *MemDB) Update(ctx context.Context, f func(tx backenddb.WriteTx) error)
 		db.processedBlocks[bh] = b
 	}
 
+	if tx.accountFormat != 0 {
+		db.accountFormat = tx.accountFormat
+	}
+
 	// Record the last processed height.
 	if tx.updatedBlock {
 		db.lastBlockHash = tx.blockHash
@@ -8,12 +8,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	"decred.org/dcrros/backend/backenddb"
 	"decred.org/dcrros/backend/internal/badgerdb"
 	"decred.org/dcrros/backend/internal/memdb"
+	"decred.org/dcrros/types"
 	"github.com/coinbase/rosetta-sdk-go/asserter"
 	rserver "github.com/coinbase/rosetta-sdk-go/server"
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
@@ -28,6 +32,38 @@ const (
 	// rosettaVersion is the version of the rosetta spec this backend
 	// currently implements.
 	rosettaVersion = "1.3.1"
+
+	// dcrdCheckRetryInterval is the interval between attempts to verify
+	// a reconnected dcrd instance during the grace period.
+	dcrdCheckRetryInterval = 5 * time.Second
+
+	// defaultGapFillBatchSize is the default number of missing blocks
+	// processed in a row while catching up to a connected block.
+	defaultGapFillBatchSize = 100
+
+	// syncRetryDelay and maxSyncRetryDelay are the initial and maximum
+	// delays between attempts to resume a failed initial sync.
+	syncRetryDelay    = time.Second
+	maxSyncRetryDelay = time.Minute
+
+	// defaultBlockNtfnQueueSize is the default maximum number of block
+	// notifications queued for processing.
+	defaultBlockNtfnQueueSize = 1000
+
+	// migrationBatchSize is the number of blocks rolled back per db
+	// transaction while migrating the account format of a db.
+	migrationBatchSize = 100
+
+	// diskFullRetryInterval is the interval after which block
+	// notifications that failed due to lack of disk space are queued
+	// again.
+	diskFullRetryInterval = time.Minute
+)
+
+var (
+	// errReorgTooDeep is returned when handling a reorg requires rolling
+	// back more blocks than the configured maximum reorg depth.
+	errReorgTooDeep = errors.New("reorg exceeds maximum depth")
 )
 
 type DBType string
@@ -60,8 +96,176 @@ type ServerConfig struct {
 	DBType      DBType
 	DBDir       string
 
+	// DBGCInterval is the interval between garbage collections of the
+	// value log of badger dbs. Zero disables garbage collection.
+	DBGCInterval time.Duration
+
 	CacheSizeBlocks uint
 	CacheSizeRawTxs uint
+
+	// CacheSizePrevInputs is the number of outputs created by processed
+	// blocks that are kept in memory to avoid fetching them from dcrd
+	// once they are spent.
+	CacheSizePrevInputs uint
+
+	// CacheRawTxTTL is the maximum age of entries in the raw tx cache.
+	// Zero means entries are only evicted once the cache is full.
+	CacheRawTxTTL time.Duration
+
+	// BalanceConfirmations is the number of blocks behind the tip at
+	// which balances are reported when the client does not request a
+	// specific block.
+	BalanceConfirmations uint
+
+	// SnapshotFile is the path to a balance snapshot used to bootstrap an
+	// empty db.
+	SnapshotFile string
+
+	// ExportSnapshotFile is the path where a balance snapshot is written
+	// to after the initial sync is complete.
+	ExportSnapshotFile string
+
+	// BlockLogFile is the path to a file where every processed block is
+	// appended to.
+	BlockLogFile string
+
+	// ImportBlockLogFile is the path to a block log file that is replayed
+	// into the db during startup, before fetching any remaining blocks
+	// from dcrd.
+	ImportBlockLogFile string
+
+	// BootstrapFile is the path to a file with serialized mainchain
+	// blocks that are processed during startup, before fetching any
+	// remaining blocks from dcrd.
+	BootstrapFile string
+
+	// IncludeHeaderHex includes the serialized block header in the
+	// metadata of blocks.
+	IncludeHeaderHex bool
+
+	// LikelyChange flags outputs of transactions that are likely to be
+	// change outputs.
+	LikelyChange bool
+
+	// RelatedOps links the operations of each transaction through their
+	// related_operations.
+	RelatedOps bool
+
+	// IncludeEmptyTxs includes transactions without any operations in
+	// the list of transactions of blocks.
+	IncludeEmptyTxs bool
+
+	// AccountPkScript includes the pkScript of the output created or
+	// spent by each operation in the metadata of its account identifier.
+	AccountPkScript bool
+
+	// IncludeRawTx includes the serialized transaction in the metadata of
+	// every transaction.
+	IncludeRawTx bool
+
+	// FeeOps appends a synthetic fee operation to every transaction that
+	// pays a fee.
+	FeeOps bool
+
+	// RedeemScriptClass includes the class of the redeem script revealed
+	// by debits spending P2SH outputs in their metadata.
+	RedeemScriptClass bool
+
+	// SyncConcurrency is the maximum number of concurrent requests to
+	// dcrd performed while the server is executing its initial sync.
+	// Defaults to the number of CPUs.
+	SyncConcurrency uint
+
+	// ServeConcurrency is the maximum number of concurrent requests to
+	// dcrd performed by each operation once the initial sync is complete.
+	// Defaults to the number of CPUs.
+	ServeConcurrency uint
+
+	// OmitOpMetadata lists operation metadata keys that are not returned
+	// to clients.
+	OmitOpMetadata []string
+
+	// StakedSubAccount tracks funds locked in tickets in the "staked"
+	// sub-account of their owner's account. Changing this option requires
+	// reprocessing the chain from an empty db.
+	StakedSubAccount bool
+
+	// DcrdTimeout is the maximum amount of time to wait for individual
+	// requests to dcrd. Zero means no timeout.
+	DcrdTimeout time.Duration
+
+	// DcrdGracePeriod is the amount of time during which a reconnected
+	// dcrd instance that is unsuitable is checked again before the server
+	// is disabled.
+	DcrdGracePeriod time.Duration
+
+	// DcrdMaxRetryInterval is the maximum interval between checks of a
+	// reconnected dcrd instance during the grace period. The interval
+	// starts at 5 seconds and doubles after every failed check up to
+	// this value. Zero keeps the interval constant.
+	DcrdMaxRetryInterval time.Duration
+
+	// NetworkStatusCacheTTL is the amount of time a network status
+	// response is reused for. Zero disables caching.
+	NetworkStatusCacheTTL time.Duration
+
+	// GapFillBatchSize is the maximum number of missing blocks processed
+	// in a row while catching up to a connected block before checking
+	// whether the server is shutting down. Defaults to 100.
+	GapFillBatchSize uint
+
+	// SyncRetries is the number of times a failed initial sync is resumed
+	// from the last processed block before the server gives up. Zero
+	// halts on the first error.
+	SyncRetries uint
+
+	// MaxReorgDepth is the maximum number of processed blocks that may be
+	// rolled back while handling a reorg, counting every block rolled back
+	// since the last connected block. The server stops instead of rolling
+	// back deeper reorgs. Zero disables the limit.
+	MaxReorgDepth uint
+
+	// IgnoreAccountFormat starts the server even if the db was created
+	// with a different account format version, instead of migrating the
+	// db to the current version.
+	IgnoreAccountFormat bool
+
+	// ReadyAfterBlock only reports the server as ready after the first
+	// block notification received once the initial sync is complete is
+	// successfully handled, instead of as soon as the initial sync
+	// completes.
+	ReadyAfterBlock bool
+
+	// CheckImmatureSpends rejects submitted transactions that spend
+	// coinbase, vote or revocation outputs which would still be immature
+	// in the next block, instead of relaying them to dcrd.
+	CheckImmatureSpends bool
+
+	// SlowBlockThreshold is the processing time of a connected block
+	// after which a warning with the time spent in each phase is logged.
+	// Zero disables the warning.
+	SlowBlockThreshold time.Duration
+
+	// VerifyBlockRoots recalculates the merkle and stake roots of blocks
+	// received from dcrd and errors if they don't match their headers.
+	VerifyBlockRoots bool
+
+	// FetchConcurrency is the maximum number of concurrent requests to
+	// dcrd performed when fetching the previous outputs spent by a set of
+	// inputs. Zero means the limit is the current sync or serve
+	// concurrency.
+	FetchConcurrency uint
+
+	// BlockConcurrency is the maximum number of transactions of a block
+	// that are converted concurrently when serving blocks.
+	BlockConcurrency uint
+
+	// BlockNtfnQueueSize is the maximum number of block notifications
+	// received from dcrd that are queued while waiting to be processed.
+	// The oldest queued notification is dropped when the queue is full,
+	// which is the only supported policy (see queueBlockNtfn for why
+	// blocking is not). Defaults to 1000.
+	BlockNtfnQueueSize uint
 }
 
 type Server struct {
@@ -72,16 +276,69 @@ type Server struct {
 	network     *rtypes.NetworkIdentifier
 	db          backenddb.DB
 
+	balanceConfirmations uint
+	snapshotFile         string
+	exportSnapshotFile   string
+	blockLogFile         string
+	importBlockLogFile   string
+	bootstrapFile        string
+	blockLog             *os.File
+	convertOpts          types.ConvertOpts
+	syncConcurrency      int
+	serveConcurrency     int
+	fetchConcurrency     int
+	verifyBlockRoots     bool
+	stakedSubAccount     bool
+	dcrdTimeout          time.Duration
+	dcrdGracePeriod      time.Duration
+	dcrdMaxRetryInterval time.Duration
+
+	networkStatusCacheTTL time.Duration
+	gapFillBatchSize      int
+	syncRetries           uint
+	maxReorgDepth         int64
+	blockNtfnQueueSize    int
+	slowBlockThreshold    time.Duration
+	checkImmature         bool
+	readyAfterBlock       bool
+	ignoreAccountFormat   bool
+
+	// reorgDepth is the number of processed blocks rolled back since the
+	// last time a block was connected. It is only accessed by the event
+	// loop.
+	reorgDepth int64
+
+	// diskFullRetryInterval is the interval after which notifications
+	// that failed due to lack of disk space are queued again.
+	diskFullRetryInterval time.Duration
+
+	// dcrdCheckRetryInterval is the initial interval between attempts to
+	// verify a reconnected dcrd instance during the grace period.
+	dcrdCheckRetryInterval time.Duration
+
+	// syncRetryDelay is the initial delay between attempts to resume a
+	// failed initial sync.
+	syncRetryDelay time.Duration
+
 	// Caches for speeding up operations.
-	cacheBlocks *lru.KVCache
-	cacheRawTxs *lru.KVCache
+	cacheBlocks     *lru.KVCache
+	cacheRawTxs     *ttlCache
+	cachePrevInputs *lru.KVCache
 
 	// The given mtx mutex protects the following fields.
-	mtx            sync.Mutex
-	active         bool
-	dcrdVersion    string
-	blockNtfns     []*blockNtfn
-	blockNtfnsChan chan struct{}
+	mtx              sync.Mutex
+	active           bool
+	synced           bool
+	ready            bool
+	diskFull         bool
+	diskFullNtfns    []*blockNtfn
+	dcrdTimeouts     int
+	cachedStatus     *rtypes.NetworkStatusResponse
+	cachedStatusTime time.Time
+	dcrdVersion      string
+	dcrdErr          error
+	blockNtfns       []*blockNtfn
+	blockNtfnsChan   chan struct{}
 }
 
 func NewServer(ctx context.Context, cfg *ServerConfig) (*Server, error) {
@@ -97,16 +354,50 @@ func NewServer(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 
 	// Setup in-memory caches.
 	cacheBlocks := lru.NewKVCache(cfg.CacheSizeBlocks)
-	cacheRawTxs := lru.NewKVCache(cfg.CacheSizeRawTxs)
+	cacheRawTxs := newTTLCache(cfg.CacheSizeRawTxs, cfg.CacheRawTxTTL)
+	cachePrevInputs := lru.NewKVCache(cfg.CacheSizePrevInputs)
+
+	convertOpts := types.ConvertOpts{
+		IncludeHeaderHex:  cfg.IncludeHeaderHex,
+		LikelyChange:      cfg.LikelyChange,
+		RelatedOps:        cfg.RelatedOps,
+		IncludeEmptyTxs:   cfg.IncludeEmptyTxs,
+		RedeemScriptClass: cfg.RedeemScriptClass,
+		AccountPkScript:   cfg.AccountPkScript,
+		IncludeRawTx:      cfg.IncludeRawTx,
+		FeeOps:            cfg.FeeOps,
+		OmitOpMetadata:    cfg.OmitOpMetadata,
+		StakedSubAccount:  cfg.StakedSubAccount,
+		Concurrency:       int(cfg.BlockConcurrency),
+	}
+
+	syncConcurrency := int(cfg.SyncConcurrency)
+	if syncConcurrency == 0 {
+		syncConcurrency = runtime.NumCPU()
+	}
+	serveConcurrency := int(cfg.ServeConcurrency)
+	if serveConcurrency == 0 {
+		serveConcurrency = runtime.NumCPU()
+	}
+
+	blockNtfnQueueSize := int(cfg.BlockNtfnQueueSize)
+	if blockNtfnQueueSize == 0 {
+		blockNtfnQueueSize = defaultBlockNtfnQueueSize
+	}
+
+	gapFillBatchSize := int(cfg.GapFillBatchSize)
+	if gapFillBatchSize == 0 {
+		gapFillBatchSize = defaultGapFillBatchSize
+	}
 
 	var db backenddb.DB
 	switch cfg.DBType {
 	case DBTypeMem:
 		db, err = memdb.NewMemDB()
 	case DBTypeBadger:
-		db, err = badgerdb.NewBadgerDB(cfg.DBDir)
+		db, err = badgerdb.NewBadgerDB(cfg.DBDir, cfg.DBGCInterval)
 	case DBTypeBadgerMem:
-		db, err = badgerdb.NewBadgerDB("")
+		db, err = badgerdb.NewBadgerDB("", 0)
 	default:
 		err = errors.New("unknown db type")
 	}
@@ -115,15 +406,46 @@ func NewServer(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 	}
 
 	s := &Server{
-		chainParams:    cfg.ChainParams,
-		asserter:       astr,
-		network:        network,
-		ctx:            ctx,
-		cacheBlocks:    &cacheBlocks,
-		cacheRawTxs:    &cacheRawTxs,
-		db:             db,
+		chainParams:          cfg.ChainParams,
+		asserter:             astr,
+		network:              network,
+		ctx:                  ctx,
+		cacheBlocks:          &cacheBlocks,
+		cacheRawTxs:          cacheRawTxs,
+		cachePrevInputs:      &cachePrevInputs,
+		db:                   db,
+		balanceConfirmations: cfg.BalanceConfirmations,
+		snapshotFile:         cfg.SnapshotFile,
+		exportSnapshotFile:   cfg.ExportSnapshotFile,
+		blockLogFile:         cfg.BlockLogFile,
+		importBlockLogFile:   cfg.ImportBlockLogFile,
+		bootstrapFile:        cfg.BootstrapFile,
+		convertOpts:          convertOpts,
+		syncConcurrency:      syncConcurrency,
+		serveConcurrency:     serveConcurrency,
+		fetchConcurrency:     int(cfg.FetchConcurrency),
+		verifyBlockRoots:     cfg.VerifyBlockRoots,
+		stakedSubAccount:     cfg.StakedSubAccount,
+		dcrdTimeout:          cfg.DcrdTimeout,
+		dcrdGracePeriod:      cfg.DcrdGracePeriod,
+		dcrdMaxRetryInterval: cfg.DcrdMaxRetryInterval,
+
+		networkStatusCacheTTL: cfg.NetworkStatusCacheTTL,
+		gapFillBatchSize:      gapFillBatchSize,
+		syncRetries:           cfg.SyncRetries,
+		maxReorgDepth:         int64(cfg.MaxReorgDepth),
+		diskFullRetryInterval: diskFullRetryInterval,
+		blockNtfnQueueSize:    blockNtfnQueueSize,
+		slowBlockThreshold:    cfg.SlowBlockThreshold,
+		checkImmature:         cfg.CheckImmatureSpends,
+		readyAfterBlock:       cfg.ReadyAfterBlock,
+		ignoreAccountFormat:   cfg.IgnoreAccountFormat,
+
+		dcrdCheckRetryInterval: dcrdCheckRetryInterval,
+		syncRetryDelay:         syncRetryDelay,
+
 		blockNtfns:     make([]*blockNtfn, 0),
-		blockNtfnsChan: make(chan struct{}),
+		blockNtfnsChan: make(chan struct{}, 1),
 	}
 
 	// We make a copy of the passed config because we change some of the
@@ -149,49 +471,230 @@ func (s *Server) Active() bool {
 	return active
 }
 
+// Ready returns true once the server has completed its initial sync and is
+// ready to process block notifications. When the ReadyAfterBlock option is
+// set, the server only becomes ready after successfully handling a block
+// notification.
+func (s *Server) Ready() bool {
+	s.mtx.Lock()
+	ready := s.ready
+	s.mtx.Unlock()
+	return ready
+}
+
+// DiskFull returns true if processing new blocks is currently halted because
+// the db ran out of disk space. Requests are still served from the already
+// processed blocks while this is the case.
+func (s *Server) DiskFull() bool {
+	s.mtx.Lock()
+	diskFull := s.diskFull
+	s.mtx.Unlock()
+	return diskFull
+}
+
+// concurrency returns the maximum number of concurrent requests to dcrd that
+// a single operation should perform. This depends on whether the server has
+// already completed its initial sync.
+func (s *Server) concurrency() int {
+	s.mtx.Lock()
+	synced := s.synced
+	s.mtx.Unlock()
+	if synced {
+		return s.serveConcurrency
+	}
+	return s.syncConcurrency
+}
+
+// RawTxCacheStats returns usage statistics of the in-memory raw tx cache.
+func (s *Server) RawTxCacheStats() CacheStats {
+	return s.cacheRawTxs.Stats()
+}
+
 func (s *Server) onDcrdConnected() {
 	s.mtx.Lock()
-	defer s.mtx.Unlock()
 
 	// Ideally these would be done on a onDcrdDisconnected() callback but
 	// rpcclient doesn't currently offer that.
 	s.active = false
 	s.dcrdVersion = ""
+	s.dcrdErr = nil
+	s.cachedStatus = nil
+	s.mtx.Unlock()
 
 	svrLog.Debugf("Reconnected to the dcrd instance")
-	version, err := checkDcrd(s.ctx, s.c, s.chainParams)
-	if err != nil {
-		svrLog.Error(err)
-		svrLog.Infof("Disabling server operations")
-		return
+
+	// A dcrd instance that was just restarted might be temporarily
+	// unsuitable, so retry the checks during the grace period before
+	// disabling the server.
+	deadline := time.Now().Add(s.dcrdGracePeriod)
+	retryInterval := s.dcrdCheckRetryInterval
+	for {
+		version, err := checkDcrd(s.ctx, s.c, s.chainParams)
+		s.mtx.Lock()
+		s.dcrdErr = err
+		s.cachedStatus = nil
+		if err == nil {
+			s.active = true
+			s.dcrdVersion = version
+			s.dcrdTimeouts = 0
+		}
+		s.mtx.Unlock()
+		if err == nil {
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			svrLog.Error(err)
+			svrLog.Infof("Disabling server operations")
+			return
+		}
+
+		svrLog.Warnf("dcrd not yet suitable (%v). Retrying in %s", err,
+			retryInterval)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+		retryInterval = nextDcrdRetryInterval(retryInterval,
+			s.dcrdMaxRetryInterval)
 	}
+}
 
-	s.active = true
-	s.dcrdVersion = version
+// nextDcrdRetryInterval returns the interval to wait before the check of a
+// reconnected dcrd instance that follows a check retried after interval. The
+// interval doubles up to maxInterval or is kept constant if maxInterval is
+// not higher than it.
+func nextDcrdRetryInterval(interval, maxInterval time.Duration) time.Duration {
+	if maxInterval <= interval {
+		return interval
+	}
+	interval *= 2
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	return interval
 }
 
+// notifyNewBlockEvent signals the event loop that there are queued block
+// notifications. Signals are coalesced, so the event loop must keep
+// processing notifications until the queue is empty.
 func (s *Server) notifyNewBlockEvent() {
-	go func() {
-		select {
-		case <-s.ctx.Done():
-		case s.blockNtfnsChan <- struct{}{}:
+	select {
+	case s.blockNtfnsChan <- struct{}{}:
+	default:
+	}
+}
+
+// queueBlockNtfn adds the given notification to the queue of block
+// notifications. When the queue is full, the oldest queued notification is
+// dropped.
+//
+// Blocking until the event loop dequeues a notification is not supported as
+// a backpressure policy. This is called from the rpcclient notification
+// handlers, which run in the same goroutine that reads every reply from dcrd,
+// so blocking here would stop the replies to the calls made by the event loop
+// while processing the queued notifications and deadlock the server.
+//
+// Dropping notifications is safe because the newest notification is always
+// queued. Processing it (in handleBlockConnected) runs syncToBlock, which
+// rolls back any blocks whose disconnection was dropped and fetches and
+// processes any blocks whose connection was dropped, or resyncs to the best
+// dcrd block when the notification is inconsistent with the db tip.
+func (s *Server) queueBlockNtfn(ntfn *blockNtfn) {
+	s.mtx.Lock()
+	s.cachedStatus = nil
+	if len(s.blockNtfns) < s.blockNtfnQueueSize {
+		s.blockNtfns = append(s.blockNtfns, ntfn)
+		s.mtx.Unlock()
+		s.notifyNewBlockEvent()
+		return
+	}
+
+	// Reuse the slot of the dropped notification.
+	dropped := s.blockNtfns[0]
+	copy(s.blockNtfns, s.blockNtfns[1:])
+	s.blockNtfns[len(s.blockNtfns)-1] = ntfn
+	s.mtx.Unlock()
+	s.notifyNewBlockEvent()
+	svrLog.Warnf("Block notification queue full. Dropped notification "+
+		"for block %s", dropped.header.BlockHash())
+}
+
+// handleBlockNtfn processes the given block notification.
+//
+// Running out of disk space is not fatal: requests keep being served from the
+// already processed blocks and the failed notifications are queued again
+// after diskFullRetryInterval. Processing them also processes any blocks
+// missed in the meantime.
+func (s *Server) handleBlockNtfn(ctx context.Context, ntfn *blockNtfn) error {
+	var err error
+	switch ntfn.ntfnType {
+	case blockConnected:
+		err = s.handleBlockConnected(ctx, ntfn.header)
+	case blockDisconnected:
+		err = s.handleBlockDisconnected(ctx, ntfn.header)
+	default:
+		err = fmt.Errorf("unknown notification type")
+	}
+
+	noSpace := errors.Is(err, syscall.ENOSPC)
+	s.mtx.Lock()
+	wasDiskFull := s.diskFull
+	s.diskFull = noSpace
+	var scheduleRetry bool
+	if noSpace {
+		// Only one retry is scheduled at a time, queueing every
+		// notification that failed since the last one.
+		scheduleRetry = len(s.diskFullNtfns) == 0
+		if len(s.diskFullNtfns) == s.blockNtfnQueueSize {
+			copy(s.diskFullNtfns, s.diskFullNtfns[1:])
+			s.diskFullNtfns = s.diskFullNtfns[:len(s.diskFullNtfns)-1]
 		}
-	}()
+		s.diskFullNtfns = append(s.diskFullNtfns, ntfn)
+	}
+	s.mtx.Unlock()
+
+	switch {
+	case noSpace:
+		svrLog.Errorf("Unable to process new blocks due to lack of "+
+			"disk space: %v", err)
+		if scheduleRetry {
+			time.AfterFunc(s.diskFullRetryInterval, s.retryDiskFullNtfns)
+		}
+		return nil
+	case err == nil && wasDiskFull:
+		svrLog.Infof("Resumed processing blocks")
+	}
+	return err
 }
 
-func (s *Server) onDcrdBlockConnected(blockHeader []byte, transactions [][]byte) {
+// retryDiskFullNtfns queues again the block notifications that failed due to
+// lack of disk space.
+func (s *Server) retryDiskFullNtfns() {
+	if s.ctx.Err() != nil {
+		return
+	}
 	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	ntfns := s.diskFullNtfns
+	s.diskFullNtfns = nil
+	s.mtx.Unlock()
 
+	svrLog.Infof("Retrying %d block notifications that failed due to "+
+		"lack of disk space", len(ntfns))
+	for _, ntfn := range ntfns {
+		s.queueBlockNtfn(ntfn)
+	}
+}
+
+func (s *Server) onDcrdBlockConnected(blockHeader []byte, transactions [][]byte) {
 	var header wire.BlockHeader
 	if err := header.FromBytes(blockHeader); err != nil {
 		svrLog.Errorf("Unable to decode blockheader on block connected: %v", err)
 		return
 	}
 
-	ntfn := &blockNtfn{header: &header, ntfnType: blockConnected}
-	s.blockNtfns = append(s.blockNtfns, ntfn)
-	s.notifyNewBlockEvent()
+	s.queueBlockNtfn(&blockNtfn{header: &header, ntfnType: blockConnected})
 }
 
 // rollbackDbChain rolls back the db chain until we find a common block betwen
@@ -212,10 +715,28 @@ func (s *Server) rollbackDbChain(dbtx backenddb.WriteTx,
 		return &tipHash, tipHeight, nil
 	}
 
+	// Helper to ensure rolling back the current tip does not exceed the
+	// maximum reorg depth, accounting for blocks already rolled back by
+	// previous notifications of the same reorg.
+	origTipHeight := tipHeight
+	checkDepth := func() error {
+		depth := s.reorgDepth + origTipHeight - tipHeight
+		if s.maxReorgDepth > 0 && depth >= s.maxReorgDepth {
+			return fmt.Errorf("%w: rolling back block %d %s would "+
+				"reorg more than %d blocks from tip %d",
+				errReorgTooDeep, tipHeight, tipHash, s.maxReorgDepth,
+				origTipHeight)
+		}
+		return nil
+	}
+
 	// If the target is lower than the current tip, it's likely we're in
 	// the middle of a reorg. Roll back until we find the target height.
 	for tipHeight > 0 && tipHeight > targetHeight {
 		var err error
+		if err = checkDepth(); err != nil {
+			return nil, 0, err
+		}
 
 		svrLog.Debugf("Rolling back rewinded tip %d %s", tipHeight, tipHash)
 		if err = s.db.RollbackTip(dbtx, tipHeight, tipHash); err != nil {
@@ -231,7 +752,7 @@ func (s *Server) rollbackDbChain(dbtx backenddb.WriteTx,
 	chainHash := targetHash
 	if targetHeight > tipHeight {
 		var err error
-		chainHash, err = s.c.GetBlockHash(dbtx.Context(), tipHeight)
+		chainHash, err = s.getChainBlockHash(dbtx.Context(), tipHeight)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -242,6 +763,9 @@ func (s *Server) rollbackDbChain(dbtx backenddb.WriteTx,
 	rolledBack := false
 	for tipHeight > 0 && !chainHash.IsEqual(&tipHash) {
 		var err error
+		if err = checkDepth(); err != nil {
+			return nil, 0, err
+		}
 		svrLog.Debugf("Rolling back reorged tip %d %s", tipHeight, tipHash)
 
 		if err = s.db.RollbackTip(dbtx, tipHeight, tipHash); err != nil {
@@ -250,7 +774,7 @@ func (s *Server) rollbackDbChain(dbtx backenddb.WriteTx,
 		if tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx); err != nil {
 			return nil, 0, err
 		}
-		if chainHash, err = s.c.GetBlockHash(dbtx.Context(), tipHeight); err != nil {
+		if chainHash, err = s.getChainBlockHash(dbtx.Context(), tipHeight); err != nil {
 			return nil, 0, err
 		}
 		rolledBack = true
@@ -262,28 +786,104 @@ func (s *Server) rollbackDbChain(dbtx backenddb.WriteTx,
 	return &tipHash, tipHeight, nil
 }
 
-func (s *Server) handleBlockConnected(ctx context.Context, header *wire.BlockHeader) error {
+// resyncToBestBlock syncs the db chain to the current best block reported by
+// dcrd. This is used to reconcile the db when block notifications arrive in
+// an order inconsistent with the db chain.
+func (s *Server) resyncToBestBlock(ctx context.Context) error {
+	var bestHash *chainhash.Hash
+	var header *wire.BlockHeader
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		bestHash, _, err = s.c.GetBestBlock(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		header, err = s.c.GetBlockHeader(ctx, bestHash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
+	svrLog.Infof("Resyncing to best block %s at height %d", bestHash,
+		header.Height)
+	return s.syncToBlock(ctx, header)
+}
+
+func (s *Server) handleBlockConnected(ctx context.Context, header *wire.BlockHeader) error {
 	chainHeight := int64(header.Height)
 	chainHash := header.BlockHash()
 
 	svrLog.Debugf("Received connected block %s at height %d", chainHash, chainHeight)
 
+	// Verify the connected block extends our current tip. Blocks at or
+	// below our tip are either duplicated notifications for blocks we
+	// already processed or out of order notifications (for example, due
+	// to a fast reorg) which we can't apply directly.
 	var tipHeight int64
+	var processedHash chainhash.Hash
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		_, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		if err != nil || chainHeight > tipHeight {
+			return err
+		}
+		processedHash, err = s.db.ProcessedBlockHash(dbtx, chainHeight)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chainHeight > tipHeight:
+		return s.syncToBlock(ctx, header)
+
+	case processedHash == chainHash:
+		svrLog.Debugf("Ignoring already processed block %s", chainHash)
+		return nil
+
+	default:
+		svrLog.Warnf("Connected block %s at height %d is inconsistent "+
+			"with current tip at height %d", chainHash, chainHeight,
+			tipHeight)
+		return s.resyncToBestBlock(ctx)
+	}
+}
+
+// syncToBlock updates the db chain such that its tip is the block with the
+// given header, rolling back any blocks not in the new chain and processing
+// any missing ones.
+func (s *Server) syncToBlock(ctx context.Context, header *wire.BlockHeader) error {
+	chainHeight := int64(header.Height)
+	chainHash := header.BlockHash()
+
+	var tipHeight, rolledBack int64
 	var tipHash *chainhash.Hash
 
 	// Ensure our current tip matches the chain extended by the new block.
 	err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
-		var err error
+		_, origTipHeight, err := s.db.LastProcessedBlock(dbtx)
+		if err != nil {
+			return err
+		}
 		targetHash := &header.PrevBlock
 		targetHeight := int64(header.Height - 1)
 		tipHash, tipHeight, err = s.rollbackDbChain(dbtx, targetHash, targetHeight)
+		if tipHeight < origTipHeight {
+			rolledBack = origTipHeight - tipHeight
+		}
 		return err
 
 	})
 	if err != nil {
 		return err
 	}
+	s.reorgDepth += rolledBack
 
 	// Fetch the full previous block.
 	prev, err := s.getBlock(s.ctx, tipHash)
@@ -292,82 +892,153 @@ func (s *Server) handleBlockConnected(ctx context.Context, header *wire.BlockHea
 			"block %s: %v", header.PrevBlock, chainHash, err)
 	}
 
-	// Now fetch all missing blocks from our tip
+	// Now fetch all missing blocks from our tip. Blocks are processed in
+	// batches so that large gaps don't delay shutting down the server.
+	var batchCount int
 	for tipHeight < chainHeight {
+		if batchCount == s.gapFillBatchSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			svrLog.Infof("Catching up to block %s at height %d "+
+				"(current tip %d)", chainHash, chainHeight, tipHeight)
+			batchCount = 0
+			runtime.Gosched()
+		}
+		batchCount++
+
 		// Fetch the next missing block as a wire.MsgBlock. We special
 		// case when the next block is the received connected block to
 		// avoid another roundtrip to dcrd.
+		//
+		// Requests canceled by ctx fail with an rpcclient error that
+		// doesn't wrap the reason, so ctx is checked again after a
+		// failed fetch such that callers can tell a canceled gap fill
+		// apart from a failed one.
 		var err error
 		var nextTipHash *chainhash.Hash
 		if tipHeight+1 == chainHeight {
 			nextTipHash = &chainHash
 		} else {
-			if nextTipHash, err = s.c.GetBlockHash(ctx, tipHeight+1); err != nil {
+			if nextTipHash, err = s.getChainBlockHash(ctx, tipHeight+1); err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
 				return err
 			}
 		}
 
-		b, err := s.c.GetBlock(ctx, nextTipHash)
+		var timings blockTimings
+		fetchStart := time.Now()
+		b, err := s.getBlock(ctx, nextTipHash)
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			return fmt.Errorf("Unable to fetch new connected block %s: %v",
 				nextTipHash, err)
 		}
+		timings.fetch = time.Since(fetchStart)
 
 		// Process the accounts modified by the block.
-		err = s.preProcessAccountBlock(s.ctx, nextTipHash, b, prev, nil)
+		err = s.preProcessAccountBlock(s.ctx, nextTipHash, b, prev, nil, &timings)
 		if err != nil {
 			return fmt.Errorf("Unable to process accounts of connected block "+
 				"%s: %v", nextTipHash, err)
 		}
 
+		total := timings.fetch + timings.convert + timings.commit
+		if s.slowBlockThreshold > 0 && total > s.slowBlockThreshold {
+			svrLog.Warnf("Slow processing of block %s at height %d: "+
+				"%s total (fetch %s, conversion %s, db commit %s)",
+				nextTipHash, tipHeight+1, total, timings.fetch,
+				timings.convert, timings.commit)
+		}
+
 		// Advance to next block.
 		prev = b
 		tipHeight++
 		svrLog.Infof("Connected block %s at height %d", nextTipHash, tipHeight)
 	}
+
+	// The reorg (if any) is complete.
+	s.reorgDepth = 0
 	return nil
 }
 
 func (s *Server) onDcrdBlockDisconnected(blockHeader []byte) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-
 	var header wire.BlockHeader
 	if err := header.FromBytes(blockHeader); err != nil {
 		svrLog.Errorf("Unable to decode blockheader on block disconnected: %v", err)
 		return
 	}
 
-	ntfn := &blockNtfn{header: &header, ntfnType: blockDisconnected}
-	s.blockNtfns = append(s.blockNtfns, ntfn)
-	s.notifyNewBlockEvent()
+	s.queueBlockNtfn(&blockNtfn{header: &header, ntfnType: blockDisconnected})
 }
 
 func (s *Server) handleBlockDisconnected(ctx context.Context, header *wire.BlockHeader) error {
 	blockHash := header.BlockHash()
+	var tipHash, processedHash chainhash.Hash
+	var tipHeight int64
 	err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
 		// Ensure our current tip matches the chain rolled back by the
 		// disconnected block.
-		tipHash, tipHeight, err := s.db.LastProcessedBlock(dbtx)
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
 		if err != nil {
 			return err
 		}
 
 		if tipHash != blockHash || tipHeight != int64(header.Height) {
-			return fmt.Errorf("Current tip %d (%s) does not match "+
-				"disconnected block %s",
-				tipHeight, tipHash, blockHash)
+			if int64(header.Height) <= tipHeight {
+				processedHash, err = s.db.ProcessedBlockHash(dbtx,
+					int64(header.Height))
+			}
+			return err
 		}
 
-		// Rollback this block.
+		// Rollback this block, unless that exceeds the maximum reorg
+		// depth.
+		if s.maxReorgDepth > 0 && s.reorgDepth >= s.maxReorgDepth {
+			return fmt.Errorf("%w: rolling back block %d %s would "+
+				"reorg more than %d blocks", errReorgTooDeep,
+				tipHeight, tipHash, s.maxReorgDepth)
+		}
 		return s.db.RollbackTip(dbtx, int64(header.Height), tipHash)
 	})
 	if err != nil {
 		return err
 	}
 
-	svrLog.Infof("Disconnected block %s at height %d", blockHash, header.Height)
-	return nil
+	switch {
+	case tipHash == blockHash:
+		s.reorgDepth++
+		svrLog.Infof("Disconnected block %s at height %d", blockHash, header.Height)
+		return nil
+
+	case int64(header.Height) > tipHeight:
+		// We never processed this block, so there's nothing to
+		// roll back.
+		svrLog.Debugf("Ignoring disconnected block %s at height %d "+
+			"after current tip %d", blockHash, header.Height, tipHeight)
+		return nil
+
+	case processedHash != blockHash:
+		// The db has a different block at this height, so the block
+		// is not part of the db chain: either it was never processed
+		// or it was already rolled back (for example, while
+		// resyncing to the best block after dropped notifications).
+		// Either way, there's nothing to roll back.
+		svrLog.Debugf("Ignoring stale disconnected block %s at height "+
+			"%d (processed block at this height is %s)", blockHash,
+			header.Height, processedHash)
+		return nil
+
+	default:
+		svrLog.Warnf("Current tip %d (%s) does not match disconnected "+
+			"block %s", tipHeight, tipHash, blockHash)
+		return s.resyncToBestBlock(ctx)
+	}
 }
 
 func (s *Server) ntfnHandlers() *rpcclient.NotificationHandlers {
@@ -402,18 +1073,75 @@ func (s *Server) Run(ctx context.Context) error {
 		return err
 	}
 
+	if err := s.checkAccountFormat(ctx); err != nil {
+		s.db.Close()
+		return err
+	}
+
+	if s.snapshotFile != "" {
+		if err := s.importSnapshotFile(ctx, s.snapshotFile); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+
+	if s.importBlockLogFile != "" {
+		if err := s.replayBlockLogFile(ctx, s.importBlockLogFile); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+
+	if s.bootstrapFile != "" {
+		if err := s.importBootstrapFile(ctx, s.bootstrapFile); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+
+	if s.blockLogFile != "" {
+		f, err := openBlockLog(s.blockLogFile)
+		if err != nil {
+			s.db.Close()
+			return err
+		}
+		defer f.Close()
+		s.blockLog = f
+	}
+
 	err := s.preProcessAccounts(ctx)
 	if err != nil {
 		s.db.Close()
 		return err
 	}
 
+	if s.exportSnapshotFile != "" {
+		if err := s.writeSnapshotFile(ctx, s.exportSnapshotFile); err != nil {
+			s.db.Close()
+			return err
+		}
+		svrLog.Infof("Exported balance snapshot to %s", s.exportSnapshotFile)
+	}
+
+	// The initial sync is complete, so reserve some headroom for serving
+	// requests.
+	s.mtx.Lock()
+	s.synced = true
+	s.mtx.Unlock()
+	svrLog.Debugf("Switching concurrency from %d to %d", s.syncConcurrency,
+		s.serveConcurrency)
+
 	// Now that we've processed the accounts, we can register for block
 	// notifications.
 	if err := s.c.NotifyBlocks(ctx); err != nil {
 		return err
 	}
 	svrLog.Infof("Waiting for block notifications")
+	if !s.readyAfterBlock {
+		s.mtx.Lock()
+		s.ready = true
+		s.mtx.Unlock()
+	}
 
 	// Handle server events.
 nextevent:
@@ -437,17 +1165,32 @@ nextevent:
 				s.blockNtfns[len(s.blockNtfns)-1] = nil
 			}
 			s.blockNtfns = s.blockNtfns[:len(s.blockNtfns)-1]
+
+			// Signals are coalesced, so ensure the remaining
+			// notifications are processed.
+			if len(s.blockNtfns) > 0 {
+				s.notifyNewBlockEvent()
+			}
 			s.mtx.Unlock()
 
-			switch ntfn.ntfnType {
-			case blockConnected:
-				err = s.handleBlockConnected(ctx, ntfn.header)
-			case blockDisconnected:
-				err = s.handleBlockDisconnected(ctx, ntfn.header)
-			default:
-				err = fmt.Errorf("unknown notification type")
+			err = s.handleBlockNtfn(ctx, ntfn)
+			if err == nil && s.DiskFull() {
+				continue nextevent
 			}
 
+			if err == nil && !s.Ready() {
+				s.mtx.Lock()
+				s.ready = true
+				s.mtx.Unlock()
+				svrLog.Infof("Handled first block notification. " +
+					"Server is ready.")
+			}
+
+			if errors.Is(err, errReorgTooDeep) {
+				svrLog.Errorf("Refusing to process reorg: %v. "+
+					"Verify the dcrd instance is on the expected "+
+					"chain.", err)
+			}
 			if err != nil {
 				break nextevent
 			}
@@ -0,0 +1,1755 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"decred.org/dcrros/backend/backenddb"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrjson/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	chainjson "github.com/decred/dcrd/rpc/jsonrpc/types/v2"
+	"github.com/decred/dcrd/rpcclient/v6"
+	"github.com/decred/dcrd/txscript/v3"
+	"github.com/decred/dcrd/wire"
+	"github.com/decred/slog"
+	"github.com/gorilla/websocket"
+)
+
+// testAddr returns the address of a test account identified by id.
+func testAddr(t testing.TB, id byte, params *chaincfg.Params) dcrutil.Address {
+	t.Helper()
+	hash := make([]byte, 20)
+	hash[0] = id
+	addr, err := dcrutil.NewAddressScriptHashFromHash(hash, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// testPkScript returns a script that pays to the test account identified by
+// id.
+func testPkScript(t testing.TB, id byte, params *chaincfg.Params) []byte {
+	t.Helper()
+	pkScript, err := txscript.PayToAddrScript(testAddr(t, id, params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkScript
+}
+
+// testMerkleRoot calculates the merkle root of the given transactions.
+func testMerkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	if len(txs) == 0 {
+		return chainhash.Hash{}
+	}
+	leaves := make([]chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		leaves[i] = tx.TxHashFull()
+	}
+	for len(leaves) > 1 {
+		if len(leaves)%2 != 0 {
+			leaves = append(leaves, leaves[len(leaves)-1])
+		}
+		next := make([]chainhash.Hash, len(leaves)/2)
+		for i := range next {
+			var buf [chainhash.HashSize * 2]byte
+			copy(buf[:chainhash.HashSize], leaves[i*2][:])
+			copy(buf[chainhash.HashSize:], leaves[i*2+1][:])
+			next[i] = chainhash.HashH(buf[:])
+		}
+		leaves = next
+	}
+	return leaves[0]
+}
+
+// testChain builds chains of blocks with simple transactions on top of the
+// genesis block of a network. The blocks are not valid according to the
+// consensus rules, but are suitable for exercising the processing of blocks
+// by the server.
+type testChain struct {
+	t      testing.TB
+	params *chaincfg.Params
+
+	// blocks is the main chain, indexed by height.
+	blocks []*wire.MsgBlock
+}
+
+func newTestChain(t testing.TB, params *chaincfg.Params) *testChain {
+	return &testChain{
+		t:      t,
+		params: params,
+		blocks: []*wire.MsgBlock{params.GenesisBlock},
+	}
+}
+
+// tip returns the last block of the main chain.
+func (c *testChain) tip() *wire.MsgBlock {
+	return c.blocks[len(c.blocks)-1]
+}
+
+// newBlock returns a block extending parent, with a coinbase that pays 10 DCR
+// to the account identified by payTo followed by the given transactions.
+func (c *testChain) newBlock(parent *wire.MsgBlock, approvesParent bool, payTo byte, txs ...*wire.MsgTx) *wire.MsgBlock {
+	height := parent.Header.Height + 1
+
+	// Include the height and payee in the coinbase so that blocks at the
+	// same height have different coinbases. The signature script is not
+	// part of the tx hash, so the height is also set as the lock time to
+	// ensure coinbases paying the same account at different heights have
+	// different hashes.
+	sigScript := make([]byte, 5)
+	binary.LittleEndian.PutUint32(sigScript, height)
+	sigScript[4] = payTo
+	coinbase := wire.NewMsgTx()
+	coinbase.LockTime = height
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex, wire.TxTreeRegular),
+		Sequence:        wire.MaxTxInSequenceNum,
+		ValueIn:         10e8,
+		SignatureScript: sigScript,
+	})
+	coinbase.AddTxOut(wire.NewTxOut(10e8, testPkScript(c.t, payTo, c.params)))
+
+	var voteBits uint16
+	if approvesParent {
+		voteBits = 1
+	}
+	b := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   1,
+			PrevBlock: parent.BlockHash(),
+			VoteBits:  voteBits,
+			Height:    height,
+			Timestamp: parent.Header.Timestamp.Add(time.Minute),
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, txs...),
+	}
+	b.Header.MerkleRoot = testMerkleRoot(b.Transactions)
+	return b
+}
+
+// addBlock extends the main chain with a new block. See newBlock.
+func (c *testChain) addBlock(approvesParent bool, payTo byte, txs ...*wire.MsgTx) *wire.MsgBlock {
+	b := c.newBlock(c.tip(), approvesParent, payTo, txs...)
+	c.blocks = append(c.blocks, b)
+	return b
+}
+
+// spendTx returns a tx that spends the given output of prev, paying value to
+// the account identified by payTo.
+func (c *testChain) spendTx(prev *wire.MsgTx, index uint32, payTo byte, value int64) *wire.MsgTx {
+	prevHash := prev.TxHash()
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&prevHash, index,
+			wire.TxTreeRegular),
+		Sequence: wire.MaxTxInSequenceNum,
+		ValueIn:  prev.TxOut[index].Value,
+	})
+	tx.AddTxOut(wire.NewTxOut(value, testPkScript(c.t, payTo, c.params)))
+	return tx
+}
+
+// addStakeBlock extends the main chain with a new block that approves its
+// parent and includes the given stake transactions. See newBlock.
+func (c *testChain) addStakeBlock(payTo byte, stxs ...*wire.MsgTx) *wire.MsgBlock {
+	b := c.newBlock(c.tip(), true, payTo)
+	b.STransactions = stxs
+	c.blocks = append(c.blocks, b)
+	return b
+}
+
+// ticketTx returns a ticket that spends the given output of prev, locking
+// value in a stake submission output paying to the account identified by
+// submitTo and committing the full amount of the output to the account
+// identified by commitTo.
+func (c *testChain) ticketTx(prev *wire.MsgTx, index uint32, submitTo, commitTo byte, value int64) *wire.MsgTx {
+	c.t.Helper()
+	prevHash := prev.TxHash()
+	inValue := prev.TxOut[index].Value
+	submission, err := txscript.PayToSStx(testAddr(c.t, submitTo, c.params))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	commitment, err := txscript.GenerateSStxAddrPush(testAddr(c.t,
+		commitTo, c.params), dcrutil.Amount(inValue), 0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	change, err := txscript.PayToSStxChange(testAddr(c.t, commitTo, c.params))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&prevHash, index,
+			wire.TxTreeRegular),
+		Sequence: wire.MaxTxInSequenceNum,
+		ValueIn:  inValue,
+	})
+	tx.AddTxOut(wire.NewTxOut(value, submission))
+	tx.AddTxOut(wire.NewTxOut(0, commitment))
+	tx.AddTxOut(wire.NewTxOut(0, change))
+	return tx
+}
+
+// voteTx returns a vote on the current tip of the chain that spends the given
+// ticket, paying value to the account identified by payTo.
+func (c *testChain) voteTx(ticket *wire.MsgTx, payTo byte, value int64) *wire.MsgTx {
+	c.t.Helper()
+	tip := c.tip()
+	blockRef, err := txscript.GenerateSSGenBlockRef(tip.BlockHash(),
+		tip.Header.Height)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	votes, err := txscript.GenerateSSGenVotes(1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	payment, err := txscript.PayToSSGen(testAddr(c.t, payTo, c.params))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ticketHash := ticket.TxHash()
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex, wire.TxTreeRegular), 0, nil))
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&ticketHash, 0,
+		wire.TxTreeStake), ticket.TxOut[0].Value, nil))
+	tx.AddTxOut(wire.NewTxOut(0, blockRef))
+	tx.AddTxOut(wire.NewTxOut(0, votes))
+	tx.AddTxOut(wire.NewTxOut(value, payment))
+	return tx
+}
+
+// newTestServer returns a server backed by an in-memory db that processes
+// blocks of the regnet network. Fields of cfg that are not set are filled
+// with defaults suitable for tests.
+//
+// The returned server is not connected to any dcrd instance, so tests must
+// only exercise code paths that don't need one.
+func newTestServer(t testing.TB, cfg *ServerConfig) *Server {
+	t.Helper()
+	if cfg == nil {
+		cfg = &ServerConfig{}
+	}
+	if cfg.ChainParams == nil {
+		cfg.ChainParams = chaincfg.RegNetParams()
+	}
+	if cfg.DBType == "" {
+		cfg.DBType = DBTypeMem
+	}
+	if cfg.DcrdCfg == nil {
+		cfg.DcrdCfg = &rpcclient.ConnConfig{
+			Host:       "127.0.0.1:0",
+			DisableTLS: true,
+		}
+	}
+	if cfg.CacheSizeBlocks == 0 {
+		cfg.CacheSizeBlocks = 1000
+	}
+	if cfg.CacheSizeRawTxs == 0 {
+		cfg.CacheSizeRawTxs = 1000
+	}
+	if cfg.CacheSizePrevInputs == 0 {
+		cfg.CacheSizePrevInputs = 1000
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewServer(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		s.db.Close()
+	})
+	return s
+}
+
+// processTestBlocks processes the given blocks, which must extend the current
+// db tip, and caches them so that they can be fetched without a dcrd
+// instance.
+func processTestBlocks(t testing.TB, s *Server, prev *wire.MsgBlock, blocks ...*wire.MsgBlock) {
+	t.Helper()
+	if prev != nil {
+		s.cacheBlocks.Add(prev.BlockHash(), prev)
+	}
+	for _, b := range blocks {
+		bh := b.BlockHash()
+		s.cacheBlocks.Add(bh, b)
+		if err := s.preProcessAccountBlock(s.ctx, &bh, b, prev, nil, nil); err != nil {
+			t.Fatalf("unable to process block %d: %v", b.Header.Height, err)
+		}
+		prev = b
+	}
+}
+
+// testBalances returns the nonzero balances of all accounts as of the last
+// processed block.
+func testBalances(t *testing.T, s *Server) map[string]dcrutil.Amount {
+	t.Helper()
+	balances := make(map[string]dcrutil.Amount)
+	_, _, err := s.ForEachBalance(s.ctx, func(account string, balance dcrutil.Amount) error {
+		balances[account] = balance
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balances
+}
+
+// testTempFile returns the name of a file in a temporary directory that is
+// removed once the test completes.
+func testTempFile(t *testing.T, name string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dcrros-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, name)
+}
+
+// TestBlockNtfnQueueBound ensures the queue of block notifications never
+// grows past its capacity when notifications arrive faster than they are
+// processed, keeping the most recent ones, and that queueing never blocks.
+func TestBlockNtfnQueueBound(t *testing.T) {
+	const queueSize = 8
+	s := newTestServer(t, &ServerConfig{BlockNtfnQueueSize: queueSize})
+
+	headerBytes := func(height uint32) []byte {
+		header := wire.BlockHeader{Height: height}
+		b, err := header.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// Flood the queue from multiple goroutines without ever processing
+	// the notifications.
+	const producers, ntfnsPerProducer = 8, 500
+	var wg sync.WaitGroup
+	var overflow int32
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < ntfnsPerProducer; i++ {
+				height := uint32(p*ntfnsPerProducer + i)
+				if i%2 == 0 {
+					s.onDcrdBlockConnected(headerBytes(height), nil)
+				} else {
+					s.onDcrdBlockDisconnected(headerBytes(height))
+				}
+				s.mtx.Lock()
+				if len(s.blockNtfns) > queueSize {
+					atomic.StoreInt32(&overflow, 1)
+				}
+				s.mtx.Unlock()
+			}
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("queueing block notifications blocked")
+	}
+	if atomic.LoadInt32(&overflow) != 0 {
+		t.Fatalf("queue grew past its capacity of %d", queueSize)
+	}
+	if len(s.blockNtfns) != queueSize {
+		t.Fatalf("unexpected queue length: got %d, want %d",
+			len(s.blockNtfns), queueSize)
+	}
+
+	// The event loop is signalled even though the notifications were
+	// never processed.
+	select {
+	case <-s.blockNtfnsChan:
+	default:
+		t.Fatal("event loop was not signalled")
+	}
+
+	// Only the most recent notifications are kept, in order.
+	for i := uint32(0); i < 3*queueSize; i++ {
+		s.onDcrdBlockConnected(headerBytes(100000+i), nil)
+	}
+	for i, ntfn := range s.blockNtfns {
+		wantHeight := uint32(100000 + 2*queueSize + i)
+		if ntfn.header.Height != wantHeight || ntfn.ntfnType != blockConnected {
+			t.Fatalf("unexpected queued notification %d: got height "+
+				"%d, want %d", i, ntfn.header.Height, wantHeight)
+		}
+	}
+}
+
+// TestBlockNtfnQueueDropRecovery ensures the blocks of dropped notifications
+// are processed along with the notifications that remain queued.
+func TestBlockNtfnQueueDropRecovery(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 10; i++ {
+		c.addBlock(true, byte(i))
+	}
+
+	const queueSize = 2
+	s := newTestServer(t, &ServerConfig{BlockNtfnQueueSize: queueSize})
+	processTestBlocks(t, s, nil, c.blocks[:2]...)
+	newFakeDcrd(t, s, c.blocks)
+	for _, b := range c.blocks[2:] {
+		header, err := b.Header.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.onDcrdBlockConnected(header, nil)
+	}
+	if len(s.blockNtfns) != queueSize {
+		t.Fatalf("unexpected queue length: got %d, want %d",
+			len(s.blockNtfns), queueSize)
+	}
+
+	for _, ntfn := range s.blockNtfns {
+		if err := s.handleBlockConnected(s.ctx, ntfn.header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantHash, wantHeight := c.tip().BlockHash(), int64(c.tip().Header.Height)
+	if tipHash, tipHeight := testTip(t, s); tipHash != wantHash || tipHeight != wantHeight {
+		t.Fatalf("unexpected tip: got %d %s, want %d %s", tipHeight,
+			tipHash, wantHeight, wantHash)
+	}
+}
+
+// testTip returns the last processed block of the db.
+func testTip(t *testing.T, s *Server) (chainhash.Hash, int64) {
+	t.Helper()
+	var tipHash chainhash.Hash
+	var tipHeight int64
+	err := s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tipHash, tipHeight
+}
+
+// TestHandleBlockDisconnectedUnknown ensures disconnect notifications for
+// blocks that are not part of the db chain don't change the db.
+func TestHandleBlockDisconnectedUnknown(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 4; i++ {
+		c.addBlock(true, byte(i))
+	}
+	s := newTestServer(t, nil)
+	processTestBlocks(t, s, nil, c.blocks...)
+	wantHash, wantHeight := testTip(t, s)
+
+	tests := []struct {
+		name   string
+		header wire.BlockHeader
+	}{{
+		name:   "fork block at tip height",
+		header: c.newBlock(c.blocks[3], true, 10).Header,
+	}, {
+		name:   "fork block below tip",
+		header: c.newBlock(c.blocks[1], true, 11).Header,
+	}, {
+		name:   "block after tip",
+		header: c.newBlock(c.tip(), true, 12).Header,
+	}, {
+		name:   "unrelated header",
+		header: wire.BlockHeader{Height: 2, Nonce: 1},
+	}}
+
+	for _, tc := range tests {
+		if err := s.handleBlockDisconnected(s.ctx, &tc.header); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		tipHash, tipHeight := testTip(t, s)
+		if tipHash != wantHash || tipHeight != wantHeight {
+			t.Fatalf("%s: tip changed to %d %s", tc.name, tipHeight,
+				tipHash)
+		}
+		if s.reorgDepth != 0 {
+			t.Fatalf("%s: unexpected reorg depth %d", tc.name,
+				s.reorgDepth)
+		}
+	}
+}
+
+// TestHandleBlockDisconnectedTooDeep ensures the server refuses to roll back
+// more blocks than the maximum reorg depth, counting the blocks rolled back by
+// every notification of the same reorg.
+func TestHandleBlockDisconnectedTooDeep(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 5; i++ {
+		c.addBlock(true, byte(i))
+	}
+
+	t.Run("disconnects", func(t *testing.T) {
+		s := newTestServer(t, &ServerConfig{MaxReorgDepth: 2})
+		processTestBlocks(t, s, nil, c.blocks...)
+
+		// The first two disconnected blocks are rolled back.
+		for _, height := range []int{5, 4} {
+			header := &c.blocks[height].Header
+			if err := s.handleBlockDisconnected(s.ctx, header); err != nil {
+				t.Fatalf("unable to disconnect block %d: %v",
+					height, err)
+			}
+		}
+		if s.reorgDepth != 2 {
+			t.Fatalf("unexpected reorg depth: got %d, want 2",
+				s.reorgDepth)
+		}
+
+		// The next one exceeds the maximum depth.
+		err := s.handleBlockDisconnected(s.ctx, &c.blocks[3].Header)
+		if !errors.Is(err, errReorgTooDeep) {
+			t.Fatalf("unexpected error: got %v, want %v", err,
+				errReorgTooDeep)
+		}
+		wantHash := c.blocks[3].BlockHash()
+		if tipHash, tipHeight := testTip(t, s); tipHash != wantHash || tipHeight != 3 {
+			t.Fatalf("unexpected tip %d %s", tipHeight, tipHash)
+		}
+	})
+
+	// Disconnect the tip, then connect a block of a chain forking off
+	// block 2, which requires rolling back blocks 4 and 3 for a total
+	// depth of 3.
+	fork3 := c.newBlock(c.blocks[2], true, 20)
+	fork4 := c.newBlock(fork3, true, 21)
+	fork5 := c.newBlock(fork4, true, 22)
+	forkChain := []*wire.MsgBlock{c.blocks[0], c.blocks[1], c.blocks[2],
+		fork3, fork4, fork5}
+
+	tests := []struct {
+		name          string
+		maxReorgDepth uint
+		wantErr       error
+		wantTip       *wire.MsgBlock
+	}{{
+		name:          "too deep",
+		maxReorgDepth: 2,
+		wantErr:       errReorgTooDeep,
+		wantTip:       c.blocks[4],
+	}, {
+		name:          "within limit",
+		maxReorgDepth: 3,
+		wantTip:       fork5,
+	}, {
+		name:    "no limit",
+		wantTip: fork5,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				MaxReorgDepth: tc.maxReorgDepth,
+			})
+			processTestBlocks(t, s, nil, c.blocks...)
+			newFakeDcrd(t, s, forkChain)
+
+			err := s.handleBlockDisconnected(s.ctx, &c.tip().Header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.handleBlockConnected(s.ctx, &fork5.Header)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err,
+					tc.wantErr)
+			}
+
+			// A failed reorg does not change the db.
+			wantHash := tc.wantTip.BlockHash()
+			wantHeight := int64(tc.wantTip.Header.Height)
+			tipHash, tipHeight := testTip(t, s)
+			if tipHash != wantHash || tipHeight != wantHeight {
+				t.Fatalf("unexpected tip: got %d %s, want %d %s",
+					tipHeight, tipHash, wantHeight, wantHash)
+			}
+
+			// A completed reorg resets the depth.
+			if tc.wantErr == nil && s.reorgDepth != 0 {
+				t.Fatalf("unexpected reorg depth %d", s.reorgDepth)
+			}
+		})
+	}
+}
+
+// TestReorgToAbandonedChain ensures reorging back to a previously abandoned
+// chain (A->B->A) processes its blocks again instead of reusing data of the
+// first time they were processed.
+func TestReorgToAbandonedChain(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(true, 4)
+	chainA := append([]*wire.MsgBlock{}, c.blocks...)
+
+	// Chain B forks off block 1 and spends the same output differently.
+	fork2 := c.newBlock(c.blocks[1], true, 5, c.spendTx(b1.Transactions[0],
+		0, 6, 2e8))
+	fork3 := c.newBlock(fork2, true, 7)
+	fork4 := c.newBlock(fork3, true, 8)
+	chainB := []*wire.MsgBlock{c.blocks[0], c.blocks[1], fork2, fork3, fork4}
+
+	// Chain A is then extended past chain B.
+	c.addBlock(true, 9)
+	c.addBlock(true, 10, c.spendTx(c.blocks[2].Transactions[1], 0, 11, 5e8))
+	finalA := c.blocks
+
+	for _, dbType := range []DBType{DBTypeMem, DBTypeBadgerMem} {
+		t.Run(string(dbType), func(t *testing.T) {
+			ref := newTestServer(t, &ServerConfig{DBType: dbType})
+			processTestBlocks(t, ref, nil, finalA...)
+
+			s := newTestServer(t, &ServerConfig{DBType: dbType})
+			processTestBlocks(t, s, nil, chainA...)
+			d := newFakeDcrd(t, s, chainB)
+			if err := s.handleBlockConnected(s.ctx, &fork4.Header); err != nil {
+				t.Fatalf("unable to reorg to chain B: %v", err)
+			}
+			d.setChain(finalA)
+			if err := s.handleBlockConnected(s.ctx, &c.tip().Header); err != nil {
+				t.Fatalf("unable to reorg back to chain A: %v", err)
+			}
+
+			wantHash, wantHeight := testTip(t, ref)
+			gotHash, gotHeight := testTip(t, s)
+			if gotHash != wantHash || gotHeight != wantHeight {
+				t.Fatalf("unexpected tip: got %d %s, want %d %s",
+					gotHeight, gotHash, wantHeight, wantHash)
+			}
+
+			// Every height must have the block of chain A and the same
+			// balances as the reference db.
+			accounts := make(map[string]struct{})
+			for _, bals := range []map[string]dcrutil.Amount{
+				testBalances(t, ref), testBalances(t, s)} {
+				for account := range bals {
+					accounts[account] = struct{}{}
+				}
+			}
+			for _, addr := range []byte{3, 6} {
+				accounts[testAddr(t, addr, params).Address()] = struct{}{}
+			}
+			for height, b := range finalA {
+				height := int64(height)
+				err := s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+					hash, err := s.db.ProcessedBlockHash(dbtx, height)
+					if err != nil {
+						return err
+					}
+					if hash != b.BlockHash() {
+						t.Fatalf("unexpected block at height %d: "+
+							"got %s, want %s", height, hash,
+							b.BlockHash())
+					}
+					for account := range accounts {
+						got, err := s.db.Balance(dbtx, account, height)
+						if err != nil {
+							return err
+						}
+						var want dcrutil.Amount
+						err = ref.db.View(ref.ctx, func(rtx backenddb.ReadTx) error {
+							var err error
+							want, err = ref.db.Balance(rtx, account, height)
+							return err
+						})
+						if err != nil {
+							return err
+						}
+						if got != want {
+							t.Fatalf("unexpected balance of %s at "+
+								"height %d: got %v, want %v",
+								account, height, got, want)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Storing a block at a processed height without rolling
+			// back the existing one is rejected.
+			err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
+				return s.db.StoreBalances(dbtx, fork2.BlockHash(), 2, nil)
+			})
+			if !errors.Is(err, backenddb.ErrHeightProcessed) {
+				t.Fatalf("unexpected error: got %v, want %v", err,
+					backenddb.ErrHeightProcessed)
+			}
+		})
+	}
+}
+
+// TestGapFillBatches ensures large gaps of missing blocks are filled
+// regardless of the batch size and that canceling the context stops filling
+// the gap promptly, leaving the db at a block that can be resumed from.
+func TestGapFillBatches(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	for i := 0; i < 28; i++ {
+		c.addBlock(true, byte(4+i))
+	}
+
+	ref := newTestServer(t, nil)
+	processTestBlocks(t, ref, nil, c.blocks...)
+	wantHash, wantHeight := testTip(t, ref)
+	wantBals := testBalances(t, ref)
+
+	tests := []struct {
+		name      string
+		batchSize uint
+		cancelAt  int
+	}{{
+		name:      "single block batches",
+		batchSize: 1,
+	}, {
+		name:      "gap larger than batch",
+		batchSize: 7,
+	}, {
+		name:      "gap smaller than batch",
+		batchSize: 100,
+	}, {
+		name:      "canceled mid batch",
+		batchSize: 7,
+		cancelAt:  10,
+	}, {
+		name:      "canceled at batch boundary",
+		batchSize: 7,
+		cancelAt:  7,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				GapFillBatchSize: tc.batchSize,
+			})
+			processTestBlocks(t, s, nil, c.blocks[0])
+			d := newFakeDcrd(t, s, c.blocks)
+
+			if tc.cancelAt > 0 {
+				ctx, cancel := context.WithCancel(s.ctx)
+				defer cancel()
+				d.mtx.Lock()
+				d.onCall = func(method string, count int) {
+					if method == "getblock" && count == tc.cancelAt {
+						cancel()
+					}
+				}
+				d.mtx.Unlock()
+
+				err := s.handleBlockConnected(ctx, &c.tip().Header)
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("unexpected error: got %v, want %v",
+						err, context.Canceled)
+				}
+
+				// No more blocks are fetched or processed after
+				// the context is canceled.
+				if got := d.callCount("getblock"); got != tc.cancelAt {
+					t.Fatalf("unexpected number of block "+
+						"fetches: got %d, want %d", got,
+						tc.cancelAt)
+				}
+				_, gotHeight := testTip(t, s)
+				if gotHeight > int64(tc.cancelAt) {
+					t.Fatalf("unexpected tip height after "+
+						"cancel: got %d, want at most %d",
+						gotHeight, tc.cancelAt)
+				}
+			}
+
+			if err := s.handleBlockConnected(s.ctx, &c.tip().Header); err != nil {
+				t.Fatalf("unable to fill gap: %v", err)
+			}
+			gotHash, gotHeight := testTip(t, s)
+			if gotHash != wantHash || gotHeight != wantHeight {
+				t.Fatalf("unexpected tip: got %d %s, want %d %s",
+					gotHeight, gotHash, wantHeight, wantHash)
+			}
+			gotBals := testBalances(t, s)
+			if !reflect.DeepEqual(gotBals, wantBals) {
+				t.Fatalf("unexpected balances: got %v, want %v",
+					gotBals, wantBals)
+			}
+		})
+	}
+}
+
+// captureLog makes the server log warnings to the returned buffer until the
+// test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger := slog.NewBackend(&buf).Logger("DROS")
+	logger.SetLevel(slog.LevelWarn)
+	oldLog := svrLog
+	svrLog = logger
+	t.Cleanup(func() { svrLog = oldLog })
+	return &buf
+}
+
+// TestSlowBlockWarning ensures a warning with the timing of each phase is
+// logged when processing a connected block takes longer than the configured
+// threshold.
+func TestSlowBlockWarning(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	b := c.addBlock(true, 2)
+	wantMsg := fmt.Sprintf("Slow processing of block %s at height 2",
+		b.BlockHash())
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		wantWarn  bool
+	}{{
+		name:  "no threshold",
+		delay: 50 * time.Millisecond,
+	}, {
+		name:      "fast block",
+		threshold: 10 * time.Second,
+	}, {
+		name:      "slow fetch",
+		threshold: 10 * time.Millisecond,
+		delay:     50 * time.Millisecond,
+		wantWarn:  true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				SlowBlockThreshold: tc.threshold,
+			})
+			processTestBlocks(t, s, nil, c.blocks[:2]...)
+			d := newFakeDcrd(t, s, c.blocks)
+			d.setDelay(tc.delay)
+			logBuf := captureLog(t)
+
+			if err := s.handleBlockConnected(s.ctx, &b.Header); err != nil {
+				t.Fatal(err)
+			}
+			logged := logBuf.String()
+			if gotWarn := strings.Contains(logged, wantMsg); gotWarn != tc.wantWarn {
+				t.Fatalf("unexpected slow block warning: got %v, "+
+					"want %v (log: %q)", gotWarn, tc.wantWarn,
+					logged)
+			}
+			if !tc.wantWarn {
+				return
+			}
+			for _, phase := range []string{"fetch", "conversion", "db commit"} {
+				if !strings.Contains(logged, phase) {
+					t.Fatalf("slow block warning without %s "+
+						"timing: %q", phase, logged)
+				}
+			}
+		})
+	}
+}
+
+// TestReadyAfterBlock ensures the server only reports itself as ready after
+// handling the first block notification that follows the initial sync when
+// the ReadyAfterBlock option is set.
+func TestReadyAfterBlock(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	c.addBlock(true, 2)
+	synced := c.blocks[:2]
+
+	// Helper to wait until f returns true.
+	waitFor := func(t *testing.T, what string, f func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !f(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		readyAfterBlock bool
+		failBlock       bool
+		wantReadySynced bool
+		wantReady       bool
+	}{{
+		name:            "ready after sync",
+		wantReadySynced: true,
+		wantReady:       true,
+	}, {
+		name:            "ready after block",
+		readyAfterBlock: true,
+		wantReady:       true,
+	}, {
+		name:            "failed block",
+		readyAfterBlock: true,
+		failBlock:       true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				ReadyAfterBlock: tc.readyAfterBlock,
+			})
+			processTestBlocks(t, s, nil, synced...)
+			d := startFakeDcrd(t, s, synced, true)
+
+			runErr := make(chan error, 1)
+			go func() { runErr <- s.Run(s.ctx) }()
+
+			// Wait until the initial sync is done.
+			waitFor(t, "initial sync", func() bool {
+				s.mtx.Lock()
+				defer s.mtx.Unlock()
+				return s.synced
+			})
+			if tc.wantReadySynced {
+				waitFor(t, "ready", s.Ready)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+				if s.Ready() {
+					t.Fatal("server ready before handling a block")
+				}
+			}
+
+			// Connect the next block.
+			d.setChain(c.blocks)
+			if tc.failBlock {
+				d.failNext("getblock", 1)
+			}
+			header, err := c.tip().Header.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.onDcrdBlockConnected(header, nil)
+
+			if tc.failBlock {
+				select {
+				case err := <-runErr:
+					if err == nil {
+						t.Fatal("server stopped without error")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("server did not stop after failed block")
+				}
+			} else {
+				waitFor(t, "ready", s.Ready)
+			}
+			if s.Ready() != tc.wantReady {
+				t.Fatalf("unexpected readiness: got %v, want %v",
+					s.Ready(), tc.wantReady)
+			}
+		})
+	}
+}
+
+// TestSyncServeConcurrency ensures the number of concurrent requests to dcrd
+// switches from the sync to the serve limit once the initial sync completes.
+func TestSyncServeConcurrency(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 40; i++ {
+		c.addBlock(true, byte(i))
+	}
+
+	const syncConcurrency, serveConcurrency = 8, 2
+	s := newTestServer(t, &ServerConfig{
+		SyncConcurrency:  syncConcurrency,
+		ServeConcurrency: serveConcurrency,
+	})
+	if got := s.concurrency(); got != syncConcurrency {
+		t.Fatalf("unexpected concurrency before sync: got %d, want %d",
+			got, syncConcurrency)
+	}
+	d := startFakeDcrd(t, s, c.blocks, true)
+	d.setDelay(5 * time.Millisecond)
+
+	go s.Run(s.ctx)
+	for deadline := time.Now().Add(5 * time.Second); !s.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the initial sync")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := d.resetMaxInFlight(); got != syncConcurrency {
+		t.Fatalf("unexpected concurrent requests during sync: got %d, "+
+			"want %d", got, syncConcurrency)
+	}
+	if got := s.concurrency(); got != serveConcurrency {
+		t.Fatalf("unexpected concurrency after sync: got %d, want %d",
+			got, serveConcurrency)
+	}
+
+	// Sequential block fetches after the sync use the serve limit.
+	err := s.processSequentialBlocks(s.ctx, 1, func(*chainhash.Hash, *wire.MsgBlock) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.resetMaxInFlight(); got != serveConcurrency {
+		t.Fatalf("unexpected concurrent requests after sync: got %d, "+
+			"want %d", got, serveConcurrency)
+	}
+}
+
+// TestDcrdGracePeriod ensures a reconnected dcrd instance that is briefly
+// unsuitable only disables the server once the grace period elapses.
+func TestDcrdGracePeriod(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+
+	tests := []struct {
+		name        string
+		unsuitable  int
+		gracePeriod time.Duration
+		wantActive  bool
+		wantChecks  int
+	}{{
+		name:       "suitable",
+		wantActive: true,
+		wantChecks: 1,
+	}, {
+		name:       "unsuitable without grace period",
+		unsuitable: 2,
+		wantChecks: 1,
+	}, {
+		name:        "suitable within grace period",
+		unsuitable:  2,
+		gracePeriod: 5 * time.Second,
+		wantActive:  true,
+		wantChecks:  3,
+	}, {
+		name:        "unsuitable after grace period",
+		unsuitable:  1000,
+		gracePeriod: 50 * time.Millisecond,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				DcrdGracePeriod: tc.gracePeriod,
+			})
+			s.dcrdCheckRetryInterval = 10 * time.Millisecond
+			d := newFakeDcrd(t, s, c.blocks)
+			d.setUnsuitable(tc.unsuitable)
+
+			s.onDcrdConnected()
+
+			s.mtx.Lock()
+			active, dcrdErr := s.active, s.dcrdErr
+			s.mtx.Unlock()
+			if active != tc.wantActive {
+				t.Fatalf("unexpected active: got %v, want %v",
+					active, tc.wantActive)
+			}
+			if gotErr := dcrdErr != nil; gotErr == tc.wantActive {
+				t.Fatalf("unexpected dcrd error: got %v, want "+
+					"error %v", dcrdErr, !tc.wantActive)
+			}
+			if tc.wantChecks > 0 && d.callCount("getinfo") != tc.wantChecks {
+				t.Fatalf("unexpected number of checks: got %d, "+
+					"want %d", d.callCount("getinfo"),
+					tc.wantChecks)
+			}
+		})
+	}
+}
+
+// TestNextDcrdRetryInterval ensures the interval between checks of a
+// reconnected dcrd instance backs off up to the maximum interval.
+func TestNextDcrdRetryInterval(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		maxInterval time.Duration
+		want        time.Duration
+	}{{
+		name:     "no maximum",
+		interval: 5 * time.Second,
+		want:     5 * time.Second,
+	}, {
+		name:        "maximum below interval",
+		interval:    5 * time.Second,
+		maxInterval: time.Second,
+		want:        5 * time.Second,
+	}, {
+		name:        "doubles",
+		interval:    5 * time.Second,
+		maxInterval: time.Minute,
+		want:        10 * time.Second,
+	}, {
+		name:        "capped",
+		interval:    40 * time.Second,
+		maxInterval: time.Minute,
+		want:        time.Minute,
+	}, {
+		name:        "at maximum",
+		interval:    time.Minute,
+		maxInterval: time.Minute,
+		want:        time.Minute,
+	}}
+
+	for _, tc := range tests {
+		got := nextDcrdRetryInterval(tc.interval, tc.maxInterval)
+		if got != tc.want {
+			t.Fatalf("%s: unexpected interval: got %s, want %s",
+				tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestOutOfOrderBlockNtfns ensures bursts of connect and disconnect
+// notifications of a reorg lead to the new chain regardless of the order in
+// which they are delivered.
+func TestOutOfOrderBlockNtfns(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2)
+	a3 := c.addBlock(true, 3, c.spendTx(b1.Transactions[0], 0, 4, 6e8))
+	a4 := c.addBlock(true, 5)
+	chainA := append([]*wire.MsgBlock{}, c.blocks...)
+
+	// The new chain forks off block 2 and spends the same output
+	// differently.
+	fork3 := c.newBlock(c.blocks[2], true, 6, c.spendTx(b1.Transactions[0],
+		0, 7, 2e8))
+	fork4 := c.newBlock(fork3, true, 8)
+	fork5 := c.newBlock(fork4, true, 9)
+	chainB := []*wire.MsgBlock{c.blocks[0], c.blocks[1], c.blocks[2],
+		fork3, fork4, fork5}
+
+	ref := newTestServer(t, nil)
+	processTestBlocks(t, ref, nil, chainB...)
+	wantHash, wantHeight := testTip(t, ref)
+	wantBals := testBalances(t, ref)
+
+	connected := func(b *wire.MsgBlock) *blockNtfn {
+		return &blockNtfn{header: &b.Header, ntfnType: blockConnected}
+	}
+	disconnected := func(b *wire.MsgBlock) *blockNtfn {
+		return &blockNtfn{header: &b.Header, ntfnType: blockDisconnected}
+	}
+
+	tests := []struct {
+		name   string
+		ntfns  []*blockNtfn
+		resync bool
+	}{{
+		name: "in order",
+		ntfns: []*blockNtfn{disconnected(a4), disconnected(a3),
+			connected(fork3), connected(fork4), connected(fork5)},
+	}, {
+		name: "connects before disconnects",
+		ntfns: []*blockNtfn{connected(fork3), connected(fork4),
+			connected(fork5), disconnected(a4), disconnected(a3)},
+		resync: true,
+	}, {
+		name: "reversed connects",
+		ntfns: []*blockNtfn{disconnected(a4), disconnected(a3),
+			connected(fork5), connected(fork4), connected(fork3)},
+	}, {
+		name: "reversed disconnects",
+		ntfns: []*blockNtfn{disconnected(a3), disconnected(a4),
+			connected(fork3), connected(fork4), connected(fork5)},
+		resync: true,
+	}, {
+		name: "interleaved",
+		ntfns: []*blockNtfn{disconnected(a4), connected(fork4),
+			connected(fork3), disconnected(a3), connected(fork5)},
+	}, {
+		name: "duplicated",
+		ntfns: []*blockNtfn{disconnected(a4), disconnected(a4),
+			disconnected(a3), connected(fork3), connected(fork4),
+			connected(fork3), connected(fork5), connected(fork5)},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			processTestBlocks(t, s, nil, chainA...)
+			d := newFakeDcrd(t, s, chainB)
+
+			for i, ntfn := range tc.ntfns {
+				if err := s.handleBlockNtfn(s.ctx, ntfn); err != nil {
+					t.Fatalf("unable to handle notification %d: %v",
+						i, err)
+				}
+			}
+
+			gotHash, gotHeight := testTip(t, s)
+			if gotHash != wantHash || gotHeight != wantHeight {
+				t.Fatalf("unexpected tip: got %d %s, want %d %s",
+					gotHeight, gotHash, wantHeight, wantHash)
+			}
+			gotBals := testBalances(t, s)
+			if !reflect.DeepEqual(gotBals, wantBals) {
+				t.Fatalf("unexpected balances: got %v, want %v",
+					gotBals, wantBals)
+			}
+
+			// Only notifications inconsistent with the db chain
+			// trigger a resync to the best block.
+			gotResync := d.callCount("getbestblock") > 0
+			if gotResync != tc.resync {
+				t.Fatalf("unexpected resync: got %v, want %v",
+					gotResync, tc.resync)
+			}
+		})
+	}
+}
+
+// noSpaceDB is a db that fails writes with an out of disk space error while
+// full is set.
+type noSpaceDB struct {
+	backenddb.DB
+	full int32
+}
+
+func (db *noSpaceDB) Update(ctx context.Context, f func(tx backenddb.WriteTx) error) error {
+	if atomic.LoadInt32(&db.full) != 0 {
+		return fmt.Errorf("unable to commit: %w", &os.PathError{
+			Op: "write", Path: "000001.vlog", Err: syscall.ENOSPC})
+	}
+	return db.DB.Update(ctx, f)
+}
+
+// TestDiskFull ensures running out of disk space while processing a block
+// keeps the server serving the processed blocks and that the failed
+// notification is retried until processing succeeds.
+func TestDiskFull(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 4; i++ {
+		c.addBlock(true, byte(i))
+	}
+
+	s := newTestServer(t, nil)
+	processTestBlocks(t, s, nil, c.blocks[:3]...)
+	newFakeDcrd(t, s, c.blocks)
+	db := &noSpaceDB{DB: s.db, full: 1}
+	s.db = db
+	s.diskFullRetryInterval = 10 * time.Millisecond
+	wantBals := testBalances(t, s)
+	wantHash, wantHeight := testTip(t, s)
+
+	ntfn := &blockNtfn{header: &c.tip().Header, ntfnType: blockConnected}
+	if err := s.handleBlockNtfn(s.ctx, ntfn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !s.DiskFull() {
+		t.Fatal("server not flagged as out of disk space")
+	}
+
+	// Requests are still served from the processed blocks.
+	if gotBals := testBalances(t, s); !reflect.DeepEqual(gotBals, wantBals) {
+		t.Fatalf("unexpected balances: got %v, want %v", gotBals, wantBals)
+	}
+	if gotHash, gotHeight := testTip(t, s); gotHash != wantHash || gotHeight != wantHeight {
+		t.Fatalf("unexpected tip: got %d %s, want %d %s", gotHeight,
+			gotHash, wantHeight, wantHash)
+	}
+
+	// The failed notification is queued again.
+	var retried *blockNtfn
+	for deadline := time.Now().Add(5 * time.Second); retried == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("failed notification was not queued again")
+		}
+		time.Sleep(5 * time.Millisecond)
+		s.mtx.Lock()
+		if len(s.blockNtfns) > 0 {
+			retried = s.blockNtfns[0]
+			s.blockNtfns = s.blockNtfns[1:]
+		}
+		s.mtx.Unlock()
+	}
+	if retried != ntfn {
+		t.Fatalf("unexpected queued notification for block %s",
+			retried.header.BlockHash())
+	}
+
+	// Processing resumes once space is available.
+	atomic.StoreInt32(&db.full, 0)
+	if err := s.handleBlockNtfn(s.ctx, retried); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.DiskFull() {
+		t.Fatal("server still flagged as out of disk space")
+	}
+	wantHash, wantHeight = c.tip().BlockHash(), int64(c.tip().Header.Height)
+	if gotHash, gotHeight := testTip(t, s); gotHash != wantHash || gotHeight != wantHeight {
+		t.Fatalf("unexpected tip: got %d %s, want %d %s", gotHeight,
+			gotHash, wantHeight, wantHash)
+	}
+}
+
+// fakeDcrd is a minimal dcrd JSON-RPC server that serves the blocks and txs
+// of a chain, for tests that exercise code paths that query dcrd.
+type fakeDcrd struct {
+	t   testing.TB
+	mtx sync.Mutex
+
+	// blocks is the main chain, indexed by height.
+	blocks []*wire.MsgBlock
+
+	// known are all the blocks ever served, including ones that were
+	// reorged out of the main chain.
+	known map[chainhash.Hash]*wire.MsgBlock
+
+	// delay is how long every reply is delayed.
+	delay time.Duration
+
+	// mempool are the txs served as unconfirmed.
+	mempool []*wire.MsgTx
+
+	// calls counts the calls received for each method.
+	calls map[string]int
+
+	// chainName is the name of the network reported by the fake dcrd.
+	chainName string
+
+	// unsuitable is the number of upcoming getinfo calls that report the
+	// fake dcrd as running without a tx index.
+	unsuitable int
+
+	// failures is the number of upcoming calls to each method that fail
+	// with an internal error.
+	failures map[string]int
+
+	// inFlight is the number of requests currently being replied to and
+	// maxInFlight the highest it has been since the last call to
+	// resetMaxInFlight.
+	inFlight    int
+	maxInFlight int
+
+	// onCall, when set, is called with the method and the number of calls
+	// received for it whenever a call is received. It is called with mtx
+	// held, so it must not call back into the fake dcrd.
+	onCall func(method string, count int)
+}
+
+// callCount returns how many calls to the given method were received.
+func (d *fakeDcrd) callCount(method string) int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.calls[method]
+}
+
+// setMempool changes the unconfirmed txs served by the fake dcrd.
+func (d *fakeDcrd) setMempool(txs ...*wire.MsgTx) {
+	d.mtx.Lock()
+	d.mempool = txs
+	d.mtx.Unlock()
+}
+
+// failNext makes the next n calls to the given method fail with an internal
+// error.
+func (d *fakeDcrd) failNext(method string, n int) {
+	d.mtx.Lock()
+	d.failures[method] = n
+	d.mtx.Unlock()
+}
+
+// setUnsuitable makes the next n getinfo calls report the fake dcrd as
+// running without a tx index, which makes it unsuitable for the server.
+func (d *fakeDcrd) setUnsuitable(n int) {
+	d.mtx.Lock()
+	d.unsuitable = n
+	d.mtx.Unlock()
+}
+
+// resetMaxInFlight waits until no requests are in flight, then resets the
+// highest number of concurrent requests and returns its previous value.
+func (d *fakeDcrd) resetMaxInFlight() int {
+	for {
+		d.mtx.Lock()
+		if d.inFlight == 0 {
+			maxInFlight := d.maxInFlight
+			d.maxInFlight = 0
+			d.mtx.Unlock()
+			return maxInFlight
+		}
+		d.mtx.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// setDelay changes how long every reply is delayed.
+func (d *fakeDcrd) setDelay(delay time.Duration) {
+	d.mtx.Lock()
+	d.delay = delay
+	d.mtx.Unlock()
+}
+
+// setChain changes the main chain served by the fake dcrd.
+func (d *fakeDcrd) setChain(blocks []*wire.MsgBlock) {
+	d.mtx.Lock()
+	d.blocks = blocks
+	for _, b := range blocks {
+		d.known[b.BlockHash()] = b
+	}
+	d.mtx.Unlock()
+}
+
+// result returns the result of the given rpc call or an rpc error.
+func (d *fakeDcrd) result(method string, params []json.RawMessage) (interface{}, *dcrjson.RPCError) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.calls[method]++
+	if d.onCall != nil {
+		d.onCall(method, d.calls[method])
+	}
+	if d.failures[method] > 0 {
+		d.failures[method]--
+		return nil, dcrjson.NewRPCError(dcrjson.ErrRPCInternal.Code,
+			"transient failure")
+	}
+
+	// Helper to decode the param at index i into v.
+	param := func(i int, v interface{}) *dcrjson.RPCError {
+		if i >= len(params) || json.Unmarshal(params[i], v) != nil {
+			return dcrjson.NewRPCError(dcrjson.ErrRPCInvalidParameter,
+				"invalid parameter")
+		}
+		return nil
+	}
+	// Helper to find a block by the hash in the first param.
+	blockParam := func() (*wire.MsgBlock, *dcrjson.RPCError) {
+		var s string
+		if err := param(0, &s); err != nil {
+			return nil, err
+		}
+		hash, err := chainhash.NewHashFromStr(s)
+		if err != nil {
+			return nil, dcrjson.NewRPCError(dcrjson.ErrRPCDecodeHexString,
+				err.Error())
+		}
+		b, ok := d.known[*hash]
+		if !ok {
+			return nil, dcrjson.NewRPCError(dcrjson.ErrRPCBlockNotFound,
+				"block not found")
+		}
+		return b, nil
+	}
+	// Helper to serialize v as a hex string.
+	hexBytes := func(v interface{ Bytes() ([]byte, error) }) (interface{}, *dcrjson.RPCError) {
+		b, err := v.Bytes()
+		if err != nil {
+			d.t.Error(err)
+			return nil, dcrjson.NewRPCError(dcrjson.ErrRPCInternal.Code,
+				err.Error())
+		}
+		return hex.EncodeToString(b), nil
+	}
+
+	switch method {
+	case "getblockchaininfo":
+		tipHeight := int64(len(d.blocks) - 1)
+		return &chainjson.GetBlockChainInfoResult{
+			Chain:      d.chainName,
+			Blocks:     tipHeight,
+			SyncHeight: tipHeight,
+		}, nil
+
+	case "getinfo":
+		txIndex := d.unsuitable == 0
+		if !txIndex {
+			d.unsuitable--
+		}
+		return &chainjson.InfoChainResult{TxIndex: txIndex}, nil
+
+	case "version":
+		return map[string]chainjson.VersionResult{
+			"dcrdjsonrpcapi": {
+				VersionString: fmt.Sprintf("%d.%d.0",
+					wantJsonRpcMajor, wantJsonRpcMinor),
+				Major: wantJsonRpcMajor,
+				Minor: wantJsonRpcMinor,
+			},
+			"dcrd": {VersionString: "1.6.0"},
+		}, nil
+
+	case "getbestblockhash":
+		return d.blocks[len(d.blocks)-1].BlockHash().String(), nil
+
+	case "getbestblock":
+		tip := d.blocks[len(d.blocks)-1]
+		return &chainjson.GetBestBlockResult{
+			Hash:   tip.BlockHash().String(),
+			Height: int64(tip.Header.Height),
+		}, nil
+
+	case "getblockhash":
+		var height int64
+		if err := param(0, &height); err != nil {
+			return nil, err
+		}
+		if height < 0 || height >= int64(len(d.blocks)) {
+			return nil, dcrjson.NewRPCError(dcrjson.ErrRPCOutOfRange,
+				"block number out of range")
+		}
+		return d.blocks[height].BlockHash().String(), nil
+
+	case "getblock":
+		b, err := blockParam()
+		if err != nil {
+			return nil, err
+		}
+		return hexBytes(b)
+
+	case "getblockheader":
+		b, err := blockParam()
+		if err != nil {
+			return nil, err
+		}
+		return hexBytes(&b.Header)
+
+	case "getrawmempool":
+		hashes := make([]string, 0, len(d.mempool))
+		for _, tx := range d.mempool {
+			hashes = append(hashes, tx.TxHash().String())
+		}
+		return hashes, nil
+
+	case "getrawtransaction":
+		var s string
+		if err := param(0, &s); err != nil {
+			return nil, err
+		}
+		var verbose int
+		if len(params) > 1 {
+			if err := param(1, &verbose); err != nil {
+				return nil, err
+			}
+		}
+
+		// Helper to return the tx with the given number of
+		// confirmations.
+		reply := func(tx *wire.MsgTx, confirmations int64) (interface{}, *dcrjson.RPCError) {
+			txHex, err := hexBytes(tx)
+			if err != nil || verbose == 0 {
+				return txHex, err
+			}
+			return &chainjson.TxRawResult{
+				Hex:           txHex.(string),
+				Txid:          s,
+				Confirmations: confirmations,
+			}, nil
+		}
+		for _, tx := range d.mempool {
+			if tx.TxHash().String() == s {
+				return reply(tx, 0)
+			}
+		}
+		tipHeight := int64(len(d.blocks) - 1)
+		for _, b := range d.known {
+			var confirmations int64
+			height := int64(b.Header.Height)
+			if height <= tipHeight && d.blocks[height].BlockHash() == b.BlockHash() {
+				confirmations = tipHeight - height + 1
+			}
+			for _, tx := range append(b.Transactions, b.STransactions...) {
+				if tx.TxHash().String() == s {
+					return reply(tx, confirmations)
+				}
+			}
+		}
+		return nil, dcrjson.NewRPCError(dcrjson.ErrRPCNoTxInfo,
+			"no information for transaction")
+	}
+
+	return nil, dcrjson.NewRPCError(dcrjson.ErrRPCMethodNotFound.Code,
+		"method not found")
+}
+
+// fakeDcrdRequest is a request received by the fake dcrd.
+type fakeDcrdRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     interface{}       `json:"id"`
+}
+
+// reply returns the reply to the given request after the configured delay or
+// nil if ctx is canceled first.
+//
+// Only successful requests are tracked as in flight, so that requests clients
+// abandon after reaching the tip of the chain aren't counted.
+func (d *fakeDcrd) reply(ctx context.Context, req *fakeDcrdRequest) interface{} {
+	result, rpcErr := d.result(req.Method, req.Params)
+	d.mtx.Lock()
+	delay := d.delay
+	if rpcErr == nil {
+		d.inFlight++
+		if d.inFlight > d.maxInFlight {
+			d.maxInFlight = d.inFlight
+		}
+		defer func() {
+			d.mtx.Lock()
+			d.inFlight--
+			d.mtx.Unlock()
+		}()
+	}
+	d.mtx.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil
+	}
+	return map[string]interface{}{
+		"result": result,
+		"error":  rpcErr,
+		"id":     req.ID,
+	}
+}
+
+// serveWebsocket serves the requests received through a websocket connection,
+// replying to them concurrently like dcrd does.
+func (d *fakeDcrd) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	var upgrader websocket.Upgrader
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		d.t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var writeMtx sync.Mutex
+	for {
+		var req fakeDcrdRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := d.reply(ctx, &req)
+			if reply == nil {
+				return
+			}
+			writeMtx.Lock()
+			conn.WriteJSON(reply)
+			writeMtx.Unlock()
+		}()
+	}
+}
+
+func (d *fakeDcrd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ws" {
+		d.serveWebsocket(w, r)
+		return
+	}
+
+	var req fakeDcrdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := d.reply(r.Context(), &req)
+	if reply == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		d.t.Error(err)
+	}
+}
+
+// startFakeDcrd starts a fake dcrd serving the given main chain and connects
+// the server to it, either through a websocket or through http POST requests.
+// Requests sent through http POST are serialized by the rpc client.
+func startFakeDcrd(t testing.TB, s *Server, blocks []*wire.MsgBlock, useWebsocket bool) *fakeDcrd {
+	t.Helper()
+	d := &fakeDcrd{
+		t:         t,
+		known:     make(map[chainhash.Hash]*wire.MsgBlock),
+		calls:     make(map[string]int),
+		failures:  make(map[string]int),
+		chainName: s.chainParams.Name,
+	}
+	d.setChain(blocks)
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+
+	c, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:                 srv.Listener.Addr().String(),
+		Endpoint:             "ws",
+		User:                 "user",
+		Pass:                 "pass",
+		DisableTLS:           true,
+		DisableAutoReconnect: true,
+		HTTPPostMode:         !useWebsocket,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Shutdown)
+	s.c = c
+	return d
+}
+
+// newFakeDcrd starts a fake dcrd serving the given main chain and connects
+// the server to it through http POST requests.
+func newFakeDcrd(t testing.TB, s *Server, blocks []*wire.MsgBlock) *fakeDcrd {
+	t.Helper()
+	return startFakeDcrd(t, s, blocks, false)
+}
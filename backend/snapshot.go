@@ -0,0 +1,105 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"decred.org/dcrros/backend/backenddb"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v3"
+)
+
+// ExportSnapshot writes a snapshot of the balances of every account as of the
+// last processed block into w.
+//
+// The resulting snapshot may be used to bootstrap a different dcrros instance
+// by specifying it in the SnapshotFile config option.
+func (s *Server) ExportSnapshot(ctx context.Context, w io.Writer) error {
+	snap := &backenddb.Snapshot{
+		Balances: make(map[string]dcrutil.Amount),
+	}
+	var err error
+	snap.BlockHash, snap.Height, err = s.ForEachBalance(ctx, func(account string, balance dcrutil.Amount) error {
+		snap.Balances[account] = balance
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return backenddb.WriteSnapshot(w, snap)
+}
+
+// writeSnapshotFile writes a snapshot of the balances into the given file.
+func (s *Server) writeSnapshotFile(ctx context.Context, fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	if err := s.ExportSnapshot(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importSnapshotFile bootstraps the server's db with the balances stored in
+// the given snapshot file.
+//
+// The snapshot is only imported if the db is empty and the block it was taken
+// at is part of the current mainchain as reported by dcrd.
+func (s *Server) importSnapshotFile(ctx context.Context, fname string) error {
+	var tipHash chainhash.Hash
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, _, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if tipHash != (chainhash.Hash{}) {
+		svrLog.Infof("Ignoring snapshot file since the db has already " +
+			"processed blocks")
+		return nil
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	snap, err := backenddb.ReadSnapshot(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read snapshot: %w", err)
+	}
+
+	// Verify the snapshot was taken at a block of the current mainchain.
+	// We don't trust the snapshot otherwise.
+	chainHash, err := s.getChainBlockHash(ctx, snap.Height)
+	if err != nil {
+		return err
+	}
+	if *chainHash != snap.BlockHash {
+		return fmt.Errorf("snapshot block %s does not match mainchain "+
+			"block %s at height %d", snap.BlockHash, chainHash,
+			snap.Height)
+	}
+
+	err = s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+		return s.db.StoreBalances(dbtx, snap.BlockHash, snap.Height, snap.Balances)
+	})
+	if err != nil {
+		return err
+	}
+
+	svrLog.Infof("Imported snapshot of %d accounts at block %d %s",
+		len(snap.Balances), snap.Height, snap.BlockHash)
+	return nil
+}
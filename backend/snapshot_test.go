@@ -0,0 +1,102 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestSnapshotRoundTrip ensures a db bootstrapped from the snapshot of
+// another server continues syncing to the same balances as that server.
+func TestSnapshotRoundTrip(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	b2 := c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(true, 4)
+
+	// Blocks after the snapshot spend outputs created before it.
+	c.addBlock(true, 5, c.spendTx(b2.Transactions[1], 0, 6, 5e8))
+	c.addBlock(false, 7, c.spendTx(b2.Transactions[0], 0, 8, 9e8))
+	snapHeight := 3
+
+	// Export a snapshot midway through processing the chain.
+	snapFile := testTempFile(t, "snapshot")
+	src := newTestServer(t, nil)
+	processTestBlocks(t, src, nil, c.blocks[:snapHeight+1]...)
+	if err := src.writeSnapshotFile(src.ctx, snapFile); err != nil {
+		t.Fatal(err)
+	}
+	snapBals := testBalances(t, src)
+	processTestBlocks(t, src, c.blocks[snapHeight], c.blocks[snapHeight+1:]...)
+
+	// Import the snapshot into a fresh db.
+	dst := newTestServer(t, nil)
+	newFakeDcrd(t, dst, c.blocks)
+	if err := dst.importSnapshotFile(dst.ctx, snapFile); err != nil {
+		t.Fatalf("unable to import snapshot: %v", err)
+	}
+	tipHash, tipHeight := testTip(t, dst)
+	if tipHash != c.blocks[snapHeight].BlockHash() || tipHeight != int64(snapHeight) {
+		t.Fatalf("unexpected tip after import: %d %s", tipHeight, tipHash)
+	}
+	if gotBals := testBalances(t, dst); !reflect.DeepEqual(gotBals, snapBals) {
+		t.Fatalf("unexpected imported balances: got %v, want %v",
+			gotBals, snapBals)
+	}
+
+	// Importing the snapshot again is a no-op, since the db is no longer
+	// empty.
+	if err := dst.importSnapshotFile(dst.ctx, snapFile); err != nil {
+		t.Fatalf("unexpected error importing snapshot again: %v", err)
+	}
+
+	// Continue syncing from dcrd.
+	if err := dst.handleBlockConnected(dst.ctx, &c.tip().Header); err != nil {
+		t.Fatalf("unable to sync after importing snapshot: %v", err)
+	}
+	wantHash, wantHeight := testTip(t, src)
+	if tipHash, tipHeight := testTip(t, dst); tipHash != wantHash || tipHeight != wantHeight {
+		t.Fatalf("unexpected tip: got %d %s, want %d %s", tipHeight,
+			tipHash, wantHeight, wantHash)
+	}
+	wantBals := testBalances(t, src)
+	if gotBals := testBalances(t, dst); !reflect.DeepEqual(gotBals, wantBals) {
+		t.Fatalf("unexpected balances: got %v, want %v", gotBals,
+			wantBals)
+	}
+}
+
+// TestSnapshotNotInMainchain ensures snapshots taken at a block that is not
+// part of the mainchain reported by dcrd are not imported.
+func TestSnapshotNotInMainchain(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	c.addBlock(true, 2)
+	fork2 := c.newBlock(c.blocks[1], true, 3)
+
+	snapFile := testTempFile(t, "snapshot")
+	src := newTestServer(t, nil)
+	processTestBlocks(t, src, nil, c.blocks...)
+	if err := src.writeSnapshotFile(src.ctx, snapFile); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestServer(t, nil)
+	newFakeDcrd(t, dst, []*wire.MsgBlock{c.blocks[0], c.blocks[1], fork2})
+	if err := dst.importSnapshotFile(dst.ctx, snapFile); err == nil {
+		t.Fatal("expected an error importing a snapshot of a reorged " +
+			"block")
+	}
+	if tipHash, _ := testTip(t, dst); tipHash != (chainhash.Hash{}) {
+		t.Fatalf("unexpected tip after failed import: %s", tipHash)
+	}
+}
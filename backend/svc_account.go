@@ -6,6 +6,8 @@ package backend
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"decred.org/dcrros/backend/backenddb"
@@ -60,15 +62,45 @@ func updateUtxoSet(op *types.Op, utxoSet map[wire.OutPoint]*types.PrevInput) {
 	}
 }
 
-func (s *Server) preProcessAccountBlock(ctx context.Context, bh *chainhash.Hash, b, prev *wire.MsgBlock, utxoSet map[wire.OutPoint]*types.PrevInput) error {
+// balanceAccount returns the key used to track the balance of the given
+// account and sub-account in the db.
+func balanceAccount(account, subAccount string) string {
+	if subAccount == "" {
+		return account
+	}
+	return account + "/" + subAccount
+}
+
+// blockTimings tracks how long each phase of processing a block took.
+type blockTimings struct {
+	fetch   time.Duration
+	convert time.Duration
+	commit  time.Duration
+}
+
+// preProcessAccountBlock updates the balances of the accounts modified by
+// block b. If timings is not nil, the duration of the conversion and commit
+// phases is recorded in it.
+func (s *Server) preProcessAccountBlock(ctx context.Context, bh *chainhash.Hash, b, prev *wire.MsgBlock, utxoSet map[wire.OutPoint]*types.PrevInput, timings *blockTimings) error {
 	fetchInputs := s.makeInputsFetcher(ctx, utxoSet)
+	start := time.Now()
+	var converted time.Time
 
 	height := int64(b.Header.Height)
 	newBalances := make(map[string]dcrutil.Amount)
 
-	return s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+	err := s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
 		applyOp := func(op *types.Op) error {
+			// Commitments and subsidies don't change any
+			// balances.
+			if op.Type == types.OpTypeCommitment || op.Type == types.OpTypeSubsidy {
+				return nil
+			}
+
 			account := op.Account
+			if s.stakedSubAccount {
+				account = balanceAccount(op.Account, op.SubAccount)
+			}
 			if _, ok := newBalances[account]; !ok {
 				// First time on this block we're modifying
 				// this account, so fetch the current balance
@@ -90,6 +122,23 @@ func (s *Server) preProcessAccountBlock(ctx context.Context, bh *chainhash.Hash,
 			// network call back to dcrd.
 			updateUtxoSet(op, utxoSet)
 
+			// Cache new outputs, which are likely to be spent
+			// soon. Outputs are determined by the hash of their
+			// tx, so entries remain valid even if the block is
+			// later reorged out.
+			if op.Type == types.OpTypeCredit && op.Status == types.OpStatusSuccess {
+				outp := wire.OutPoint{
+					Hash:  op.Tx.TxHash(),
+					Index: uint32(op.IOIndex),
+					Tree:  op.Tree,
+				}
+				s.cachePrevInputs.Add(outp, &types.PrevInput{
+					Amount:   op.Amount,
+					PkScript: op.Out.PkScript,
+					Version:  op.Out.Version,
+				})
+			}
+
 			return nil
 		}
 
@@ -97,17 +146,244 @@ func (s *Server) preProcessAccountBlock(ctx context.Context, bh *chainhash.Hash,
 		if err != nil {
 			return err
 		}
+		converted = time.Now()
 
 		// Update the db with the new balances.
 		return s.db.StoreBalances(dbtx, *bh, height, newBalances)
 	})
+	if err != nil {
+		return err
+	}
+	if timings != nil {
+		timings.convert = converted.Sub(start)
+		timings.commit = time.Since(converted)
+	}
+
+	return s.appendBlockLog(bh, b)
+}
+
+// checkAccountFormat verifies the account addresses stored in the db use the
+// current account format, recording the current format in new dbs and
+// migrating dbs that use a different format.
+//
+// Dbs created before the format was tracked report version 0 and are migrated
+// as well. Only an empty db is assumed to use the current format.
+func (s *Server) checkAccountFormat(ctx context.Context) error {
+	var version uint32
+	var tipHash chainhash.Hash
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		if version, err = s.db.AccountFormat(dbtx); err != nil {
+			return err
+		}
+		tipHash, _, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version == types.AccountFormatVersion:
+		return nil
+
+	case version == 0 && tipHash == (chainhash.Hash{}):
+		// New db.
+		return s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+			return s.db.StoreAccountFormat(dbtx, types.AccountFormatVersion)
+		})
+
+	case s.ignoreAccountFormat:
+		svrLog.Warnf("Db uses account format version %d instead of %d. "+
+			"Balances of accounts whose address changed will be "+
+			"inconsistent.", version, types.AccountFormatVersion)
+		return nil
+
+	default:
+		return s.migrateAccountFormat(ctx, version)
+	}
+}
+
+// migrateAccountFormat re-derives the account addresses of a db that uses
+// the given account format version, which is not the current one.
+//
+// Account addresses cannot be re-derived from the stored balances alone and
+// the db does not store blocks. Therefore every processed block after genesis
+// (which does not pay to any account) is rolled back and the same blocks are
+// processed again using the current format. Blocks are read from the block
+// log when one is configured and otherwise fetched by their processed hash
+// from the block cache or dcrd. The processed chain is re-derived as is,
+// without syncing to the current dcrd tip, but without a block log every
+// block is downloaded again.
+//
+// The new version is only stored after all blocks are rolled back, so an
+// interrupted rollback is resumed on the next start. Blocks not processed
+// again by an interrupted migration are processed by the regular sync.
+func (s *Server) migrateAccountFormat(ctx context.Context, version uint32) error {
+	// hashes[i] is the hash of the processed block at height i.
+	var hashes []chainhash.Hash
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		_, tipHeight, err := s.db.LastProcessedBlock(dbtx)
+		if err != nil {
+			return err
+		}
+
+		// Dbs bootstrapped from a snapshot don't have the blocks
+		// before the snapshot.
+		_, err = s.db.ProcessedBlockHash(dbtx, 0)
+		if errors.Is(err, backenddb.ErrBlockHeightNotFound) {
+			return fmt.Errorf("db uses account format version %d "+
+				"instead of %d and was not processed from genesis "+
+				"-- reprocess the chain from an empty db", version,
+				types.AccountFormatVersion)
+		}
+		if err != nil {
+			return err
+		}
+
+		hashes = make([]chainhash.Hash, tipHeight+1)
+		for i := range hashes {
+			hashes[i], err = s.db.ProcessedBlockHash(dbtx, int64(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tipHeight := int64(len(hashes) - 1)
+	svrLog.Infof("Migrating db from account format version %d to %d. "+
+		"Rolling back %d blocks", version, types.AccountFormatVersion,
+		tipHeight)
+	for tipHeight > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+			for i := 0; i < migrationBatchSize && tipHeight > 0; i++ {
+				err := s.db.RollbackTip(dbtx, tipHeight, hashes[tipHeight])
+				if err != nil {
+					return err
+				}
+				tipHeight--
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.db.Update(ctx, func(dbtx backenddb.WriteTx) error {
+		return s.db.StoreAccountFormat(dbtx, types.AccountFormatVersion)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Replay the processed blocks from the block log. Blocks replayed up
+	// to an error were fully processed, so the migration continues from
+	// them.
+	if s.blockLogFile != "" {
+		err = s.replayBlockLogFile(ctx, s.blockLogFile)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			svrLog.Warnf("Unable to replay block log %s: %v. Remaining "+
+				"blocks will be fetched from dcrd",
+				s.blockLogFile, err)
+		}
+	}
+
+	return s.reprocessBlocks(ctx, hashes)
+}
+
+// reprocessBlocks processes the blocks with the given hashes (indexed by
+// height) that are after the last processed block. Blocks are only processed
+// while the last processed block is the one in hashes at its height.
+func (s *Server) reprocessBlocks(ctx context.Context, hashes []chainhash.Hash) error {
+	var tipHash chainhash.Hash
+	var tipHeight int64
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if tipHeight >= int64(len(hashes)) || hashes[tipHeight] != tipHash {
+		svrLog.Infof("Processed chain diverged from the migrated one at "+
+			"height %d. Remaining blocks will be processed by the "+
+			"sync", tipHeight)
+		return nil
+	}
+	if tipHeight == int64(len(hashes)-1) {
+		return nil
+	}
+
+	svrLog.Infof("Processing blocks %d to %d again", tipHeight+1,
+		len(hashes)-1)
+	prev, err := s.getBlock(ctx, &tipHash)
+	if err != nil {
+		return err
+	}
+	utxoSet := make(map[wire.OutPoint]*types.PrevInput)
+	for height := tipHeight + 1; height < int64(len(hashes)); height++ {
+		bh := &hashes[height]
+		b, err := s.getBlock(ctx, bh)
+		if err != nil {
+			return err
+		}
+		err = s.preProcessAccountBlock(ctx, bh, b, prev, utxoSet, nil)
+		if err != nil {
+			return err
+		}
+		if height%2000 == 0 {
+			svrLog.Infof("Processed up to height %d", height)
+		}
+		prev = b
+	}
+	return nil
 }
 
 // preProcessAccounts pre-processes the blockchain to setup the account
 // balances index in the server's badger db.
 //
+// Failures are retried up to syncRetries times with an exponential backoff,
+// restarting from the last processed block and fetching blocks and inputs
+// from dcrd again.
+//
 // This is called during server startup.
 func (s *Server) preProcessAccounts(ctx context.Context) error {
+	delay := s.syncRetryDelay
+	for attempt := uint(1); ; attempt++ {
+		err := s.preProcessAccountsOnce(ctx)
+		if err == nil || ctx.Err() != nil || attempt > s.syncRetries {
+			return err
+		}
+
+		svrLog.Warnf("Retrying sync in %s (attempt %d of %d)", delay,
+			attempt, s.syncRetries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxSyncRetryDelay {
+			delay = maxSyncRetryDelay
+		}
+	}
+}
+
+// preProcessAccountsOnce processes every block after the last processed one
+// up to the current tip.
+func (s *Server) preProcessAccountsOnce(ctx context.Context) error {
 	start := time.Now()
 
 	var startHeight int64
@@ -125,7 +401,7 @@ func (s *Server) preProcessAccounts(ctx context.Context) error {
 	// Verify if the last processed block matches the block in the
 	// mainchain at startHeight. If it doesn't, we'll have to roll back due
 	// to a reorg that happened while we were offline.
-	hash, err := s.c.GetBlockHash(ctx, startHeight)
+	hash, err := s.getChainBlockHash(ctx, startHeight)
 	if err != nil {
 		return err
 	}
@@ -154,11 +430,17 @@ func (s *Server) preProcessAccounts(ctx context.Context) error {
 	// many blocks (useful during initial startup).
 	utxoSet := make(map[wire.OutPoint]*types.PrevInput)
 
+	// Start processing at the block after the last processed one, unless
+	// the db is empty, in which case we start at genesis.
+	if startHash != (chainhash.Hash{}) {
+		startHeight++
+	}
+
 	// Sequentially process the chain.
 	svrLog.Infof("Pre-processing accounts in blocks starting at %d", startHeight)
-	var lastHeight int64
+	lastHeight := startHeight - 1
 	err = s.processSequentialBlocks(ctx, startHeight, func(bh *chainhash.Hash, b *wire.MsgBlock) error {
-		err := s.preProcessAccountBlock(ctx, bh, b, prev, utxoSet)
+		err := s.preProcessAccountBlock(ctx, bh, b, prev, utxoSet, nil)
 		if err != nil {
 			return err
 		}
@@ -182,6 +464,31 @@ func (s *Server) preProcessAccounts(ctx context.Context) error {
 	return nil
 }
 
+// confirmedBlockId returns the identifier of the block that is
+// balanceConfirmations blocks behind the last processed block. It returns nil
+// (i.e. the tip) when no confirmation window is configured.
+func (s *Server) confirmedBlockId(ctx context.Context) (*rtypes.PartialBlockIdentifier, error) {
+	if s.balanceConfirmations == 0 {
+		return nil, nil
+	}
+
+	var tipHeight int64
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		_, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	height := tipHeight - int64(s.balanceConfirmations)
+	if height < 0 {
+		height = 0
+	}
+	return &rtypes.PartialBlockIdentifier{Index: &height}, nil
+}
+
 func (s *Server) AccountBalance(ctx context.Context, req *rtypes.AccountBalanceRequest) (*rtypes.AccountBalanceResponse, *rtypes.Error) {
 	if req.AccountIdentifier == nil {
 		// It doesn't make sense to return "all balances" of the
@@ -189,29 +496,95 @@ func (s *Server) AccountBalance(ctx context.Context, req *rtypes.AccountBalanceR
 		return nil, types.ErrInvalidArgument.RError()
 	}
 
-	// Decode the relevant account(=address).
+	// Decode the relevant account(=address). Accounts of bare multisig
+	// scripts and of scripts that can't be represented by a standard
+	// address use their own encodings.
 	saddr := req.AccountIdentifier.Address
-	_, err := dcrutil.DecodeAddress(saddr, s.chainParams)
-	if err != nil {
-		return nil, types.ErrInvalidAccountIdAddr.RError()
+	var err error
+	if !types.IsRawAccountAddr(saddr) && !types.IsMultisigAccountAddr(saddr, s.chainParams) {
+		_, err = dcrutil.DecodeAddress(saddr, s.chainParams)
+		if err != nil {
+			return nil, types.ErrInvalidAccountIdAddr.RError()
+		}
+	}
+
+	// Balances of the staked sub-account are only tracked separately
+	// when the server is configured to do so.
+	if subAccount := req.AccountIdentifier.SubAccount; subAccount != nil {
+		if !s.stakedSubAccount || subAccount.Address != types.SubAccountStaked {
+			return nil, types.ErrInvalidArgument.Msg("unsupported " +
+				"sub-account").RError()
+		}
+		saddr = balanceAccount(saddr, subAccount.Address)
 	}
 
 	// Figure out when to stop considering blocks (what the target height
 	// for balance was requested for by the client). By default it's the
-	// current block height.
-	stopHash, stopHeight, _, err := s.getBlockByPartialId(ctx, req.BlockIdentifier)
+	// current block height minus the configured confirmation window.
+	//
+	// Note the confirmation window can't be overridden per request: the
+	// AccountBalanceRequest of the rosetta sdk version in use has no
+	// Metadata field, so clients that need a different window must
+	// specify the target block instead.
+	blockId := req.BlockIdentifier
+	if blockId == nil || (blockId.Hash == nil && blockId.Index == nil) {
+		blockId, err = s.confirmedBlockId(ctx)
+		if err != nil {
+			return nil, types.DcrdError(err)
+		}
+	}
+	stopHash, stopHeight, _, err := s.getBlockByPartialId(ctx, blockId)
+	if errors.Is(err, types.ErrBlockIndexAfterTip) {
+		// Blocks requested by index are only known up to the last
+		// processed block.
+		return nil, types.ErrBlockIndexAfterTip.RError()
+	}
 	if err != nil {
 		return nil, types.DcrdError(err)
 	}
+	if blockId != nil && blockId.Index != nil && *blockId.Index != stopHeight {
+		return nil, types.ErrInvalidArgument.Msg("block hash and index " +
+			"do not match").RError()
+	}
 
 	// Track the balance across batches of txs.
 	var balance dcrutil.Amount
 
 	err = s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
-		var err error
+		// Balances are only known up to the last processed block,
+		// which may lag behind dcrd's tip.
+		_, tipHeight, err := s.db.LastProcessedBlock(dbtx)
+		if err != nil {
+			return err
+		}
+		if stopHeight > tipHeight {
+			return types.ErrBlockIndexAfterTip.Msg(fmt.Sprintf(
+				"block %d is after the last processed block %d",
+				stopHeight, tipHeight))
+		}
+
+		// Blocks specified by hash may not be part of the processed
+		// chain (e.g. blocks in stale side chains), so ensure the
+		// balance is only returned for blocks we have indexed.
+		mainHash, err := s.db.ProcessedBlockHash(dbtx, stopHeight)
+		switch {
+		case errors.Is(err, backenddb.ErrBlockHeightNotFound):
+			return types.ErrBlockNotInMainchain
+		case err != nil:
+			return err
+		case mainHash != *stopHash:
+			return types.ErrBlockNotInMainchain
+		}
+
 		balance, err = s.db.Balance(dbtx, saddr, stopHeight)
 		return err
 	})
+	if errors.Is(err, types.ErrBlockNotInMainchain) {
+		return nil, types.ErrBlockNotInMainchain.RError()
+	}
+	if errors.Is(err, types.ErrBlockIndexAfterTip) {
+		return nil, types.RError(err)
+	}
 	if err != nil {
 		return nil, types.DcrdError(err)
 	}
@@ -229,3 +602,106 @@ func (s *Server) AccountBalance(ctx context.Context, req *rtypes.AccountBalanceR
 	return res, nil
 
 }
+
+// ForEachBalance calls f with every account that has a nonzero balance as of
+// the last processed block. Balances are read from a single db transaction, so
+// they are consistent even if new blocks are processed during the
+// enumeration, and they are streamed from the db without loading all of them
+// into memory.
+//
+// It returns the hash and height of the block the balances refer to.
+func (s *Server) ForEachBalance(ctx context.Context, f func(account string, balance dcrutil.Amount) error) (chainhash.Hash, int64, error) {
+	var tipHash chainhash.Hash
+	var tipHeight int64
+	err := s.db.View(ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		tipHash, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+		if err != nil {
+			return err
+		}
+
+		return s.db.Balances(dbtx, tipHeight, func(account string, balance dcrutil.Amount) error {
+			if balance == 0 {
+				return nil
+			}
+			return f(account, balance)
+		})
+	})
+	return tipHash, tipHeight, err
+}
+
+// DryRunBlock returns every op generated when processing the mainchain block
+// at the given height, including the reversal of the parent's regular
+// transactions when the block disapproves it. Commitment and subsidy ops are
+// returned as well, even though they don't change any balances, so callers
+// interested only in balance changes should filter them out by type.
+//
+// This is meant for debugging balance discrepancies, therefore it fetches all
+// data directly from dcrd, without using or modifying the db or caches.
+func (s *Server) DryRunBlock(ctx context.Context, height int64) ([]*types.Op, error) {
+	// Helper to fetch a block bypassing the cache.
+	fetchBlock := func(bh *chainhash.Hash) (*wire.MsgBlock, error) {
+		var b *wire.MsgBlock
+		err := s.dcrdCall(ctx, func(ctx context.Context) error {
+			var err error
+			b, err = s.c.GetBlock(ctx, bh)
+			return err
+		})
+		return b, err
+	}
+
+	bh, err := s.getChainBlockHash(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fetchBlock(bh)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *wire.MsgBlock
+	if !types.VoteBitsApprovesParent(b.Header.VoteBits) && height > 0 {
+		prev, err = fetchBlock(&b.Header.PrevBlock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fetchInputs := func(inputList ...*wire.OutPoint) (map[wire.OutPoint]*types.PrevInput, error) {
+		res := make(map[wire.OutPoint]*types.PrevInput, len(inputList))
+		for _, in := range inputList {
+			var tx *dcrutil.Tx
+			err := s.dcrdCall(ctx, func(ctx context.Context) error {
+				var err error
+				tx, err = s.c.GetRawTransaction(ctx, &in.Hash)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			txOut := tx.MsgTx().TxOut
+			if len(txOut) <= int(in.Index) {
+				return nil, fmt.Errorf("non-existant output index %s", in)
+			}
+			res[*in] = &types.PrevInput{
+				PkScript: txOut[in.Index].PkScript,
+				Version:  txOut[in.Index].Version,
+				Amount:   dcrutil.Amount(txOut[in.Index].Value),
+			}
+		}
+		return res, nil
+	}
+
+	var ops []*types.Op
+	applyOp := func(op *types.Op) error {
+		// The op is reused during iteration, so store a copy.
+		opCopy := *op
+		ops = append(ops, &opCopy)
+		return nil
+	}
+	err = types.IterateBlockOps(b, prev, fetchInputs, applyOp, s.chainParams)
+	if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
@@ -0,0 +1,847 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"decred.org/dcrros/backend/backenddb"
+	"decred.org/dcrros/types"
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/lru"
+	"github.com/decred/dcrd/wire"
+)
+
+// processOldFormatBlocks processes the given blocks, starting at genesis,
+// like a previous version of the server that tracked balances under the
+// account returned by oldAccount would. The blocks are also appended to the
+// block log of the server, if one is open.
+func processOldFormatBlocks(t *testing.T, s *Server, blocks []*wire.MsgBlock, oldAccount func(string) string) {
+	t.Helper()
+	var prev *wire.MsgBlock
+	utxoSet := make(map[wire.OutPoint]*types.PrevInput)
+	fetchInputs := s.makeInputsFetcher(s.ctx, utxoSet)
+	for _, b := range blocks {
+		bh := b.BlockHash()
+		height := int64(b.Header.Height)
+		s.cacheBlocks.Add(bh, b)
+		err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
+			balances := make(map[string]dcrutil.Amount)
+			applyOp := func(op *types.Op) error {
+				if op.Type == types.OpTypeCommitment || op.Type == types.OpTypeSubsidy {
+					return nil
+				}
+				account := oldAccount(op.Account)
+				if _, ok := balances[account]; !ok {
+					bal, err := s.db.Balance(dbtx, account, height-1)
+					if err != nil {
+						return err
+					}
+					balances[account] = bal
+				}
+				balances[account] += op.Amount
+				updateUtxoSet(op, utxoSet)
+
+				// Cache new outputs like the server does, so
+				// that reversing a spend doesn't need dcrd.
+				if op.Type == types.OpTypeCredit && op.Status == types.OpStatusSuccess {
+					outp := wire.OutPoint{
+						Hash:  op.Tx.TxHash(),
+						Index: uint32(op.IOIndex),
+						Tree:  op.Tree,
+					}
+					s.cachePrevInputs.Add(outp, &types.PrevInput{
+						Amount:   op.Amount,
+						PkScript: op.Out.PkScript,
+						Version:  op.Out.Version,
+					})
+				}
+				return nil
+			}
+			err := types.IterateBlockOps(b, prev, fetchInputs, applyOp, s.chainParams)
+			if err != nil {
+				return err
+			}
+			return s.db.StoreBalances(dbtx, bh, height, balances)
+		})
+		if err != nil {
+			t.Fatalf("unable to process block %d: %v", height, err)
+		}
+		if err := s.appendBlockLog(&bh, b); err != nil {
+			t.Fatal(err)
+		}
+		prev = b
+	}
+}
+
+// TestMigrateAccountFormat ensures dbs using a previous account format version
+// are migrated to the current one, re-deriving the account of every balance.
+func TestMigrateAccountFormat(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(false, 1)
+	c.addBlock(true, 4, c.spendTx(b1.Transactions[0], 0, 5, 9e8))
+
+	// Process the chain with the current format to determine the
+	// expected balances. The third block disapproves the spend in the
+	// second one, so the same output is spent again in the fourth block.
+	ref := newTestServer(t, nil)
+	processTestBlocks(t, ref, nil, c.blocks...)
+	wantBalances := map[string]dcrutil.Amount{
+		testAddr(t, 1, params).Address(): 10e8,
+		testAddr(t, 4, params).Address(): 10e8,
+		testAddr(t, 5, params).Address(): 9e8,
+	}
+	if gotBals := testBalances(t, ref); !reflect.DeepEqual(gotBals, wantBalances) {
+		t.Fatalf("unexpected reference balances: got %v, want %v",
+			gotBals, wantBalances)
+	}
+
+	// Simulate a previous format that used a different account address
+	// for every output.
+	oldAccount := func(account string) string {
+		return "old:" + account
+	}
+
+	tests := []struct {
+		name     string
+		version  uint32
+		blockLog bool
+		fromDcrd bool
+	}{{
+		// With a block log, blocks are replayed from it.
+		name:     "with block log",
+		version:  types.AccountFormatVersion - 1,
+		blockLog: true,
+	}, {
+		// Without a block log, the processed blocks are fetched again
+		// from the block cache.
+		name:    "without block log",
+		version: types.AccountFormatVersion - 1,
+	}, {
+		// Without a block log or cached blocks, the processed blocks
+		// are fetched again from dcrd.
+		name:     "from dcrd",
+		version:  types.AccountFormatVersion - 1,
+		fromDcrd: true,
+	}, {
+		// Dbs created before the format was tracked are migrated.
+		name:    "unversioned db",
+		version: 0,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &ServerConfig{}
+			if tc.blockLog {
+				cfg.BlockLogFile = testTempFile(t, "blocks.log")
+			}
+			s := newTestServer(t, cfg)
+			if tc.blockLog {
+				f, err := openBlockLog(cfg.BlockLogFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.blockLog = f
+			}
+			processOldFormatBlocks(t, s, c.blocks, oldAccount)
+			if s.blockLog != nil {
+				s.blockLog.Close()
+				s.blockLog = nil
+			}
+			if tc.fromDcrd {
+				cacheBlocks := lru.NewKVCache(1000)
+				cachePrevInputs := lru.NewKVCache(1000)
+				s.cacheBlocks = &cacheBlocks
+				s.cachePrevInputs = &cachePrevInputs
+				newFakeDcrd(t, s, c.blocks)
+			}
+			if tc.version != 0 {
+				err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
+					return s.db.StoreAccountFormat(dbtx, tc.version)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := s.checkAccountFormat(s.ctx); err != nil {
+				t.Fatalf("unexpected migration error: %v", err)
+			}
+
+			var version uint32
+			var tipHeight int64
+			err := s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+				var err error
+				if version, err = s.db.AccountFormat(dbtx); err != nil {
+					return err
+				}
+				_, tipHeight, err = s.db.LastProcessedBlock(dbtx)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != types.AccountFormatVersion {
+				t.Fatalf("unexpected account format version: got %d, "+
+					"want %d", version, types.AccountFormatVersion)
+			}
+			if wantHeight := int64(c.tip().Header.Height); tipHeight != wantHeight {
+				t.Fatalf("unexpected tip height: got %d, want %d",
+					tipHeight, wantHeight)
+			}
+			gotBals := testBalances(t, s)
+			if !reflect.DeepEqual(gotBals, wantBalances) {
+				t.Fatalf("unexpected balances: got %v, want %v",
+					gotBals, wantBalances)
+			}
+		})
+	}
+}
+
+// TestMigrateAccountFormatSnapshot ensures dbs that were not processed from
+// genesis are not migrated, since their balances can't be re-derived.
+func TestMigrateAccountFormatSnapshot(t *testing.T) {
+	s := newTestServer(t, nil)
+	err := s.db.Update(s.ctx, func(dbtx backenddb.WriteTx) error {
+		balances := map[string]dcrutil.Amount{"old:account": 1e8}
+		err := s.db.StoreBalances(dbtx, chainhash.Hash{0x01}, 10, balances)
+		if err != nil {
+			return err
+		}
+		return s.db.StoreAccountFormat(dbtx, types.AccountFormatVersion-1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.checkAccountFormat(s.ctx); err == nil {
+		t.Fatal("expected an error migrating a db bootstrapped from a " +
+			"snapshot")
+	}
+}
+
+// TestCheckAccountFormatNewDb ensures an empty db is assumed to use the
+// current account format.
+func TestCheckAccountFormatNewDb(t *testing.T) {
+	s := newTestServer(t, nil)
+	if err := s.checkAccountFormat(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	var version uint32
+	err := s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+		var err error
+		version, err = s.db.AccountFormat(dbtx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != types.AccountFormatVersion {
+		t.Fatalf("unexpected account format version: got %d, want %d",
+			version, types.AccountFormatVersion)
+	}
+}
+
+// TestForEachBalance ensures every account credited in a chain is enumerated
+// with its balance, and that enumerations running concurrently with block
+// processing are consistent with the tip they report.
+func TestForEachBalance(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	for i := 0; i < 20; i++ {
+		c.addBlock(true, byte(10+i%5))
+	}
+
+	for _, dbType := range []DBType{DBTypeMem, DBTypeBadgerMem} {
+		t.Run(string(dbType), func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{DBType: dbType})
+			processTestBlocks(t, s, nil, c.blocks[:3]...)
+
+			// Enumerate balances while the remaining blocks are
+			// processed.
+			type snapshot struct {
+				height   int64
+				balances map[string]dcrutil.Amount
+			}
+			snaps := make(chan snapshot)
+			done := make(chan struct{})
+			go func() {
+				defer close(snaps)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					balances := make(map[string]dcrutil.Amount)
+					_, height, err := s.ForEachBalance(s.ctx, func(account string, balance dcrutil.Amount) error {
+						balances[account] = balance
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					snaps <- snapshot{height, balances}
+				}
+			}()
+			var got []snapshot
+			collected := make(chan struct{})
+			go func() {
+				for snap := range snaps {
+					got = append(got, snap)
+				}
+				close(collected)
+			}()
+			processTestBlocks(t, s, c.blocks[2], c.blocks[3:]...)
+			close(done)
+			<-collected
+
+			// Every enumeration matches the balances as of its
+			// height.
+			for _, snap := range got {
+				err := s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+					for account, got := range snap.balances {
+						want, err := s.db.Balance(dbtx, account, snap.height)
+						if err != nil {
+							return err
+						}
+						if got != want {
+							t.Fatalf("unexpected balance of %s "+
+								"at height %d: got %v, want %v",
+								account, snap.height, got, want)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The final enumeration has every credited account, except
+			// the one whose only output was spent.
+			gotBals := testBalances(t, s)
+			for _, id := range []byte{2, 3, 10, 11, 12, 13, 14} {
+				addr := testAddr(t, id, params).Address()
+				if gotBals[addr] == 0 {
+					t.Fatalf("account %s not enumerated", addr)
+				}
+			}
+			if len(gotBals) != 7 {
+				t.Fatalf("unexpected number of accounts: got %d, "+
+					"want 7", len(gotBals))
+			}
+		})
+	}
+}
+
+// TestDryRunBlock ensures DryRunBlock returns every op generated for a block,
+// and that the ops which change balances match the balance changes recorded
+// when actually processing it.
+func TestDryRunBlock(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	c.addBlock(false, 1)
+	c.addBlock(true, 4, c.spendTx(b1.Transactions[0], 0, 5, 9e8))
+
+	s := newTestServer(t, nil)
+	processTestBlocks(t, s, nil, c.blocks...)
+	newFakeDcrd(t, s, c.blocks)
+
+	for height := int64(1); height < int64(len(c.blocks)); height++ {
+		ops, err := s.DryRunBlock(s.ctx, height)
+		if err != nil {
+			t.Fatalf("unable to dry run block %d: %v", height, err)
+		}
+
+		var nbSubsidy, nbReversed int
+		deltas := make(map[string]dcrutil.Amount)
+		for _, op := range ops {
+			if op.Status == types.OpStatusReversed {
+				nbReversed++
+			}
+			switch op.Type {
+			case types.OpTypeSubsidy:
+				nbSubsidy++
+			case types.OpTypeCommitment:
+			default:
+				deltas[op.Account] += op.Amount
+			}
+		}
+
+		// Every block has a coinbase, so at least its subsidy must be
+		// returned. Only the disapproving block reverses ops.
+		if nbSubsidy == 0 {
+			t.Fatalf("block %d: no subsidy ops returned", height)
+		}
+		wantReversed := !types.VoteBitsApprovesParent(c.blocks[height].Header.VoteBits)
+		if gotReversed := nbReversed > 0; gotReversed != wantReversed {
+			t.Fatalf("block %d: unexpected reversed ops: got %v, want %v",
+				height, gotReversed, wantReversed)
+		}
+
+		// The balance of every account must have changed by the sum
+		// of its ops.
+		for i := byte(1); i <= 5; i++ {
+			account := testAddr(t, i, params).Address()
+			if _, ok := deltas[account]; !ok {
+				deltas[account] = 0
+			}
+		}
+		err = s.db.View(s.ctx, func(dbtx backenddb.ReadTx) error {
+			for account, delta := range deltas {
+				bal, err := s.db.Balance(dbtx, account, height)
+				if err != nil {
+					return err
+				}
+				prevBal, err := s.db.Balance(dbtx, account, height-1)
+				if err != nil {
+					return err
+				}
+				if bal-prevBal != delta {
+					t.Fatalf("block %d account %s: unexpected "+
+						"balance change: got %v, want %v",
+						height, account, delta, bal-prevBal)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestAccountBalanceConfirmations ensures balances requested without a block
+// are reported as of the configured number of blocks behind the tip, and that
+// explicitly requested blocks ignore the confirmation window.
+func TestAccountBalanceConfirmations(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 5; i++ {
+		c.addBlock(true, 1)
+	}
+	tipHeight := int64(len(c.blocks) - 1)
+	account := testAddr(t, 1, params).Address()
+
+	tests := []struct {
+		name          string
+		confirmations uint
+		blockIndex    *int64
+		wantHeight    int64
+	}{{
+		name:       "no window",
+		wantHeight: tipHeight,
+	}, {
+		name:          "tip-1",
+		confirmations: 1,
+		wantHeight:    tipHeight - 1,
+	}, {
+		name:          "tip-3",
+		confirmations: 3,
+		wantHeight:    tipHeight - 3,
+	}, {
+		name:          "window past genesis",
+		confirmations: 100,
+		wantHeight:    0,
+	}, {
+		name:          "explicit block",
+		confirmations: 3,
+		blockIndex:    &tipHeight,
+		wantHeight:    tipHeight,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				BalanceConfirmations: tc.confirmations,
+			})
+			processTestBlocks(t, s, nil, c.blocks...)
+			newFakeDcrd(t, s, c.blocks)
+
+			req := &rtypes.AccountBalanceRequest{
+				AccountIdentifier: &rtypes.AccountIdentifier{
+					Address: account,
+				},
+			}
+			if tc.blockIndex != nil {
+				req.BlockIdentifier = &rtypes.PartialBlockIdentifier{
+					Index: tc.blockIndex,
+				}
+			}
+			res, rerr := s.AccountBalance(s.ctx, req)
+			if rerr != nil {
+				t.Fatalf("unexpected error: %v", rerr)
+			}
+
+			wantHash := c.blocks[tc.wantHeight].BlockHash().String()
+			if res.BlockIdentifier.Index != tc.wantHeight ||
+				res.BlockIdentifier.Hash != wantHash {
+				t.Fatalf("unexpected block: got %d %s, want %d %s",
+					res.BlockIdentifier.Index,
+					res.BlockIdentifier.Hash, tc.wantHeight,
+					wantHash)
+			}
+
+			// Every block pays 10 DCR to the account.
+			want := types.DcrAmountToRosetta(dcrutil.Amount(tc.wantHeight * 10e8))
+			if !reflect.DeepEqual(res.Balances[0], want) {
+				t.Fatalf("unexpected balance: got %v, want %v",
+					res.Balances[0], want)
+			}
+		})
+	}
+}
+
+// TestVoteSubsidyBalances ensures the stakebase subsidy redeemed by votes does
+// not change the balance of any account, while the ticket and vote payment
+// are applied to the balances.
+func TestVoteSubsidyBalances(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	ticket := c.ticketTx(b1.Transactions[0], 0, 2, 3, 9e8)
+	c.addStakeBlock(5, ticket)
+
+	// Votes only redeem a subsidy after stake validation height.
+	for int64(c.tip().Header.Height) < params.StakeValidationHeight {
+		c.addBlock(true, 5)
+	}
+	vote := c.voteTx(ticket, 4, 12e8)
+	c.addStakeBlock(5, vote)
+	nbBlocks5 := int64(len(c.blocks) - 2)
+
+	s := newTestServer(t, nil)
+	processTestBlocks(t, s, nil, c.blocks...)
+	newFakeDcrd(t, s, c.blocks)
+
+	// The vote redeems a non-zero subsidy.
+	ops, err := s.DryRunBlock(s.ctx, int64(c.tip().Header.Height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subsidy dcrutil.Amount
+	for _, op := range ops {
+		if op.Type == types.OpTypeSubsidy && op.Tree == wire.TxTreeStake {
+			subsidy += op.Amount
+		}
+	}
+	if subsidy == 0 {
+		t.Fatal("vote did not redeem any subsidy")
+	}
+
+	// The funding account spent its coinbase on the ticket, whose funds
+	// were then spent by the vote, so only the vote payment and the
+	// coinbases remain.
+	wantBalances := map[string]dcrutil.Amount{
+		testAddr(t, 4, params).Address(): 12e8,
+		testAddr(t, 5, params).Address(): dcrutil.Amount(nbBlocks5 * 10e8),
+	}
+	if gotBals := testBalances(t, s); !reflect.DeepEqual(gotBals, wantBalances) {
+		t.Fatalf("unexpected balances: got %v, want %v", gotBals,
+			wantBalances)
+	}
+}
+
+// TestAccountBalanceBlockErrors ensures balances are only returned for blocks
+// of the processed main chain, up to the last processed block.
+func TestAccountBalanceBlockErrors(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	for i := 0; i < 6; i++ {
+		c.addBlock(true, 1)
+	}
+	side := c.newBlock(c.blocks[1], true, 9)
+	const processedHeight = 4
+	account := testAddr(t, 1, params).Address()
+
+	s := newTestServer(t, nil)
+	processTestBlocks(t, s, nil, c.blocks[:processedHeight+1]...)
+	// The fake dcrd serves the side chain block even after switching to
+	// the main chain, which extends past the processed tip.
+	d := newFakeDcrd(t, s, append(c.blocks[:2:2], side))
+	d.setChain(c.blocks)
+
+	// Helpers to specify the target block.
+	hash := func(b *wire.MsgBlock) *string {
+		h := b.BlockHash().String()
+		return &h
+	}
+	index := func(i int64) *int64 {
+		return &i
+	}
+
+	tests := []struct {
+		name       string
+		blockId    *rtypes.PartialBlockIdentifier
+		wantErr    types.ErrorCode
+		wantHeight int64
+	}{{
+		name:       "processed tip",
+		blockId:    &rtypes.PartialBlockIdentifier{Hash: hash(c.blocks[processedHeight])},
+		wantHeight: processedHeight,
+	}, {
+		name:       "processed block by index",
+		blockId:    &rtypes.PartialBlockIdentifier{Index: index(2)},
+		wantHeight: 2,
+	}, {
+		name:       "processed block by hash and index",
+		blockId:    &rtypes.PartialBlockIdentifier{Hash: hash(c.blocks[2]), Index: index(2)},
+		wantHeight: 2,
+	}, {
+		name:    "side chain block",
+		blockId: &rtypes.PartialBlockIdentifier{Hash: hash(side)},
+		wantErr: types.ErrBlockNotInMainchain,
+	}, {
+		name:    "mismatched hash and index",
+		blockId: &rtypes.PartialBlockIdentifier{Hash: hash(c.blocks[2]), Index: index(3)},
+		wantErr: types.ErrInvalidArgument,
+	}, {
+		name:    "index after processed tip",
+		blockId: &rtypes.PartialBlockIdentifier{Index: index(processedHeight + 1)},
+		wantErr: types.ErrBlockIndexAfterTip,
+	}, {
+		name:    "hash after processed tip",
+		blockId: &rtypes.PartialBlockIdentifier{Hash: hash(c.blocks[processedHeight+2])},
+		wantErr: types.ErrBlockIndexAfterTip,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &rtypes.AccountBalanceRequest{
+				AccountIdentifier: &rtypes.AccountIdentifier{
+					Address: account,
+				},
+				BlockIdentifier: tc.blockId,
+			}
+			res, rerr := s.AccountBalance(s.ctx, req)
+			if tc.wantErr != types.ErrUnknown {
+				if rerr == nil || rerr.Code != int32(tc.wantErr) {
+					t.Fatalf("unexpected error: got %v, want %v",
+						rerr, tc.wantErr)
+				}
+				return
+			}
+			if rerr != nil {
+				t.Fatalf("unexpected error: %v", rerr)
+			}
+			if res.BlockIdentifier.Index != tc.wantHeight {
+				t.Fatalf("unexpected height: got %d, want %d",
+					res.BlockIdentifier.Index, tc.wantHeight)
+			}
+			want := types.DcrAmountToRosetta(dcrutil.Amount(tc.wantHeight * 10e8))
+			if !reflect.DeepEqual(res.Balances[0], want) {
+				t.Fatalf("unexpected balance: got %v, want %v",
+					res.Balances[0], want)
+			}
+		})
+	}
+}
+
+// TestPreProcessAccountsRetry ensures transient failures fetching blocks
+// during the initial sync are retried up to the configured number of times,
+// resuming from the last processed block.
+func TestPreProcessAccountsRetry(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+	for i := 0; i < 8; i++ {
+		c.addBlock(true, byte(4+i))
+	}
+
+	ref := newTestServer(t, nil)
+	processTestBlocks(t, ref, nil, c.blocks...)
+	wantHash, wantHeight := testTip(t, ref)
+	wantBals := testBalances(t, ref)
+
+	tests := []struct {
+		name     string
+		retries  uint
+		failures int
+		wantErr  bool
+	}{{
+		name: "no failures",
+	}, {
+		name:     "failure without retries",
+		failures: 1,
+		wantErr:  true,
+	}, {
+		name:     "failures within retries",
+		retries:  2,
+		failures: 2,
+	}, {
+		name:     "failures exceeding retries",
+		retries:  2,
+		failures: 3,
+		wantErr:  true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				SyncRetries:     tc.retries,
+				CacheSizeBlocks: 1,
+			})
+			s.syncRetryDelay = time.Millisecond
+			d := newFakeDcrd(t, s, c.blocks)
+			d.failNext("getblock", tc.failures)
+
+			err := s.preProcessAccounts(s.ctx)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("unexpected error: got %v, want error %v",
+					err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			// Every failed attempt fetches the block again.
+			wantFetches := len(c.blocks) + tc.failures
+			if got := d.callCount("getblock"); got < wantFetches {
+				t.Fatalf("unexpected number of block fetches: got "+
+					"%d, want at least %d", got, wantFetches)
+			}
+			gotHash, gotHeight := testTip(t, s)
+			if gotHash != wantHash || gotHeight != wantHeight {
+				t.Fatalf("unexpected tip: got %d %s, want %d %s",
+					gotHeight, gotHash, wantHeight, wantHash)
+			}
+			gotBals := testBalances(t, s)
+			if !reflect.DeepEqual(gotBals, wantBals) {
+				t.Fatalf("unexpected balances: got %v, want %v",
+					gotBals, wantBals)
+			}
+		})
+	}
+}
+
+// TestStakedSubAccountBalances ensures ticket funds are moved into the staked
+// sub-account of the ticket owner when tracked separately and out of it once
+// the ticket is redeemed, while they remain part of the main account
+// otherwise.
+func TestStakedSubAccountBalances(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	ticket := c.ticketTx(b1.Transactions[0], 0, 2, 3, 9e8)
+	ticketBlock := c.addStakeBlock(5, ticket)
+	vote := c.voteTx(ticket, 4, 10e8)
+	voteBlock := c.addStakeBlock(5, vote)
+	ticketHeight := int64(ticketBlock.Header.Height)
+	voteHeight := int64(voteBlock.Header.Height)
+
+	staked := &rtypes.SubAccountIdentifier{Address: types.SubAccountStaked}
+	tests := []struct {
+		name       string
+		enabled    bool
+		addr       byte
+		subAccount *rtypes.SubAccountIdentifier
+		height     int64
+		want       dcrutil.Amount
+		wantErr    bool
+	}{{
+		name:    "funding account after ticket",
+		enabled: true,
+		addr:    1,
+		height:  ticketHeight,
+	}, {
+		name:    "owner after ticket",
+		enabled: true,
+		addr:    2,
+		height:  ticketHeight,
+	}, {
+		name:       "owner staked after ticket",
+		enabled:    true,
+		addr:       2,
+		subAccount: staked,
+		height:     ticketHeight,
+		want:       9e8,
+	}, {
+		name:       "owner staked after vote",
+		enabled:    true,
+		addr:       2,
+		subAccount: staked,
+		height:     voteHeight,
+	}, {
+		name:    "vote payee after vote",
+		enabled: true,
+		addr:    4,
+		height:  voteHeight,
+		want:    10e8,
+	}, {
+		name:   "owner after ticket without sub-account",
+		addr:   2,
+		height: ticketHeight,
+		want:   9e8,
+	}, {
+		name:   "owner after vote without sub-account",
+		addr:   2,
+		height: voteHeight,
+	}, {
+		name:       "staked without sub-account",
+		addr:       2,
+		subAccount: staked,
+		height:     ticketHeight,
+		wantErr:    true,
+	}, {
+		name:       "unknown sub-account",
+		enabled:    true,
+		addr:       2,
+		subAccount: &rtypes.SubAccountIdentifier{Address: "locked"},
+		height:     ticketHeight,
+		wantErr:    true,
+	}}
+
+	servers := make(map[bool]*Server)
+	for _, enabled := range []bool{false, true} {
+		s := newTestServer(t, &ServerConfig{StakedSubAccount: enabled})
+		processTestBlocks(t, s, nil, c.blocks...)
+		newFakeDcrd(t, s, c.blocks)
+		servers[enabled] = s
+	}
+
+	for _, tc := range tests {
+		s := servers[tc.enabled]
+		height := tc.height
+		res, rerr := s.AccountBalance(s.ctx, &rtypes.AccountBalanceRequest{
+			AccountIdentifier: &rtypes.AccountIdentifier{
+				Address:    testAddr(t, tc.addr, params).Address(),
+				SubAccount: tc.subAccount,
+			},
+			BlockIdentifier: &rtypes.PartialBlockIdentifier{
+				Index: &height,
+			},
+		})
+		if tc.wantErr {
+			if rerr == nil || rerr.Code != int32(types.ErrInvalidArgument) {
+				t.Fatalf("%s: unexpected error: got %v, want %v",
+					tc.name, rerr, types.ErrInvalidArgument)
+			}
+			continue
+		}
+		if rerr != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, rerr.Message)
+		}
+		want := types.DcrAmountToRosetta(tc.want)
+		if !reflect.DeepEqual(res.Balances[0], want) {
+			t.Fatalf("%s: unexpected balance: got %v, want %v",
+				tc.name, res.Balances[0].Value, want.Value)
+		}
+	}
+}
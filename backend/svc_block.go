@@ -30,6 +30,10 @@ func (s *Server) inputsFetcher(ctx context.Context, utxoSet map[wire.OutPoint]*t
 			res[*in] = prev
 			continue
 		}
+		if prev, ok := s.cachePrevInputs.Lookup(*in); ok {
+			res[*in] = prev.(*types.PrevInput)
+			continue
+		}
 		txs[in.Hash] = nil
 	}
 	txhs := make([]chainhash.Hash, 0, len(txs))
@@ -44,9 +48,16 @@ func (s *Server) inputsFetcher(ctx context.Context, utxoSet map[wire.OutPoint]*t
 	// Now, request the txs concurrently from dcrd (assumes txindex is on).
 	g, gctx := errgroup.WithContext(ctx)
 	var mu sync.Mutex
+	concurrency := s.concurrency()
+	if s.fetchConcurrency > 0 && s.fetchConcurrency < concurrency {
+		concurrency = s.fetchConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
 	for _, txh := range txhs {
 		txh := txh
+		sem <- struct{}{}
 		g.Go(func() error {
+			defer func() { <-sem }()
 			tx, err := s.getRawTx(gctx, &txh)
 			if err != nil {
 				return err
@@ -79,6 +90,7 @@ func (s *Server) inputsFetcher(ctx context.Context, utxoSet map[wire.OutPoint]*t
 			Version:  out.Version,
 			Amount:   dcrutil.Amount(out.Value),
 		}
+		s.cachePrevInputs.Add(*in, res[*in])
 	}
 
 	return res, nil
@@ -114,7 +126,7 @@ func (s *Server) Block(ctx context.Context, req *rtypes.BlockRequest) (*rtypes.B
 	}
 
 	fetchInputs := s.makeInputsFetcher(ctx, nil)
-	rblock, err := types.WireBlockToRosetta(b, prev, fetchInputs, s.chainParams)
+	rblock, err := types.WireBlockToRosetta(b, prev, fetchInputs, s.chainParams, &s.convertOpts)
 	if err != nil {
 		return nil, types.RError(err)
 	}
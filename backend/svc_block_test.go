@@ -0,0 +1,99 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/lru"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestInputsFetcherCachedOutputs ensures spending outputs created by processed
+// blocks does not require fetching their txs from dcrd.
+func TestInputsFetcherCachedOutputs(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	c.addBlock(true, 2, c.spendTx(b1.Transactions[0], 0, 3, 6e8))
+
+	tests := []struct {
+		name      string
+		dropCache bool
+		wantCalls int
+	}{{
+		name:      "cached output",
+		wantCalls: 0,
+	}, {
+		name:      "uncached output",
+		dropCache: true,
+		wantCalls: 1,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			d := newFakeDcrd(t, s, c.blocks)
+			processTestBlocks(t, s, nil, c.blocks[:2]...)
+			if tc.dropCache {
+				cachePrevInputs := lru.NewKVCache(1000)
+				s.cachePrevInputs = &cachePrevInputs
+			}
+
+			processTestBlocks(t, s, c.blocks[1], c.blocks[2])
+			gotCalls := d.callCount("getrawtransaction")
+			if gotCalls != tc.wantCalls {
+				t.Fatalf("unexpected number of tx fetches: got %d, "+
+					"want %d", gotCalls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+// BenchmarkInputsFetcherConcurrency benchmarks fetching the previous outputs
+// of inputs that spend distinct txs from a dcrd instance with a fixed latency
+// per call, using different limits of concurrent fetches. The fake dcrd is
+// reached through a websocket, since http POST requests are serialized by the
+// rpc client.
+func BenchmarkInputsFetcherConcurrency(b *testing.B) {
+	const nbTxs = 64
+	params := chaincfg.RegNetParams()
+	c := newTestChain(b, params)
+	inputs := make([]*wire.OutPoint, 0, nbTxs)
+	for i := 0; i < nbTxs; i++ {
+		blk := c.addBlock(true, 1)
+		txh := blk.Transactions[0].TxHash()
+		inputs = append(inputs, wire.NewOutPoint(&txh, 0, wire.TxTreeRegular))
+	}
+
+	for _, concurrency := range []uint{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			s := newTestServer(b, &ServerConfig{
+				SyncConcurrency:  nbTxs,
+				FetchConcurrency: concurrency,
+			})
+			d := startFakeDcrd(b, s, c.blocks, true)
+			d.setDelay(time.Millisecond)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Drop the caches so every tx is fetched.
+				b.StopTimer()
+				cachePrevInputs := lru.NewKVCache(1000)
+				s.cachePrevInputs = &cachePrevInputs
+				s.cacheRawTxs = newTTLCache(1000, 0)
+				b.StartTimer()
+
+				_, err := s.inputsFetcher(s.ctx, nil, inputs...)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -7,11 +7,14 @@ package backend
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"strings"
 
 	"decred.org/dcrros/types"
 	rserver "github.com/coinbase/rosetta-sdk-go/server"
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/blockchain/stake/v3"
+	"github.com/decred/dcrd/chaincfg/chainhash"
 	"github.com/decred/dcrd/dcrjson/v3"
 	"github.com/decred/dcrd/wire"
 )
@@ -30,6 +33,35 @@ func (s *Server) ConstructionMetadata(context.Context, *rtypes.ConstructionMetad
 	}, nil
 }
 
+// checkImmatureSpends returns ErrSpendsImmatureOutput if the given tx spends
+// outputs subject to the coinbase maturity rules (of coinbases, votes,
+// revocations or ticket change, either mined or in the mempool) which would
+// still be immature in the next block.
+func (s *Server) checkImmatureSpends(ctx context.Context, tx *wire.MsgTx) error {
+	prevOutpoints := make([]*wire.OutPoint, 0, len(tx.TxIn))
+	isVote := stake.IsSSGen(tx)
+	for i, in := range tx.TxIn {
+		// The stakebase input of votes does not spend any output.
+		if i == 0 && isVote {
+			continue
+		}
+		prevOutpoints = append(prevOutpoints, &in.PreviousOutPoint)
+	}
+
+	fetchInputs := s.makeMempoolInputsFetcher(ctx)
+	prevInputs, err := fetchInputs(prevOutpoints...)
+	if err != nil {
+		return err
+	}
+	for outp, prevInput := range prevInputs {
+		if prevInput.Immature {
+			return types.ErrSpendsImmatureOutput.Msg(fmt.Sprintf(
+				"tx spends immature output %s", outp))
+		}
+	}
+	return nil
+}
+
 // ConstructionSubmit submits the provided transaction to the Decred network.
 //
 // NOTE: This is part of the ConstructionAPIServicer interface.
@@ -45,7 +77,18 @@ func (s *Server) ConstructionSubmit(ctx context.Context, req *rtypes.Constructio
 		return nil, types.ErrInvalidTransaction.RError()
 	}
 
-	txh, err := s.c.SendRawTransaction(ctx, tx, false)
+	if s.checkImmature {
+		if err := s.checkImmatureSpends(ctx, tx); err != nil {
+			return nil, types.RError(err)
+		}
+	}
+
+	var txh *chainhash.Hash
+	err = s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		txh, err = s.c.SendRawTransaction(ctx, tx, false)
+		return err
+	})
 	if err != nil {
 		// Handle some special cases from dcrd into different error
 		// codes.
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestCheckImmatureSpends ensures txs spending outputs of mined or unconfirmed
+// coinbases and stake txs that would still be immature in the next block are
+// rejected, while mature and regular outputs are accepted.
+func TestCheckImmatureSpends(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	maturity := int(params.CoinbaseMaturity)
+	c := newTestChain(t, params)
+
+	// Mine an old ticket that is mature by the tip and a recent one that
+	// isn't.
+	oldTicket := testTicket(wire.NewOutPoint(&chainhash.Hash{0x01}, 0,
+		wire.TxTreeRegular))
+	newTicket := testTicket(wire.NewOutPoint(&chainhash.Hash{0x02}, 0,
+		wire.TxTreeRegular))
+	for i := 1; i <= maturity+4; i++ {
+		switch i {
+		case 2:
+			c.addBlock(true, byte(i), oldTicket)
+		case maturity:
+			c.addBlock(true, byte(i), newTicket)
+		default:
+			c.addBlock(true, byte(i))
+		}
+	}
+	oldCoinbase := c.blocks[1].Transactions[0]
+	newCoinbase := c.blocks[maturity].Transactions[0]
+
+	// Unconfirmed txs.
+	oldTicketHash, newTicketHash := oldTicket.TxHash(), newTicket.TxHash()
+	vote := testVote(&oldTicketHash)
+	revocation := testRevocation(&newTicketHash)
+	regular := c.spendTx(oldCoinbase, 0, 50, 9e8)
+
+	s := newTestServer(t, &ServerConfig{CheckImmatureSpends: true})
+	d := newFakeDcrd(t, s, c.blocks)
+	d.setMempool(vote, revocation, regular)
+
+	const regularTree, stakeTree = wire.TxTreeRegular, wire.TxTreeStake
+	tests := []struct {
+		name    string
+		prev    *wire.MsgTx
+		index   uint32
+		tree    int8
+		wantErr error
+	}{
+		{"mature coinbase", oldCoinbase, 0, regularTree, nil},
+		{"immature coinbase", newCoinbase, 0, regularTree, types.ErrSpendsImmatureOutput},
+		{"mature ticket change", oldTicket, 2, stakeTree, nil},
+		{"immature ticket change", newTicket, 2, stakeTree, types.ErrSpendsImmatureOutput},
+		{"ticket submission", newTicket, 0, stakeTree, nil},
+		{"mempool vote", vote, 2, stakeTree, types.ErrSpendsImmatureOutput},
+		{"mempool revocation", revocation, 0, stakeTree, types.ErrSpendsImmatureOutput},
+		{"mempool regular", regular, 0, regularTree, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := c.spendTx(tc.prev, tc.index, 51, 1e8)
+			tx.TxIn[0].PreviousOutPoint.Tree = tc.tree
+			err := s.checkImmatureSpends(s.ctx, tx)
+			if !errors.Is(err, tc.wantErr) || (err == nil) != (tc.wantErr == nil) {
+				t.Fatalf("unexpected error: got %v, want %v", err,
+					tc.wantErr)
+			}
+		})
+	}
+}
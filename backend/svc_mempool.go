@@ -6,18 +6,29 @@ package backend
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 
 	"decred.org/dcrros/types"
 	rserver "github.com/coinbase/rosetta-sdk-go/server"
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/blockchain/stake/v3"
 	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
 	chainjson "github.com/decred/dcrd/rpc/jsonrpc/types/v2"
+	"github.com/decred/dcrd/wire"
 )
 
 var _ rserver.MempoolAPIServicer = (*Server)(nil)
 
 func (s *Server) Mempool(ctx context.Context, req *rtypes.MempoolRequest) (*rtypes.MempoolResponse, *rtypes.Error) {
-	mempool, err := s.c.GetRawMempool(ctx, chainjson.GRMAll)
+	var mempool []*chainhash.Hash
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		mempool, err = s.c.GetRawMempool(ctx, chainjson.GRMAll)
+		return err
+	})
 	if err != nil {
 		return nil, types.DcrdError(err)
 	}
@@ -40,14 +51,19 @@ func (s *Server) MempoolTransaction(ctx context.Context, req *rtypes.MempoolTran
 		return nil, types.ErrInvalidChainHash.RError()
 	}
 
-	tx, err := s.c.GetRawTransaction(ctx, &txh)
+	var tx *dcrutil.Tx
+	err = s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		tx, err = s.c.GetRawTransaction(ctx, &txh)
+		return err
+	})
 	if err != nil {
 		return nil, types.DcrdError(err)
 	}
 
 	// TODO: What if the returned tx has already been mined?
-	fetchInputs := s.makeInputsFetcher(ctx, nil)
-	rtx, err := types.MempoolTxToRosetta(tx.MsgTx(), fetchInputs, s.chainParams)
+	fetchInputs := s.makeMempoolInputsFetcher(ctx)
+	rtx, err := types.MempoolTxToRosetta(tx.MsgTx(), fetchInputs, s.chainParams, &s.convertOpts)
 	if err != nil {
 		return nil, types.RError(err)
 	}
@@ -55,3 +71,185 @@ func (s *Server) MempoolTransaction(ctx context.Context, req *rtypes.MempoolTran
 		Transaction: rtx,
 	}, nil
 }
+
+// isCoinbaseTx returns true if the given tx is a coinbase.
+func isCoinbaseTx(tx *wire.MsgTx) bool {
+	if len(tx.TxIn) != 1 {
+		return false
+	}
+	prevOut := tx.TxIn[0].PreviousOutPoint
+	return prevOut.Index == wire.MaxPrevOutIndex && prevOut.Hash == chainhash.Hash{}
+}
+
+// hasMaturingOutputs returns true if outputs of the given tx are subject to
+// the coinbase maturity rules, which apply to coinbases, votes, revocations
+// and the change outputs of tickets.
+func hasMaturingOutputs(tx *wire.MsgTx) bool {
+	return isCoinbaseTx(tx) || stake.IsSSGen(tx) || stake.IsSSRtx(tx) ||
+		stake.IsSStx(tx)
+}
+
+// isMaturingOutput returns true if the given output of the given tx is subject
+// to the coinbase maturity rules.
+//
+// The first output of tickets is only spent by votes and revocations, which
+// are subject to the ticket maturity and expiry rules enforced by dcrd
+// instead, and ticket commitments are unspendable, so only ticket change
+// outputs are subject to the coinbase maturity.
+func isMaturingOutput(tx *wire.MsgTx, index uint32) bool {
+	switch {
+	case isCoinbaseTx(tx), stake.IsSSGen(tx), stake.IsSSRtx(tx):
+		return true
+	case stake.IsSStx(tx):
+		return index > 0 && index%2 == 0
+	default:
+		return false
+	}
+}
+
+// isImmatureInNextBlock returns true if the given output of the given tx,
+// which has the given number of confirmations, would still be immature if
+// spent by a tx mined in the next block.
+//
+// The next block is at a depth equal to the current number of confirmations
+// of the tx, which is zero for txs in the mempool.
+func isImmatureInNextBlock(tx *wire.MsgTx, index uint32, confirmations int64, chainParams *chaincfg.Params) bool {
+	return isMaturingOutput(tx, index) &&
+		confirmations < int64(chainParams.CoinbaseMaturity)
+}
+
+// maturingParent returns the given mined tx and its number of confirmations
+// if any of its outputs are subject to the coinbase maturity rules. It returns
+// a nil tx otherwise.
+func (s *Server) maturingParent(ctx context.Context, txh *chainhash.Hash) (*wire.MsgTx, int64, error) {
+	// The tx is usually cached after fetching the inputs, in which case
+	// the number of confirmations is only requested from dcrd when
+	// maturity rules apply to the tx.
+	if tx, ok := s.cacheRawTxs.Lookup(*txh); ok && !hasMaturingOutputs(tx.(*wire.MsgTx)) {
+		return nil, 0, nil
+	}
+
+	var vtx *chainjson.TxRawResult
+	err := s.dcrdCall(ctx, func(ctx context.Context) error {
+		var err error
+		vtx, err = s.c.GetRawTransactionVerbose(ctx, txh)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	rawTx, err := hex.DecodeString(vtx.Hex)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx := new(wire.MsgTx)
+	if err := tx.FromBytes(rawTx); err != nil {
+		return nil, 0, err
+	}
+	if !hasMaturingOutputs(tx) {
+		return nil, 0, nil
+	}
+	return tx, vtx.Confirmations, nil
+}
+
+// makeMempoolInputsFetcher returns an inputs fetcher for transactions in the
+// mempool. Inputs are first looked up in the transactions currently in the
+// mempool, such that chains of unconfirmed transactions are resolved, and
+// then in the mainchain. Besides fetching the inputs, it flags the ones that
+// spend coinbase, vote, revocation or ticket change outputs (mined or still
+// in the mempool) which wouldn't be mature in the next block.
+//
+// The returned fetcher is meant to be used for a single request: the list of
+// mempool transactions is only fetched from dcrd on the first call and reused
+// by later ones.
+func (s *Server) makeMempoolInputsFetcher(ctx context.Context) types.PrevInputsFetcher {
+	var inMempool map[chainhash.Hash]struct{}
+	return func(inputList ...*wire.OutPoint) (map[wire.OutPoint]*types.PrevInput, error) {
+		if inMempool == nil {
+			var mempool []*chainhash.Hash
+			err := s.dcrdCall(ctx, func(ctx context.Context) error {
+				var err error
+				mempool, err = s.c.GetRawMempool(ctx, chainjson.GRMAll)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			inMempool = make(map[chainhash.Hash]struct{}, len(mempool))
+			for _, txh := range mempool {
+				inMempool[*txh] = struct{}{}
+			}
+		}
+
+		// Resolve the inputs that spend outputs of unconfirmed txs.
+		res := make(map[wire.OutPoint]*types.PrevInput, len(inputList))
+		confirmed := make([]*wire.OutPoint, 0, len(inputList))
+		for _, in := range inputList {
+			if _, ok := inMempool[in.Hash]; !ok {
+				confirmed = append(confirmed, in)
+				continue
+			}
+			tx, err := s.getRawTx(ctx, &in.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if len(tx.TxOut) <= int(in.Index) {
+				return nil, fmt.Errorf("non-existant output index %s", in.String())
+			}
+			out := tx.TxOut[in.Index]
+			res[*in] = &types.PrevInput{
+				PkScript: out.PkScript,
+				Version:  out.Version,
+				Amount:   dcrutil.Amount(out.Value),
+				Immature: isImmatureInNextBlock(tx, in.Index, 0,
+					s.chainParams),
+			}
+		}
+		if len(confirmed) == 0 {
+			return res, nil
+		}
+
+		// Resolve the remaining ones from the mainchain.
+		chainRes, err := s.inputsFetcher(ctx, nil, confirmed...)
+		if isErrRPCNoTxInfo(err) {
+			return nil, types.ErrTxNotFound.Msg("prev outpoint not " +
+				"found in the mempool or mainchain")
+		}
+		if err != nil {
+			return nil, err
+		}
+		for outp, prev := range chainRes {
+			res[outp] = prev
+		}
+
+		// Flag the inputs that would be immature. Each parent tx is
+		// only fetched once, even if multiple of its outputs are
+		// spent.
+		type parent struct {
+			tx            *wire.MsgTx
+			confirmations int64
+		}
+		parents := make(map[chainhash.Hash]parent, len(confirmed))
+		for _, in := range confirmed {
+			p, ok := parents[in.Hash]
+			if !ok {
+				p.tx, p.confirmations, err = s.maturingParent(ctx, &in.Hash)
+				if err != nil {
+					return nil, err
+				}
+				parents[in.Hash] = p
+			}
+			if p.tx == nil || !isImmatureInNextBlock(p.tx, in.Index,
+				p.confirmations, s.chainParams) {
+				continue
+			}
+
+			// Flag a copy of the input, since the fetched one may
+			// be shared with the prev inputs cache.
+			prev := *res[*in]
+			prev.Immature = true
+			res[*in] = &prev
+		}
+		return res, nil
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"decred.org/dcrros/types"
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/blockchain/stake/v3"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/txscript/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// testP2PKH is a pay-to-pubkey-hash script, tagged by the stake outputs of
+// the test stake txs.
+var testP2PKH = append(append([]byte{txscript.OP_DUP, txscript.OP_HASH160,
+	txscript.OP_DATA_20}, make([]byte, 20)...), txscript.OP_EQUALVERIFY,
+	txscript.OP_CHECKSIG)
+
+// testTicket returns a minimal ticket spending the given output: a stake
+// submission output, a commitment and a change output.
+func testTicket(prevOut *wire.OutPoint) *wire.MsgTx {
+	commitment := append([]byte{txscript.OP_RETURN, txscript.OP_DATA_30},
+		make([]byte, 30)...)
+	ticket := wire.NewMsgTx()
+	ticket.AddTxIn(wire.NewTxIn(prevOut, 0, nil))
+	ticket.AddTxOut(wire.NewTxOut(1e8, append([]byte{txscript.OP_SSTX},
+		testP2PKH...)))
+	ticket.AddTxOut(wire.NewTxOut(0, commitment))
+	ticket.AddTxOut(wire.NewTxOut(1e8, append([]byte{txscript.OP_SSTXCHANGE},
+		testP2PKH...)))
+	return ticket
+}
+
+// testVote returns a minimal vote of the given ticket: stakebase, ticket
+// input, block reference, vote bits and a single stake generation output.
+func testVote(ticketHash *chainhash.Hash) *wire.MsgTx {
+	blockRef := append([]byte{txscript.OP_RETURN, txscript.OP_DATA_36},
+		make([]byte, 36)...)
+	voteBits := []byte{txscript.OP_RETURN, txscript.OP_DATA_6, 0x01, 0x00,
+		0x00, 0x00, 0x00, 0x00}
+	vote := wire.NewMsgTx()
+	vote.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex, wire.TxTreeRegular), 0, nil))
+	vote.AddTxIn(wire.NewTxIn(wire.NewOutPoint(ticketHash, 0,
+		wire.TxTreeStake), 0, nil))
+	vote.AddTxOut(wire.NewTxOut(0, blockRef))
+	vote.AddTxOut(wire.NewTxOut(0, voteBits))
+	vote.AddTxOut(wire.NewTxOut(1e8, append([]byte{txscript.OP_SSGEN},
+		testP2PKH...)))
+	return vote
+}
+
+// testRevocation returns a minimal revocation of the given ticket: ticket
+// input and a single stake revocation output.
+func testRevocation(ticketHash *chainhash.Hash) *wire.MsgTx {
+	revocation := wire.NewMsgTx()
+	revocation.AddTxIn(wire.NewTxIn(wire.NewOutPoint(ticketHash, 0,
+		wire.TxTreeStake), 0, nil))
+	revocation.AddTxOut(wire.NewTxOut(1e8, append([]byte{txscript.OP_SSRTX},
+		testP2PKH...)))
+	return revocation
+}
+
+// TestImmatureInNextBlock ensures outputs of coinbases, votes, revocations
+// and ticket change are only considered mature once they reach the coinbase
+// maturity of each network.
+func TestImmatureInNextBlock(t *testing.T) {
+	coinbase := wire.NewMsgTx()
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex, wire.TxTreeRegular), 0, nil))
+	coinbase.AddTxOut(wire.NewTxOut(1e8, []byte{txscript.OP_TRUE}))
+
+	ticket := testTicket(wire.NewOutPoint(&chainhash.Hash{0x02}, 0,
+		wire.TxTreeRegular))
+	if !stake.IsSStx(ticket) {
+		t.Fatal("test ticket is not a ticket")
+	}
+	vote := testVote(&chainhash.Hash{0x01})
+	revocation := testRevocation(&chainhash.Hash{0x01})
+
+	regular := wire.NewMsgTx()
+	regular.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{0x01}, 0,
+		wire.TxTreeRegular), 0, nil))
+	regular.AddTxOut(wire.NewTxOut(1e8, []byte{txscript.OP_TRUE}))
+
+	txs := []struct {
+		name     string
+		tx       *wire.MsgTx
+		index    uint32
+		maturing bool
+	}{
+		{"coinbase", coinbase, 0, true},
+		{"vote", vote, 2, true},
+		{"revocation", revocation, 0, true},
+		{"ticket submission", ticket, 0, false},
+		{"ticket change", ticket, 2, true},
+		{"regular", regular, 0, false},
+	}
+
+	nets := []*chaincfg.Params{
+		chaincfg.MainNetParams(),
+		chaincfg.TestNet3Params(),
+		chaincfg.SimNetParams(),
+		chaincfg.RegNetParams(),
+	}
+
+	for _, params := range nets {
+		maturity := int64(params.CoinbaseMaturity)
+		for _, tc := range txs {
+			if got := isMaturingOutput(tc.tx, tc.index); got != tc.maturing {
+				t.Fatalf("%s: unexpected maturing output: got %v, "+
+					"want %v", tc.name, got, tc.maturing)
+			}
+			if tc.maturing && !hasMaturingOutputs(tc.tx) {
+				t.Fatalf("%s: tx not flagged as having maturing "+
+					"outputs", tc.name)
+			}
+
+			confs := []int64{0, 1, maturity - 1, maturity, maturity + 1}
+			for _, conf := range confs {
+				want := tc.maturing && conf < maturity
+				got := isImmatureInNextBlock(tc.tx, tc.index, conf, params)
+				if got != want {
+					t.Errorf("%s: %s with %d confirmations: got "+
+						"immature %v, want %v", params.Name,
+						tc.name, conf, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestMempoolInputsFetcher ensures inputs spending outputs of unconfirmed txs
+// are resolved from the mempool, that the rest are resolved from the
+// mainchain and that the mempool is only fetched once per fetcher.
+func TestMempoolInputsFetcher(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	b1 := c.addBlock(true, 1)
+	confirmed := c.spendTx(b1.Transactions[0], 0, 2, 6e8)
+	c.addBlock(true, 3, confirmed)
+
+	// Chain of unconfirmed txs spending the confirmed one.
+	parent := c.spendTx(confirmed, 0, 4, 5e8)
+	child := c.spendTx(parent, 0, 5, 4e8)
+
+	s := newTestServer(t, nil)
+	d := newFakeDcrd(t, s, c.blocks)
+	d.setMempool(parent, child)
+
+	parentHash, confirmedHash := parent.TxHash(), confirmed.TxHash()
+	tests := []struct {
+		name       string
+		outp       wire.OutPoint
+		wantErr    bool
+		wantErrIs  error
+		wantAmount dcrutil.Amount
+		wantScript []byte
+	}{{
+		name:       "unconfirmed parent",
+		outp:       *wire.NewOutPoint(&parentHash, 0, wire.TxTreeRegular),
+		wantAmount: 5e8,
+		wantScript: testPkScript(t, 4, params),
+	}, {
+		name:       "confirmed parent",
+		outp:       *wire.NewOutPoint(&confirmedHash, 0, wire.TxTreeRegular),
+		wantAmount: 6e8,
+		wantScript: testPkScript(t, 2, params),
+	}, {
+		name:      "unknown parent",
+		outp:      *wire.NewOutPoint(&chainhash.Hash{0x01}, 0, wire.TxTreeRegular),
+		wantErr:   true,
+		wantErrIs: types.ErrTxNotFound,
+	}, {
+		name:    "unconfirmed parent output out of range",
+		outp:    *wire.NewOutPoint(&parentHash, 1, wire.TxTreeRegular),
+		wantErr: true,
+	}}
+
+	fetchInputs := s.makeMempoolInputsFetcher(s.ctx)
+	for _, tc := range tests {
+		outp := tc.outp
+		res, err := fetchInputs(&outp)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Fatalf("%s: unexpected error: got %v, want error %v",
+				tc.name, err, tc.wantErr)
+		}
+		if tc.wantErrIs != nil && !errors.Is(err, tc.wantErrIs) {
+			t.Fatalf("%s: unexpected error: got %v, want %v",
+				tc.name, err, tc.wantErrIs)
+		}
+		if tc.wantErr {
+			continue
+		}
+		prev, ok := res[outp]
+		if !ok {
+			t.Fatalf("%s: input not fetched", tc.name)
+		}
+		if prev.Amount != tc.wantAmount {
+			t.Fatalf("%s: unexpected amount: got %v, want %v",
+				tc.name, prev.Amount, tc.wantAmount)
+		}
+		if !bytes.Equal(prev.PkScript, tc.wantScript) {
+			t.Fatalf("%s: unexpected pkscript: got %x, want %x",
+				tc.name, prev.PkScript, tc.wantScript)
+		}
+	}
+
+	// The mempool was only fetched once for all calls.
+	if got := d.callCount("getrawmempool"); got != 1 {
+		t.Fatalf("unexpected number of mempool fetches: got %d, want 1",
+			got)
+	}
+
+	// The child of the unconfirmed parent is converted with the input it
+	// spends.
+	childHash := child.TxHash()
+	resp, rerr := s.MempoolTransaction(s.ctx, &rtypes.MempoolTransactionRequest{
+		TransactionIdentifier: &rtypes.TransactionIdentifier{
+			Hash: childHash.String(),
+		},
+	})
+	if rerr != nil {
+		t.Fatalf("unable to convert child tx: %v", rerr.Message)
+	}
+	wantDebit := testAddr(t, 4, params).Address()
+	var debited bool
+	for _, op := range resp.Transaction.Operations {
+		if op.Account.Address == wantDebit && op.Amount.Value == "-500000000" {
+			debited = true
+		}
+	}
+	if !debited {
+		t.Fatalf("child tx does not debit the unconfirmed parent output")
+	}
+}
@@ -6,7 +6,9 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"runtime"
+	"time"
 
 	"decred.org/dcrros/internal/version"
 	"decred.org/dcrros/types"
@@ -62,6 +64,45 @@ func (s *Server) NetworkOptions(context.Context, *rtypes.NetworkRequest) (
 	}, nil
 }
 
+// dcrdPeer returns the underlying dcrd instance as a peer, with its current
+// connection state in the metadata so that clients can detect when the server
+// is degraded.
+//
+// The state is one of "active", "connecting" (dcrd reconnected and is being
+// checked), "unsuitable" (dcrd failed the checks) or "unresponsive" (requests
+// to dcrd are timing out).
+func (s *Server) dcrdPeer() *rtypes.Peer {
+	s.mtx.Lock()
+	active, version, dcrdErr := s.active, s.dcrdVersion, s.dcrdErr
+	s.mtx.Unlock()
+
+	var state string
+	switch {
+	case active:
+		state = "active"
+	case dcrdErr == nil:
+		state = "connecting"
+	case errors.Is(dcrdErr, types.ErrDcrdTimeout):
+		state = "unresponsive"
+	default:
+		state = "unsuitable"
+	}
+
+	meta := map[string]interface{}{
+		"state": state,
+	}
+	if version != "" {
+		meta["version"] = version
+	}
+	if !active && dcrdErr != nil {
+		meta["error"] = dcrdErr.Error()
+	}
+	return &rtypes.Peer{
+		PeerID:   "dcrd",
+		Metadata: meta,
+	}
+}
+
 // NetworkStatus returns the current status of the chain as seen by dcrros and
 // the underlying dcrd.
 //
@@ -69,6 +110,17 @@ func (s *Server) NetworkOptions(context.Context, *rtypes.NetworkRequest) (
 func (s *Server) NetworkStatus(ctx context.Context, req *rtypes.NetworkRequest) (
 	*rtypes.NetworkStatusResponse, *rtypes.Error) {
 
+	// Return the cached status if it's still fresh. The cache is
+	// invalidated whenever blocks are connected or disconnected.
+	if s.networkStatusCacheTTL > 0 {
+		s.mtx.Lock()
+		status, cachedAt := s.cachedStatus, s.cachedStatusTime
+		s.mtx.Unlock()
+		if status != nil && time.Since(cachedAt) < s.networkStatusCacheTTL {
+			return status, nil
+		}
+	}
+
 	// We need the timestamp of the block, so request the best block hash
 	// then the block.
 	hash, height, block, err := s.bestBlock(ctx)
@@ -78,7 +130,7 @@ func (s *Server) NetworkStatus(ctx context.Context, req *rtypes.NetworkRequest)
 
 	// Rosetta timestamp is in milliseconds.
 	timestamp := block.Header.Timestamp.Unix() * 1000
-	return &rtypes.NetworkStatusResponse{
+	status := &rtypes.NetworkStatusResponse{
 		CurrentBlockIdentifier: &rtypes.BlockIdentifier{
 			Hash:  hash.String(),
 			Index: height,
@@ -88,7 +140,15 @@ func (s *Server) NetworkStatus(ctx context.Context, req *rtypes.NetworkRequest)
 			Hash: s.chainParams.GenesisHash.String(),
 		},
 
-		// TODO: syncing peers?
-		Peers: nil,
-	}, nil
+		Peers: []*rtypes.Peer{s.dcrdPeer()},
+	}
+
+	if s.networkStatusCacheTTL > 0 {
+		s.mtx.Lock()
+		s.cachedStatus = status
+		s.cachedStatusTime = time.Now()
+		s.mtx.Unlock()
+	}
+
+	return status, nil
 }
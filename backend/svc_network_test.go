@@ -0,0 +1,189 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"decred.org/dcrros/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestNetworkStatusDcrdPeer ensures the network status reports the connection
+// state of the underlying dcrd instance.
+func TestNetworkStatusDcrdPeer(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+
+	tests := []struct {
+		name        string
+		setup       func(s *Server, d *fakeDcrd)
+		wantState   string
+		wantVersion string
+		wantErr     bool
+	}{{
+		name: "active",
+		setup: func(s *Server, d *fakeDcrd) {
+			s.onDcrdConnected()
+		},
+		wantState:   "active",
+		wantVersion: "1.6.0",
+	}, {
+		name: "unsuitable",
+		setup: func(s *Server, d *fakeDcrd) {
+			d.setUnsuitable(1)
+			s.onDcrdConnected()
+		},
+		wantState: "unsuitable",
+		wantErr:   true,
+	}, {
+		name: "connecting",
+		setup: func(s *Server, d *fakeDcrd) {
+			s.mtx.Lock()
+			s.active = false
+			s.dcrdErr = nil
+			s.mtx.Unlock()
+		},
+		wantState: "connecting",
+	}, {
+		name: "unresponsive",
+		setup: func(s *Server, d *fakeDcrd) {
+			s.onDcrdConnected()
+			s.mtx.Lock()
+			s.active = false
+			s.dcrdErr = types.ErrDcrdTimeout
+			s.mtx.Unlock()
+		},
+		wantState:   "unresponsive",
+		wantVersion: "1.6.0",
+		wantErr:     true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			d := newFakeDcrd(t, s, c.blocks)
+			tc.setup(s, d)
+
+			status, rerr := s.NetworkStatus(s.ctx, nil)
+			if rerr != nil {
+				t.Fatalf("unexpected error: %v", rerr.Message)
+			}
+			if len(status.Peers) != 1 {
+				t.Fatalf("unexpected number of peers: got %d, want 1",
+					len(status.Peers))
+			}
+			meta := status.Peers[0].Metadata
+			if got := meta["state"]; got != tc.wantState {
+				t.Fatalf("unexpected state: got %v, want %v", got,
+					tc.wantState)
+			}
+			if got, _ := meta["version"].(string); got != tc.wantVersion {
+				t.Fatalf("unexpected version: got %q, want %q", got,
+					tc.wantVersion)
+			}
+			if _, gotErr := meta["error"]; gotErr != tc.wantErr {
+				t.Fatalf("unexpected error in metadata: got %v, "+
+					"want %v", meta["error"], tc.wantErr)
+			}
+
+			// The current block is served along with the dcrd
+			// state.
+			wantHash := c.tip().BlockHash().String()
+			if got := status.CurrentBlockIdentifier.Hash; got != wantHash {
+				t.Fatalf("unexpected current block: got %s, want %s",
+					got, wantHash)
+			}
+		})
+	}
+}
+
+// TestNetworkStatusCache ensures repeated status requests are served from the
+// cache while it's fresh and that connected blocks invalidate it.
+func TestNetworkStatusCache(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	c := newTestChain(t, params)
+	c.addBlock(true, 1)
+	c.addBlock(true, 2)
+	oldTip, newTip := c.blocks[1], c.blocks[2]
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+
+		// wait is how long to wait before repeating the request.
+		wait time.Duration
+
+		wantCached bool
+	}{{
+		name: "no cache",
+	}, {
+		name:       "fresh cache",
+		ttl:        time.Minute,
+		wantCached: true,
+	}, {
+		name: "expired cache",
+		ttl:  20 * time.Millisecond,
+		wait: 50 * time.Millisecond,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, &ServerConfig{
+				NetworkStatusCacheTTL: tc.ttl,
+			})
+			d := newFakeDcrd(t, s, c.blocks[:2])
+
+			// Helper to request the status and verify the tip.
+			status := func(want *wire.MsgBlock) {
+				t.Helper()
+				status, rerr := s.NetworkStatus(s.ctx, nil)
+				if rerr != nil {
+					t.Fatalf("unexpected error: %v", rerr.Message)
+				}
+				wantHash := want.BlockHash().String()
+				if got := status.CurrentBlockIdentifier.Hash; got != wantHash {
+					t.Fatalf("unexpected current block: got "+
+						"%s, want %s", got, wantHash)
+				}
+			}
+
+			status(oldTip)
+			time.Sleep(tc.wait)
+
+			// A new block that wasn't notified yet is only seen
+			// when the cache is not used.
+			d.setChain(c.blocks)
+			if tc.wantCached {
+				status(oldTip)
+			} else {
+				status(newTip)
+			}
+			wantCalls := 2
+			if tc.wantCached {
+				wantCalls = 1
+			}
+			if got := d.callCount("getbestblockhash"); got != wantCalls {
+				t.Fatalf("unexpected number of dcrd queries: got "+
+					"%d, want %d", got, wantCalls)
+			}
+
+			// Notifying the block invalidates the cache.
+			header, err := newTip.Header.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.onDcrdBlockConnected(header, nil)
+			status(newTip)
+			if got := d.callCount("getbestblockhash"); got != wantCalls+1 {
+				t.Fatalf("unexpected number of dcrd queries after "+
+					"block: got %d, want %d", got, wantCalls+1)
+			}
+		})
+	}
+}
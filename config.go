@@ -18,6 +18,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"decred.org/dcrros/backend"
 	"decred.org/dcrros/internal/version"
@@ -73,9 +74,11 @@ const (
 	defaultDBType         = backend.DBTypeBadger
 	defaultDataDirname    = "data"
 	defaultLogDirname     = "logs"
+	defaultDBGCInterval   = 10 * time.Minute
 
-	defaultCacheSizeBlocks = 100
-	defaultCacheSizeRawTxs = 250
+	defaultCacheSizeBlocks     = 100
+	defaultCacheSizeRawTxs     = 250
+	defaultCacheSizePrevInputs = 10000
 )
 
 var (
@@ -85,6 +88,8 @@ var (
 	defaultConfigFile   = filepath.Join(defaultConfigDir, defaultConfigFilename)
 	defaultDcrdDir      = dcrutil.AppDataDir("dcrd", false)
 	defaultDcrdCertPath = filepath.Join(defaultDcrdDir, "rpc.cert")
+	defaultTLSCert      = filepath.Join(defaultConfigDir, "rpc.cert")
+	defaultTLSKey       = filepath.Join(defaultConfigDir, "rpc.key")
 
 	errCmdDone = errors.New("cmd is done while parsing config options")
 )
@@ -106,38 +111,132 @@ type config struct {
 
 	// Dcrd Connection Options
 
-	DcrdConnect   string `short:"c" long:"dcrdconnect" description:"Network address of the RPC interface of the dcrd node to connect to (default: localhost port 9109, testnet: 19109, simnet: 19556)"`
-	DcrdCertPath  string `long:"dcrdcertpath" description:"File path location of the dcrd RPC certificate"`
-	DcrdCertBytes string `long:"dcrdcertbytes" description:"The pem-encoded RPC certificate for dcrd"`
-	DcrdUser      string `short:"u" long:"dcrduser" description:"RPC username to authenticate with dcrd"`
-	DcrdPass      string `short:"P" long:"dcrdpass" description:"RPC password to authenticate with dcrd"`
+	DcrdConnect          string        `short:"c" long:"dcrdconnect" description:"Network address of the RPC interface of the dcrd node to connect to (default: localhost port 9109, testnet: 19109, simnet: 19556)"`
+	DcrdCertPath         string        `long:"dcrdcertpath" description:"File path location of the dcrd RPC certificate"`
+	DcrdCertBytes        string        `long:"dcrdcertbytes" description:"The pem-encoded RPC certificate for dcrd"`
+	DcrdUser             string        `short:"u" long:"dcrduser" description:"RPC username to authenticate with dcrd"`
+	DcrdPass             string        `short:"P" long:"dcrdpass" description:"RPC password to authenticate with dcrd"`
+	DcrdTimeout          time.Duration `long:"dcrdtimeout" description:"Maximum amount of time to wait for individual requests to dcrd (0 for no timeout)"`
+	DcrdGracePeriod      time.Duration `long:"dcrdgraceperiod" description:"Amount of time to keep checking a reconnected dcrd instance before disabling the server if it is unsuitable"`
+	DcrdMaxRetryInterval time.Duration `long:"dcrdmaxretryinterval" description:"Maximum interval between checks of a reconnected dcrd instance during the grace period, doubling from 5s after every failed check (0 to keep the interval constant)"`
 
 	// Listeners
 
-	Listeners []string `long:"listen" description:"Add an interface/port to listen for connections (default all interfaces port: 9128, testnet: 19128, simnet: 29128)"`
+	Listeners []string `long:"listen" description:"Add an interface/port to listen for connections (default all interfaces port: 9128, testnet: 19128, simnet: 29128) -- Prefix with unix: to listen on a Unix domain socket"`
 	Profile   string   `long:"profile" description:"Enable HTTP profiling on given [addr:]port -- NOTE port must be between 1024 and 65536"`
 
+	// TLS
+
+	TLS         bool   `long:"tls" description:"Serve the API over HTTPS"`
+	TLSCert     string `long:"tlscert" description:"File containing the TLS certificate (a self-signed one is generated if neither it nor the key exist)"`
+	TLSKey      string `long:"tlskey" description:"File containing the TLS certificate key"`
+	TLSClientCA string `long:"tlsclientca" description:"Require clients to authenticate with a certificate signed by one of the CAs in the given file"`
+
 	// Embedded dcrd
 
 	RunDcrd       string   `long:"rundcrd" description:"Run the given dcrd binary and terminate dcrros if dcrd is killed"`
 	DcrdExtraArgs []string `long:"dcrdextraarg" description:"Extra arguments to provide to dcrd when running it"`
 	// Tuning
 
-	DBType          string `long:"dbtype" description:"Database backend to use for the Block Chain"`
-	CacheSizeBlocks uint   `long:"cachesizeblocks" description:"Number of blocks to hold in the in-memory block cache"`
-	CacheSizeRawTxs uint   `long:"cachesizerawtxs" description:"Number of txs to hold in the in-memory tx cache"`
+	DBType                string        `long:"dbtype" description:"Database backend to use for the Block Chain"`
+	DBGCInterval          time.Duration `long:"dbgcinterval" description:"Interval between garbage collections of the badger db value log to reclaim disk space (0 to disable)"`
+	CacheSizeBlocks       uint          `long:"cachesizeblocks" description:"Number of blocks to hold in the in-memory block cache"`
+	CacheSizeRawTxs       uint          `long:"cachesizerawtxs" description:"Number of txs to hold in the in-memory tx cache"`
+	CacheSizePrevInputs   uint          `long:"cachesizeprevinputs" description:"Number of outputs of processed blocks to hold in the in-memory cache of spent outputs"`
+	CacheRawTxTTL         time.Duration `long:"cacherawtxttl" description:"Maximum age of txs in the in-memory tx cache (0 to only evict when full)"`
+	SyncConcurrency       uint          `long:"syncconcurrency" description:"Maximum number of concurrent requests to dcrd during the initial sync (default: number of CPUs)"`
+	ServeConcurrency      uint          `long:"serveconcurrency" description:"Maximum number of concurrent requests to dcrd per operation after the initial sync (default: number of CPUs)"`
+	FetchConcurrency      uint          `long:"fetchconcurrency" description:"Maximum number of concurrent requests to dcrd when fetching the outputs spent by a block or transaction (default: same as sync/serve concurrency)"`
+	NetworkStatusCacheTTL time.Duration `long:"networkstatuscachettl" description:"Amount of time to reuse /network/status responses for while no new blocks are received (0 to disable)"`
+	GapFillBatchSize      uint          `long:"gapfillbatchsize" description:"Maximum number of missing blocks to process in a row while catching up to a new block before checking for shutdown (default: 100)"`
+	SyncRetries           uint          `long:"syncretries" description:"Number of times to retry a failed initial sync from the last processed block before giving up (0 to halt on the first error)"`
+	BlockNtfnQueueSize    uint          `long:"blockntfnqueuesize" description:"Maximum number of block notifications from dcrd queued for processing. The oldest notification is dropped when full and the missed blocks are processed along with the next one (default: 1000)"`
+	MaxReorgDepth         uint          `long:"maxreorgdepth" description:"Stop instead of rolling back reorgs deeper than this number of blocks (0 for no limit)"`
+	SlowBlockThreshold    time.Duration `long:"slowblockthreshold" description:"Log a warning with a timing breakdown when processing a connected block takes longer than this (0 to disable)"`
+	ReadyAfterBlock       bool          `long:"readyafterblock" description:"Only report the server as ready in /healthz after the first block notification following the initial sync is handled"`
+	VerifyBlockRoots      bool          `long:"verifyblockroots" description:"Verify the merkle and stake roots of blocks received from dcrd"`
+
+	// Accounts
+
+	BalanceConfirmations uint `long:"balanceconfirmations" description:"Number of blocks behind the tip at which to report balances when no block is specified"`
+	IgnoreAccountFormat  bool `long:"ignoreaccountformat" description:"Start without migrating a db created with a different account address format -- Balances of accounts whose address changed will be inconsistent"`
+	StakedSubAccount     bool `long:"stakedsubaccount" description:"Track funds locked in tickets in the \"staked\" sub-account of their owner -- Changing this requires reprocessing the chain from an empty db"`
+
+	// Construction
+
+	CheckImmatureSpends bool `long:"checkimmaturespends" description:"Reject submitted transactions that spend coinbase, vote or revocation outputs that would still be immature in the next block"`
+
+	// Snapshots
+
+	SnapshotFile       string `long:"snapshotfile" description:"Bootstrap an empty db with the account balances of the given snapshot file"`
+	ExportSnapshotFile string `long:"exportsnapshotfile" description:"Write a snapshot of the account balances to the given file after the initial sync"`
+	BlockLogFile       string `long:"blocklogfile" description:"Append every processed block to the given file"`
+	ImportBlockLogFile string `long:"importblocklogfile" description:"Rebuild the db by replaying the blocks of the given block log file during startup"`
+	BootstrapFile      string `long:"bootstrapfile" description:"Process the blocks of the given file of concatenated serialized mainchain blocks during startup, before fetching the remaining ones from dcrd"`
+
+	// Block Conversion
+
+	IncludeHeaderHex  bool     `long:"includeheaderhex" description:"Include the serialized block header in the metadata of blocks"`
+	LikelyChange      bool     `long:"likelychange" description:"Flag outputs of transactions that are likely to be change outputs"`
+	RelatedOps        bool     `long:"relatedops" description:"Link every operation of a transaction to the other operations of the same transaction"`
+	IncludeEmptyTxs   bool     `long:"includeemptytxs" description:"Include transactions that do not generate any operations in the list of transactions of blocks"`
+	RedeemScriptClass bool     `long:"redeemscriptclass" description:"Include the class of the redeem script (e.g. multisig) in the metadata of debits spending P2SH outputs"`
+	AccountPkScript   bool     `long:"accountpkscript" description:"Include the pkScript of the output created or spent by each operation in the metadata of its account identifier"`
+	IncludeRawTx      bool     `long:"includerawtx" description:"Include the serialized transaction in the metadata of transactions"`
+	FeeOps            bool     `long:"feeops" description:"Add an operation with the fee paid by each transaction, credited to the reserved fees account"`
+	OmitOpMetadata    []string `long:"omitopmetadata" description:"Do not return the given operation metadata key (e.g. signature_script) to clients -- May be specified multiple times"`
+	BlockConcurrency  uint     `long:"blockconcurrency" description:"Maximum number of transactions of a block to convert concurrently when serving blocks"`
 
 	// The rest of the members of this struct are filled by loadConfig().
 
 	activeNet chainNetwork
 }
 
+// listenNetAddr returns the network and address to listen on for the given
+// listener config. Listeners may be prefixed with "unix:" to listen on a Unix
+// domain socket or "tcp:" to listen on a TCP address, which is the default
+// when no prefix is specified.
+func listenNetAddr(listener string) (string, string) {
+	switch {
+	case strings.HasPrefix(listener, "unix:"):
+		return "unix", cleanAndExpandPath(listener[len("unix:"):])
+	case strings.HasPrefix(listener, "tcp:"):
+		return "tcp", listener[len("tcp:"):]
+	default:
+		return "tcp", listener
+	}
+}
+
 // listeners returns the interface listeners where connections to the http
 // server should be accepted.
 func (c *config) listeners() ([]net.Listener, error) {
 	var list []net.Listener
-	for _, addr := range c.Listeners {
-		l, err := net.Listen("tcp", addr)
+	for _, listener := range c.Listeners {
+		network, addr := listenNetAddr(listener)
+
+		// Remove stale sockets left over from previous runs. Sockets
+		// that still accept connections belong to another running
+		// instance, so they are left alone and listening on them
+		// fails.
+		var err error
+		if network == "unix" {
+			fi, statErr := os.Stat(addr)
+			if statErr == nil && fi.Mode()&os.ModeSocket != 0 {
+				conn, dialErr := net.Dial(network, addr)
+				if dialErr == nil {
+					conn.Close()
+					err = errors.New("socket in use by " +
+						"another process")
+				} else {
+					os.Remove(addr)
+				}
+			}
+		}
+
+		var l net.Listener
+		if err == nil {
+			l, err = net.Listen(network, addr)
+		}
 		if err != nil {
 			// Cancel listening on the other addresses since we'll
 			// return an error.
@@ -243,12 +342,55 @@ func (c *config) serverConfig() (*backend.ServerConfig, error) {
 		return nil, err
 	}
 	return &backend.ServerConfig{
-		ChainParams:     chain,
-		DcrdCfg:         dcrdCfg,
-		DBType:          dbType,
-		DBDir:           dbDir,
-		CacheSizeBlocks: c.CacheSizeBlocks,
-		CacheSizeRawTxs: c.CacheSizeRawTxs,
+		ChainParams:         chain,
+		DcrdCfg:             dcrdCfg,
+		DBType:              dbType,
+		DBDir:               dbDir,
+		DBGCInterval:        c.DBGCInterval,
+		CacheSizeBlocks:     c.CacheSizeBlocks,
+		CacheSizeRawTxs:     c.CacheSizeRawTxs,
+		CacheSizePrevInputs: c.CacheSizePrevInputs,
+		CacheRawTxTTL:       c.CacheRawTxTTL,
+
+		SyncConcurrency:  c.SyncConcurrency,
+		ServeConcurrency: c.ServeConcurrency,
+		FetchConcurrency: c.FetchConcurrency,
+		VerifyBlockRoots: c.VerifyBlockRoots,
+
+		NetworkStatusCacheTTL: c.NetworkStatusCacheTTL,
+		GapFillBatchSize:      c.GapFillBatchSize,
+		SyncRetries:           c.SyncRetries,
+		MaxReorgDepth:         c.MaxReorgDepth,
+		BlockNtfnQueueSize:    c.BlockNtfnQueueSize,
+		SlowBlockThreshold:    c.SlowBlockThreshold,
+		ReadyAfterBlock:       c.ReadyAfterBlock,
+
+		BalanceConfirmations: c.BalanceConfirmations,
+		StakedSubAccount:     c.StakedSubAccount,
+		IgnoreAccountFormat:  c.IgnoreAccountFormat,
+
+		CheckImmatureSpends: c.CheckImmatureSpends,
+
+		DcrdTimeout:          c.DcrdTimeout,
+		DcrdGracePeriod:      c.DcrdGracePeriod,
+		DcrdMaxRetryInterval: c.DcrdMaxRetryInterval,
+
+		SnapshotFile:       cleanAndExpandPath(c.SnapshotFile),
+		ExportSnapshotFile: cleanAndExpandPath(c.ExportSnapshotFile),
+		BlockLogFile:       cleanAndExpandPath(c.BlockLogFile),
+		ImportBlockLogFile: cleanAndExpandPath(c.ImportBlockLogFile),
+		BootstrapFile:      cleanAndExpandPath(c.BootstrapFile),
+
+		IncludeHeaderHex:  c.IncludeHeaderHex,
+		LikelyChange:      c.LikelyChange,
+		RelatedOps:        c.RelatedOps,
+		IncludeEmptyTxs:   c.IncludeEmptyTxs,
+		RedeemScriptClass: c.RedeemScriptClass,
+		AccountPkScript:   c.AccountPkScript,
+		IncludeRawTx:      c.IncludeRawTx,
+		FeeOps:            c.FeeOps,
+		OmitOpMetadata:    c.OmitOpMetadata,
+		BlockConcurrency:  c.BlockConcurrency,
 	}, nil
 }
 
@@ -388,12 +530,16 @@ func randString() string {
 func loadConfig() (*config, []string, error) {
 	// Default config.
 	cfg := config{
-		ConfigFile:      defaultConfigFile,
-		DcrdCertPath:    defaultDcrdCertPath,
-		DebugLevel:      defaultLogLevel,
-		DBType:          string(defaultDBType),
-		CacheSizeBlocks: defaultCacheSizeBlocks,
-		CacheSizeRawTxs: defaultCacheSizeRawTxs,
+		ConfigFile:          defaultConfigFile,
+		DcrdCertPath:        defaultDcrdCertPath,
+		TLSCert:             defaultTLSCert,
+		TLSKey:              defaultTLSKey,
+		DebugLevel:          defaultLogLevel,
+		DBType:              string(defaultDBType),
+		DBGCInterval:        defaultDBGCInterval,
+		CacheSizeBlocks:     defaultCacheSizeBlocks,
+		CacheSizeRawTxs:     defaultCacheSizeRawTxs,
+		CacheSizePrevInputs: defaultCacheSizePrevInputs,
 	}
 
 	// Pre-parse the command line options to see if an alternative config
@@ -442,6 +588,12 @@ func loadConfig() (*config, []string, error) {
 			cfg.ConfigFile = preCfg.ConfigFile
 		}
 		defaultDataDir = filepath.Join(cfg.AppData, defaultDataDirname)
+		if preCfg.TLSCert == defaultTLSCert {
+			cfg.TLSCert = filepath.Join(cfg.AppData, "rpc.cert")
+		}
+		if preCfg.TLSKey == defaultTLSKey {
+			cfg.TLSKey = filepath.Join(cfg.AppData, "rpc.key")
+		}
 		defaultLogDir = filepath.Join(cfg.AppData, defaultLogDirname, string(defaultActiveNet))
 	}
 
@@ -560,6 +712,15 @@ func loadConfig() (*config, []string, error) {
 		}
 	}
 
+	// Expand the TLS file paths. Client authentication is only possible
+	// when TLS is enabled.
+	cfg.TLSCert = cleanAndExpandPath(cfg.TLSCert)
+	cfg.TLSKey = cleanAndExpandPath(cfg.TLSKey)
+	cfg.TLSClientCA = cleanAndExpandPath(cfg.TLSClientCA)
+	if cfg.TLSClientCA != "" && !cfg.TLS {
+		return nil, nil, fmt.Errorf("cannot use --tlsclientca without --tls")
+	}
+
 	// When using --rundcrd the user shouldn't specify a connection option
 	// as we'll specify one for them.
 	if cfg.DcrdConnect != "" && cfg.RunDcrd != "" {
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// TestListenNetAddr ensures listeners are parsed into the network and address
+// to listen on.
+func TestListenNetAddr(t *testing.T) {
+	tests := []struct {
+		listener    string
+		wantNetwork string
+		wantAddr    string
+	}{
+		{"127.0.0.1:9128", "tcp", "127.0.0.1:9128"},
+		{"tcp:127.0.0.1:9128", "tcp", "127.0.0.1:9128"},
+		{"tcp:[::1]:9128", "tcp", "[::1]:9128"},
+		{":9128", "tcp", ":9128"},
+		{"unix:/run/dcrros/dcrros.sock", "unix", "/run/dcrros/dcrros.sock"},
+		{"unix:/run/dcrros/../dcrros.sock", "unix", "/run/dcrros.sock"},
+	}
+
+	for _, tc := range tests {
+		network, addr := listenNetAddr(tc.listener)
+		if network != tc.wantNetwork || addr != tc.wantAddr {
+			t.Fatalf("%s: unexpected listen address: got %s %s, "+
+				"want %s %s", tc.listener, network, addr,
+				tc.wantNetwork, tc.wantAddr)
+		}
+	}
+}
+
+// unixClient returns an http client that connects to the given unix socket.
+func unixClient(sock string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+}
+
+// TestUnixListener ensures requests are served over unix socket listeners,
+// that stale sockets of previous runs are replaced and that sockets of
+// running instances are left alone.
+func TestUnixListener(t *testing.T) {
+	sock := filepath.Join(testTempDir(t), "dcrros.sock")
+	cfg := &config{Listeners: []string{"unix:" + sock}}
+
+	// Leave a stale socket behind, as a crashed instance would.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := cfg.listeners()
+	if err != nil {
+		t.Fatalf("unable to listen over stale socket: %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("unexpected number of listeners: got %d, want 1",
+			len(listeners))
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})}
+	go srv.Serve(listeners[0])
+	t.Cleanup(func() { srv.Close() })
+
+	// Helper to request the server over the socket.
+	get := func() {
+		t.Helper()
+		client := unixClient(sock)
+		resp, err := client.Get("http://dcrros/")
+		if err != nil {
+			t.Fatalf("unable to request over unix socket: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "ok\n" {
+			t.Fatalf("unexpected body: got %q, want %q", body, "ok\n")
+		}
+		client.CloseIdleConnections()
+	}
+	get()
+
+	// A second instance can't take over the socket of the running one.
+	if _, err := cfg.listeners(); err == nil {
+		t.Fatal("expected an error listening on a socket in use")
+	}
+	get()
+}
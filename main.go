@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -27,6 +28,26 @@ func (r routerify) Routes() rserver.Routes {
 	return rserver.Routes{rserver.Route(r)}
 }
 
+// readinessChecker is implemented by servers that report whether they should
+// receive traffic.
+type readinessChecker interface {
+	Active() bool
+	Ready() bool
+}
+
+// healthzHandler returns the handler of the /healthz readiness probe, which
+// fails while the server is either inactive or not yet ready.
+func healthzHandler(svr readinessChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !svr.Active() || !svr.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
 func _main() error {
 	ctx := shutdownListener()
 	var wg sync.WaitGroup
@@ -202,7 +223,13 @@ func _main() error {
 			w.Write([]byte(s))
 		},
 	}
-	routes := append(drsvr.Routers(), routerify(index))
+	healthz := rserver.Route{
+		Name:        "healthz",
+		Method:      "GET",
+		Pattern:     "/healthz",
+		HandlerFunc: healthzHandler(drsvr),
+	}
+	routes := append(drsvr.Routers(), routerify(index), routerify(healthz))
 	router := rserver.NewRouter(routes...)
 	svr := &http.Server{
 		Handler: router,
@@ -215,6 +242,22 @@ func _main() error {
 		return err
 	}
 
+	// Serve the API over HTTPS if requested.
+	if cfg.TLS {
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			requestShutdown()
+			wg.Wait()
+			return err
+		}
+		for i, l := range listeners {
+			listeners[i] = tls.NewListener(l, tlsCfg)
+		}
+	}
+
 	for _, l := range listeners {
 		wg.Add(1)
 		go func(l net.Listener) {
@@ -0,0 +1,77 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain initializes the log rotator, which must be done before logging.
+func TestMain(m *testing.M) {
+	logDir, err := ioutil.TempDir("", "dcrros-logs")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initLogRotator(filepath.Join(logDir, "dcrros.log"))
+	code := m.Run()
+	logRotator.Close()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+// testReadiness is a readinessChecker with fixed states.
+type testReadiness struct {
+	active, ready bool
+}
+
+func (r testReadiness) Active() bool { return r.active }
+func (r testReadiness) Ready() bool  { return r.ready }
+
+// TestHealthz ensures the readiness probe only succeeds while the server is
+// both active and ready.
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name       string
+		svr        testReadiness
+		wantStatus int
+		wantBody   string
+	}{{
+		name:       "warming up",
+		svr:        testReadiness{active: true},
+		wantStatus: http.StatusServiceUnavailable,
+		wantBody:   "not ready\n",
+	}, {
+		name:       "inactive",
+		svr:        testReadiness{ready: true},
+		wantStatus: http.StatusServiceUnavailable,
+		wantBody:   "not ready\n",
+	}, {
+		name:       "active and ready",
+		svr:        testReadiness{active: true, ready: true},
+		wantStatus: http.StatusOK,
+		wantBody:   "ok\n",
+	}}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		healthzHandler(tc.svr)(w, req)
+		if w.Code != tc.wantStatus {
+			t.Fatalf("%s: unexpected status: got %d, want %d", tc.name,
+				w.Code, tc.wantStatus)
+		}
+		if got := w.Body.String(); got != tc.wantBody {
+			t.Fatalf("%s: unexpected body: got %q, want %q", tc.name,
+				got, tc.wantBody)
+		}
+	}
+}
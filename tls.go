@@ -0,0 +1,132 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// fileExists reports whether the named file or directory exists.
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// genCertPair generates a self-signed certificate and key pair valid for the
+// local host and writes them to the given files.
+//
+// The generated certificate is only meant for testing and local deployments.
+func genCertPair(certFile, keyFile string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	dnsNames := []string{host}
+	if host != "localhost" {
+		dnsNames = append(dnsNames, "localhost")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"dcrros autogenerated cert"},
+			CommonName:   host,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template,
+		&priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("unable to create certificate: %v", err)
+	}
+	derKey, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: derKey})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		os.Remove(certFile)
+		return err
+	}
+
+	log.Infof("Generated TLS certificate %s", certFile)
+	return nil
+}
+
+// tlsConfig returns the TLS config to use for the listeners of the http
+// server, generating a self-signed certificate if none exists yet.
+func (c *config) tlsConfig() (*tls.Config, error) {
+	if !fileExists(c.TLSCert) && !fileExists(c.TLSKey) {
+		if err := genCertPair(c.TLSCert, c.TLSKey); err != nil {
+			return nil, fmt.Errorf("unable to generate TLS "+
+				"certificate: %v", err)
+		}
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Require clients to present a certificate signed by one of the
+	// given CAs if client authentication was requested.
+	if c.TLSClientCA != "" {
+		caPEM, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS client CA "+
+				"file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in TLS "+
+				"client CA file %s", c.TLSClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTempDir returns a temporary dir removed at the end of the test.
+func testTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dcrros-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// testCert returns a client certificate for the given common name signed by
+// parent or a self-signed CA certificate if parent is nil, along with its
+// x509 form.
+func testCert(t *testing.T, name string, parent *tls.Certificate) (*tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(priv)
+	if parent == nil {
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+	} else {
+		signer = parent.Leaf
+		signerKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer,
+		&priv.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, leaf
+}
+
+// TestTLSConfigGenCert ensures a self-signed certificate valid for the local
+// host is generated when neither the certificate nor the key exist, and that
+// existing ones are reused.
+func TestTLSConfigGenCert(t *testing.T) {
+	dir := testTempDir(t)
+	cfg := &config{
+		TLSCert: filepath.Join(dir, "rpc.cert"),
+		TLSKey:  filepath.Join(dir, "rpc.key"),
+	}
+	if _, err := cfg.tlsConfig(); err != nil {
+		t.Fatalf("unable to generate certificate: %v", err)
+	}
+
+	certPEM, err := ioutil.ReadFile(cfg.TLSCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("generated certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Fatalf("generated certificate not valid for %s: %v",
+				host, err)
+		}
+	}
+	fi, err := os.Stat(cfg.TLSKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("unexpected key file permissions: got %o, want %o",
+			perm, 0600)
+	}
+
+	// The existing certificate is reused.
+	if _, err := cfg.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := ioutil.ReadFile(cfg.TLSCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reloaded, certPEM) {
+		t.Fatal("existing certificate was regenerated")
+	}
+
+	// A missing key is not silently replaced.
+	if err := os.Remove(cfg.TLSKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.tlsConfig(); err == nil {
+		t.Fatal("expected an error loading a certificate without key")
+	}
+}
+
+// TestTLSClientCA ensures only clients presenting a certificate signed by one
+// of the configured client CAs complete the handshake.
+func TestTLSClientCA(t *testing.T) {
+	dir := testTempDir(t)
+	ca, caCert := testCert(t, "client ca", nil)
+	trusted, _ := testCert(t, "trusted client", ca)
+	untrustedCA, _ := testCert(t, "untrusted ca", nil)
+	untrusted, _ := testCert(t, "untrusted client", untrustedCA)
+
+	caFile := filepath.Join(dir, "clients.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: caCert.Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{
+		TLSCert:     filepath.Join(dir, "rpc.cert"),
+		TLSKey:      filepath.Join(dir, "rpc.key"),
+		TLSClientCA: caFile,
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	serverPEM, err := ioutil.ReadFile(cfg.TLSCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(serverPEM) {
+		t.Fatal("unable to load server certificate")
+	}
+
+	tests := []struct {
+		name       string
+		clientCert *tls.Certificate
+		wantErr    bool
+	}{{
+		name:    "no client certificate",
+		wantErr: true,
+	}, {
+		name:       "untrusted client certificate",
+		clientCert: untrusted,
+		wantErr:    true,
+	}, {
+		name:       "trusted client certificate",
+		clientCert: trusted,
+	}}
+
+	for _, tc := range tests {
+		clientCfg := &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+		}
+		if tc.clientCert != nil {
+			clientCfg.Certificates = []tls.Certificate{*tc.clientCert}
+		}
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: clientCfg},
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Fatalf("%s: unexpected error: got %v, want error %v",
+				tc.name, err, tc.wantErr)
+		}
+		client.CloseIdleConnections()
+	}
+
+	// A client CA file without certificates is rejected.
+	if err := ioutil.WriteFile(caFile, []byte("not a cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.tlsConfig(); err == nil {
+		t.Fatal("expected an error loading a client CA file without " +
+			"certificates")
+	}
+}
@@ -8,18 +8,32 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	rtypes "github.com/coinbase/rosetta-sdk-go/types"
 	"github.com/decred/dcrd/blockchain/stake/v3"
+	"github.com/decred/dcrd/chaincfg/chainhash"
 	"github.com/decred/dcrd/chaincfg/v3"
 	"github.com/decred/dcrd/dcrutil/v3"
 	"github.com/decred/dcrd/txscript/v3"
 	"github.com/decred/dcrd/wire"
+	"golang.org/x/sync/errgroup"
 )
 
+// SubAccountStaked is the sub-account of operations that lock or unlock funds
+// in tickets.
+const SubAccountStaked = "staked"
+
+// FeeAccount is the reserved account credited by fee operations. It is not a
+// valid address, so it never clashes with the account of any script.
+const FeeAccount = "fees"
+
 var (
 	ErrNeedsPreviousBlock = errors.New("previous block required")
+	ErrNonContiguousOps   = errors.New("non-contiguous operation indices")
+	ErrTxTreeMismatch     = errors.New("tx type does not match its tree")
 
 	CurrencySymbol = &rtypes.Currency{
 		Symbol:   "DCR",
@@ -41,16 +55,86 @@ func VoteBitsApprovesParent(voteBits uint16) bool {
 	return voteBits&0x01 == 0x01
 }
 
+// AccountFormatVersion is the version of the format of account addresses
+// generated from output scripts. It MUST be increased whenever the account
+// address of any existing output changes, since balances tracked under the
+// previous format become inconsistent with the new one.
+const AccountFormatVersion uint32 = 2
+
+// multisigAccountPrefix is the prefix of account addresses of bare multisig
+// scripts.
+const multisigAccountPrefix = "multisig:"
+
+// multisigAccountAddr returns the account address of a bare multisig script
+// that requires reqSigs signatures from the given addresses.
+//
+// The account is encoded as "multisig:<m>-of-<n>:<addr1>,...,<addrn>", with
+// the addresses sorted lexicographically, such that the account doesn't
+// depend on the order of the keys in the script.
+func multisigAccountAddr(reqSigs int, addrs []dcrutil.Address) string {
+	saddrs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		saddrs[i] = addr.Address()
+	}
+	sort.Strings(saddrs)
+	return fmt.Sprintf("%s%d-of-%d:%s", multisigAccountPrefix, reqSigs,
+		len(saddrs), strings.Join(saddrs, ","))
+}
+
+// IsMultisigAccountAddr returns true if the given account address is a valid
+// bare multisig account address for the given network.
+func IsMultisigAccountAddr(addr string, chainParams *chaincfg.Params) bool {
+	if !strings.HasPrefix(addr, multisigAccountPrefix) {
+		return false
+	}
+	parts := strings.SplitN(addr[len(multisigAccountPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	var reqSigs, nbKeys int
+	_, err := fmt.Sscanf(parts[0], "%d-of-%d", &reqSigs, &nbKeys)
+	if err != nil || reqSigs < 1 || reqSigs > nbKeys {
+		return false
+	}
+	saddrs := strings.Split(parts[1], ",")
+	if len(saddrs) != nbKeys || !sort.StringsAreSorted(saddrs) {
+		return false
+	}
+	for _, saddr := range saddrs {
+		if _, err := dcrutil.DecodeAddress(saddr, chainParams); err != nil {
+			return false
+		}
+	}
+
+	// Only accept the canonical encoding.
+	return parts[0] == fmt.Sprintf("%d-of-%d", reqSigs, nbKeys)
+}
+
+// rawPkScriptToAccountAddr encodes the given script as a raw account address.
+// Raw addresses include the script version and class, followed by the script
+// itself.
 func rawPkScriptToAccountAddr(version uint16, pkScript []byte) string {
-	addrBytes := make([]byte, 2+2*2+2*len(pkScript))
+	class := txscript.GetScriptClass(version, pkScript)
+	addrBytes := make([]byte, 2+3*2+2*len(pkScript))
 	addrBytes[0] = 0x30 // "0"
 	addrBytes[1] = 0x78 // "x"
-	versionBytes := []byte{byte(version >> 8), byte(version)}
-	hex.Encode(addrBytes[2:6], versionBytes)
-	hex.Encode(addrBytes[6:], pkScript)
+	prefixBytes := []byte{byte(version >> 8), byte(version), byte(class)}
+	hex.Encode(addrBytes[2:8], prefixBytes)
+	hex.Encode(addrBytes[8:], pkScript)
 	return string(addrBytes)
 }
 
+// IsRawAccountAddr returns true if the given account address is encoded in
+// the raw format used for scripts that can't be represented as a single
+// standard address.
+func IsRawAccountAddr(addr string) bool {
+	if len(addr) < 8 || addr[:2] != "0x" {
+		return false
+	}
+	_, err := hex.DecodeString(addr[2:])
+	return err == nil
+}
+
 func dcrPkScriptToAccountAddr(version uint16, pkScript []byte, chainParams *chaincfg.Params) (string, error) {
 	if version != 0 {
 		// Versions other than 0 aren't standardized yet, so return as
@@ -58,15 +142,18 @@ func dcrPkScriptToAccountAddr(version uint16, pkScript []byte, chainParams *chai
 		return rawPkScriptToAccountAddr(version, pkScript), nil
 	}
 
-	_, addrs, _, err := txscript.ExtractPkScriptAddrs(version, pkScript, chainParams)
+	class, addrs, reqSigs, err := txscript.ExtractPkScriptAddrs(version, pkScript, chainParams)
 	if err != nil {
 		// Currently the only possible error is due to version != 0,
 		// which is handled above, but err on the side of caution.
 		return "", err
 	}
 
+	if class == txscript.MultiSigTy && len(addrs) > 0 {
+		return multisigAccountAddr(reqSigs, addrs), nil
+	}
+
 	if len(addrs) != 1 {
-		// TODO: support 'bare' (non-p2sh) multisig?
 		return rawPkScriptToAccountAddr(version, pkScript), nil
 	}
 
@@ -74,21 +161,64 @@ func dcrPkScriptToAccountAddr(version uint16, pkScript []byte, chainParams *chai
 	return saddr, nil
 }
 
+// stakeSubAccount returns the sub-account of the given output script. Funds
+// locked in tickets belong to the staked sub-account, while every other
+// output belongs to the main account.
+func stakeSubAccount(version uint16, pkScript []byte) string {
+	if version == 0 && txscript.GetScriptClass(version, pkScript) == txscript.StakeSubmissionTy {
+		return SubAccountStaked
+	}
+	return ""
+}
+
+// redeemScriptClass returns the class of the redeem script revealed by the
+// given signature script when spending a P2SH output. It returns false if the
+// spent output is not P2SH or the signature script doesn't push any data.
+func redeemScriptClass(prevInput *PrevInput, sigScript []byte) (txscript.ScriptClass, bool) {
+	if prevInput.Version != 0 || txscript.GetScriptClass(prevInput.Version, prevInput.PkScript) != txscript.ScriptHashTy {
+		return txscript.NonStandardTy, false
+	}
+
+	// The redeem script is the last data push of the signature script.
+	pushes, err := txscript.PushedData(sigScript)
+	if err != nil || len(pushes) == 0 {
+		return txscript.NonStandardTy, false
+	}
+	redeemScript := pushes[len(pushes)-1]
+	return txscript.GetScriptClass(0, redeemScript), true
+}
+
 type PrevInput struct {
 	PkScript []byte
 	Version  uint16
 	Amount   dcrutil.Amount
+
+	// Immature is set when the output was created by a coinbase, vote or
+	// revocation that hasn't reached maturity yet. Fetchers are only
+	// required to fill it for inputs of mempool transactions.
+	Immature bool
 }
 
 type PrevInputsFetcher func(...*wire.OutPoint) (map[wire.OutPoint]*PrevInput, error)
 
 type Op struct {
-	Tree      int8
-	Status    OpStatus
-	Tx        *wire.MsgTx
-	TxIndex   int
-	IOIndex   int
-	Account   string
+	// BlockHeader is the header of the block that includes the tx. It is
+	// nil for mempool txs.
+	BlockHeader *wire.BlockHeader
+
+	Tree    int8
+	Status  OpStatus
+	Tx      *wire.MsgTx
+	TxType  stake.TxType
+	TxIndex int
+	IOIndex int
+	Account string
+
+	// SubAccount is the sub-account of Account affected by the op. It is
+	// empty for spendable funds and SubAccountStaked for funds locked in
+	// tickets.
+	SubAccount string
+
 	Type      OpType
 	OpIndex   int64
 	Amount    dcrutil.Amount
@@ -102,7 +232,20 @@ func (op *Op) ROp() *rtypes.Operation {
 		Address: op.Account,
 	}
 	var meta map[string]interface{}
-	if op.Type == OpTypeDebit {
+	switch op.Type {
+	case OpTypeSubsidy:
+		// Subsidies are not paid by any account.
+		account = nil
+		meta = map[string]interface{}{
+			"input_index":    op.IOIndex,
+			"subsidy_source": "stakebase",
+		}
+		if op.TxType == stake.TxTypeRegular {
+			meta["subsidy_source"] = "coinbase"
+			meta["subsidy_height"] = op.BlockHeader.Height
+		}
+
+	case OpTypeDebit:
 		meta = map[string]interface{}{
 			"input_index":      op.IOIndex,
 			"prev_hash":        op.In.PreviousOutPoint.Hash.String(),
@@ -114,13 +257,33 @@ func (op *Op) ROp() *rtypes.Operation {
 			"signature_script": op.In.SignatureScript,
 			"script_version":   op.PrevInput.Version,
 		}
-	} else {
+		if op.PrevInput.Immature {
+			meta["spends_immature"] = true
+		}
+
+	default:
 		meta = map[string]interface{}{
 			"output_index":   op.IOIndex,
 			"script_version": op.Out.Version,
 		}
 	}
 
+	// Commitments do not change the balance of their account, so their
+	// amount is only informed in the metadata.
+	amount := DcrAmountToRosetta(op.Amount)
+	if op.Type == OpTypeCommitment {
+		meta["commitment_amount"] = int64(op.Amount)
+		amount = nil
+	}
+
+	// Link votes and revocations to the ticket they spend.
+	switch op.TxType {
+	case stake.TxTypeSSGen:
+		meta["ticket_hash"] = op.Tx.TxIn[1].PreviousOutPoint.Hash.String()
+	case stake.TxTypeSSRtx:
+		meta["ticket_hash"] = op.Tx.TxIn[0].PreviousOutPoint.Hash.String()
+	}
+
 	return &rtypes.Operation{
 		OperationIdentifier: &rtypes.OperationIdentifier{
 			Index: int64(op.OpIndex),
@@ -128,7 +291,7 @@ func (op *Op) ROp() *rtypes.Operation {
 		Type:     op.Type.RType(),
 		Status:   string(op.Status),
 		Account:  account,
-		Amount:   DcrAmountToRosetta(op.Amount),
+		Amount:   amount,
 		Metadata: meta,
 	}
 
@@ -136,9 +299,29 @@ func (op *Op) ROp() *rtypes.Operation {
 
 type BlockOpCb = func(op *Op) error
 
+// iterateBlockOpsInTx calls applyOp for every operation of the transaction in
+// op.Tx.
+//
+// The operation index assigned to each input and output is part of the public
+// API, since clients persist operations keyed by it, and therefore MUST NOT
+// change across versions: operations are numbered sequentially, starting at
+// op.OpIndex, over the inputs then the outputs of the transaction in their
+// on-chain order (outputs then inputs for reversed transactions), skipping
+// the stakebase/coinbase input of votes and coinbases, zero-valued outputs and
+// scripts that do not map to an account. Commitments of tickets and the
+// subsidy of votes are numbered last, after all regular outputs.
 func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpCb, chainParams *chaincfg.Params) error {
 	tx := op.Tx
-	isVote := op.Tree == wire.TxTreeStake && stake.IsSSGen(tx)
+	op.TxType = stake.DetermineTxType(tx)
+
+	// Ensure the tx type matches the tree it was included in, since
+	// stake txs are processed differently than regular ones.
+	isStakeTx := op.TxType != stake.TxTypeRegular
+	if isStakeTx != (op.Tree == wire.TxTreeStake) {
+		return fmt.Errorf("%w: tx %s of type %d in tree %d",
+			ErrTxTreeMismatch, tx.TxHash(), op.TxType, op.Tree)
+	}
+	isVote := op.TxType == stake.TxTypeSSGen
 	isCoinbase := op.Tree == wire.TxTreeRegular && op.TxIndex == 0
 
 	// Fetch the relevant data for the inputs.
@@ -159,11 +342,12 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 
 	var ok bool
 
-	// Reset op's output attributes.
-	op.Out = nil
-
 	// Helper to process the inputs.
 	addTxIns := func() error {
+		// Reset op's output attributes, which might have been set
+		// when processing the outputs of a reversed tx.
+		op.Out = nil
+
 		for i, in := range tx.TxIn {
 			if i == 0 && (isVote || isCoinbase) {
 				// Coinbases don't have an input with i > 0.
@@ -185,6 +369,8 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 				// commitments, etc.
 				continue
 			}
+			op.SubAccount = stakeSubAccount(op.PrevInput.Version,
+				op.PrevInput.PkScript)
 
 			// Fill in op input data.
 			op.IOIndex = i
@@ -206,18 +392,18 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 		return nil
 	}
 
-	// Reset op's input attributes.
-	op.In = nil
-	op.PrevInput = nil
-
 	// Helper to process the outputs.
 	addTxOuts := func() error {
+		// Reset op's input attributes, which might have been set when
+		// processing the inputs of a successful tx.
+		op.In = nil
+		op.PrevInput = nil
+
 		for i, out := range tx.TxOut {
 			if out.Value == 0 {
 				// Ignore OP_RETURNs and other zero-valued
-				// outputs.
-				//
-				// TODO: decode ticket commitments?
+				// outputs. Ticket commitments are processed
+				// separately.
 				continue
 			}
 
@@ -229,6 +415,7 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 			if op.Account == "" {
 				continue
 			}
+			op.SubAccount = stakeSubAccount(out.Version, out.PkScript)
 
 			// Fill in op output data.
 			op.IOIndex = i
@@ -250,6 +437,92 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 		return nil
 	}
 
+	// Helper to process the commitments of tickets. These are processed
+	// after all outputs so that they don't change the index of the
+	// operations of regular outputs.
+	addCommitments := func() error {
+		if op.TxType != stake.TxTypeSStx {
+			return nil
+		}
+
+		op.In = nil
+		op.PrevInput = nil
+		op.SubAccount = ""
+
+		// Commitments are the odd outputs of tickets.
+		for i := 1; i < len(tx.TxOut); i += 2 {
+			out := tx.TxOut[i]
+			addr, err := stake.AddrFromSStxPkScrCommitment(out.PkScript, chainParams)
+			if err != nil {
+				return err
+			}
+			amount, err := stake.AmountFromSStxPkScrCommitment(out.PkScript)
+			if err != nil {
+				return err
+			}
+
+			op.Account = addr.Address()
+			op.IOIndex = i
+			op.Out = out
+			op.Type = OpTypeCommitment
+			op.Amount = amount
+
+			if err := applyOp(op); err != nil {
+				return err
+			}
+
+			// Track cumulative OpIndex.
+			op.OpIndex += 1
+		}
+
+		return nil
+	}
+
+	// Helper to process the subsidy redeemed by the stakebase input of
+	// votes and the coinbase input of coinbases. This is processed last
+	// so that it doesn't change the index of the operations of regular
+	// inputs and outputs.
+	addSubsidy := func() error {
+		var subsidy dcrutil.Amount
+		switch {
+		case isVote:
+			// The vote subsidy depends on the height of the block
+			// that includes the vote, which is the one after the
+			// voted block.
+			_, votedHeight := stake.SSGenBlockVotedOn(tx)
+			subsidy = calcStakeVoteSubsidy(int64(votedHeight)+1, chainParams)
+
+		case isCoinbase && op.BlockHeader != nil && op.BlockHeader.Height > 0:
+			// Coinbases issue the work and treasury portions of
+			// the subsidy. The genesis block does not issue any
+			// coins.
+			height := int64(op.BlockHeader.Height)
+			voters := op.BlockHeader.Voters
+			subsidy = calcWorkSubsidy(height, voters, chainParams) +
+				calcTreasurySubsidy(height, voters, chainParams)
+
+		default:
+			return nil
+		}
+
+		op.In = tx.TxIn[0]
+		op.PrevInput = nil
+		op.Out = nil
+		op.Account = ""
+		op.SubAccount = ""
+		op.IOIndex = 0
+		op.Type = OpTypeSubsidy
+		op.Amount = -subsidy
+		if op.Status == OpStatusReversed {
+			op.Amount *= -1
+		}
+		if err := applyOp(op); err != nil {
+			return err
+		}
+		op.OpIndex += 1
+		return nil
+	}
+
 	if op.Status == OpStatusSuccess {
 		if err := addTxIns(); err != nil {
 			return err
@@ -257,6 +530,12 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 		if err := addTxOuts(); err != nil {
 			return err
 		}
+		if err := addCommitments(); err != nil {
+			return err
+		}
+		if err := addSubsidy(); err != nil {
+			return err
+		}
 	} else {
 		// When reversing a tx we apply the update in the opposite
 		// order: first roll back outputs (which were crediting an
@@ -267,53 +546,206 @@ func iterateBlockOpsInTx(op *Op, fetchInputs PrevInputsFetcher, applyOp BlockOpC
 		if err := addTxIns(); err != nil {
 			return err
 		}
+		if err := addSubsidy(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func IterateBlockOps(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, applyOp BlockOpCb, chainParams *chaincfg.Params) error {
+// blockTxOps returns the initial op for every transaction affected by block
+// b, in the order they must be applied.
+func blockTxOps(b, prev *wire.MsgBlock) ([]Op, error) {
 	approvesParent := VoteBitsApprovesParent(b.Header.VoteBits) || b.Header.Height == 0
 	if !approvesParent && prev == nil {
-		return ErrNeedsPreviousBlock
+		return nil, ErrNeedsPreviousBlock
 	}
 
-	// Use a single op var.
-	var op Op
+	nbTxs := len(b.Transactions) + len(b.STransactions)
+	if !approvesParent {
+		nbTxs += len(prev.Transactions)
+	}
+	txOps := make([]Op, 0, nbTxs)
 
-	// Helper to apply a set of transactions.
-	applyTxs := func(tree int8, status OpStatus, txs []*wire.MsgTx) error {
-		op = Op{
-			Tree:   tree,
-			Status: status,
-		}
+	// Helper to add a set of transactions.
+	addTxs := func(header *wire.BlockHeader, tree int8, status OpStatus, txs []*wire.MsgTx) {
 		for i, tx := range txs {
-			op.Tx = tx
-			op.TxIndex = i
-			op.OpIndex = 0
-			err := iterateBlockOpsInTx(&op, fetchInputs, applyOp,
-				chainParams)
-			if err != nil {
-				return err
-			}
+			txOps = append(txOps, Op{
+				BlockHeader: header,
+				Tree:        tree,
+				Status:      status,
+				Tx:          tx,
+				TxIndex:     i,
+			})
 		}
-
-		return nil
 	}
 
 	if !approvesParent {
 		// Reverse regular transactions of the previous block.
-		if err := applyTxs(wire.TxTreeRegular, OpStatusReversed, prev.Transactions); err != nil {
-			return err
+		addTxs(&prev.Header, wire.TxTreeRegular, OpStatusReversed, prev.Transactions)
+	}
+	addTxs(&b.Header, wire.TxTreeRegular, OpStatusSuccess, b.Transactions)
+	addTxs(&b.Header, wire.TxTreeStake, OpStatusSuccess, b.STransactions)
+
+	return txOps, nil
+}
+
+// prefetchBlockInputs fetches the previous outputs spent by every transaction
+// in txOps with a single call to fetchInputs and returns a fetcher that serves
+// the inputs of the individual transactions from the fetched set.
+//
+// Outputs created by the transactions themselves are resolved directly from
+// them instead of being requested from fetchInputs.
+func prefetchBlockInputs(txOps []Op, fetchInputs PrevInputsFetcher) (PrevInputsFetcher, error) {
+	blockTxs := make(map[chainhash.Hash]*Op, len(txOps))
+	for i := range txOps {
+		blockTxs[txOps[i].Tx.TxHash()] = &txOps[i]
+	}
+
+	prevInputs := make(map[wire.OutPoint]*PrevInput)
+	var outpoints []*wire.OutPoint
+	for i := range txOps {
+		op := &txOps[i]
+		tx := op.Tx
+		isCoinbase := op.Tree == wire.TxTreeRegular && op.TxIndex == 0
+		isVote := op.Tree == wire.TxTreeStake && stake.IsSSGen(tx)
+		for j, in := range tx.TxIn {
+			if j == 0 && (isVote || isCoinbase) {
+				continue
+			}
+			outp := &in.PreviousOutPoint
+			if _, ok := prevInputs[*outp]; ok {
+				continue
+			}
+			src, ok := blockTxs[outp.Hash]
+			if !ok || src.Tree != outp.Tree || int(outp.Index) >= len(src.Tx.TxOut) {
+				outpoints = append(outpoints, outp)
+				continue
+			}
+			out := src.Tx.TxOut[outp.Index]
+			prevInputs[*outp] = &PrevInput{
+				PkScript: out.PkScript,
+				Version:  out.Version,
+				Amount:   dcrutil.Amount(out.Value),
+			}
+		}
+	}
+
+	if len(outpoints) > 0 {
+		fetched, err := fetchInputs(outpoints...)
+		if err != nil {
+			return nil, err
+		}
+		for outp, prevInput := range fetched {
+			prevInputs[outp] = prevInput
 		}
 	}
-	if err := applyTxs(wire.TxTreeRegular, OpStatusSuccess, b.Transactions); err != nil {
+
+	return func(outpoints ...*wire.OutPoint) (map[wire.OutPoint]*PrevInput, error) {
+		res := make(map[wire.OutPoint]*PrevInput, len(outpoints))
+		for _, outp := range outpoints {
+			if prevInput, ok := prevInputs[*outp]; ok {
+				res[*outp] = prevInput
+			}
+		}
+		return res, nil
+	}, nil
+}
+
+// IterateBlockOps calls applyOp for every operation of block b, in the order
+// they must be applied.
+//
+// The previous outputs spent by every transaction of the block are requested
+// with a single call to fetchInputs before any operation is applied.
+func IterateBlockOps(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, applyOp BlockOpCb, chainParams *chaincfg.Params) error {
+	txOps, err := blockTxOps(b, prev)
+	if err != nil {
 		return err
 	}
-	if err := applyTxs(wire.TxTreeStake, OpStatusSuccess, b.STransactions); err != nil {
+	fetchInputs, err = prefetchBlockInputs(txOps, fetchInputs)
+	if err != nil {
 		return err
 	}
 
+	for i := range txOps {
+		err := iterateBlockOpsInTx(&txOps[i], fetchInputs, applyOp,
+			chainParams)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendROp appends the rosetta representation of op to the list of
+// operations of tx, asserting that the operation indices of the transaction
+// start at zero and are contiguous as required by the rosetta spec.
+func appendROp(tx *rtypes.Transaction, op *Op, opts *ConvertOpts) (*rtypes.Operation, error) {
+	if op.OpIndex != int64(len(tx.Operations)) {
+		return nil, fmt.Errorf("%w: op %d of tx %s has index %d",
+			ErrNonContiguousOps, len(tx.Operations),
+			tx.TransactionIdentifier.Hash, op.OpIndex)
+	}
+	rop := op.ROp()
+	if op.Type == OpTypeSubsidy {
+		tx.Operations = append(tx.Operations, rop)
+		return rop, nil
+	}
+	if opts.StakedSubAccount && op.SubAccount != "" {
+		rop.Account.SubAccount = &rtypes.SubAccountIdentifier{
+			Address: op.SubAccount,
+		}
+	}
+	if opts.AccountPkScript {
+		var pkScript []byte
+		if op.Type == OpTypeDebit {
+			pkScript = op.PrevInput.PkScript
+		} else {
+			pkScript = op.Out.PkScript
+		}
+		rop.Account.Metadata = map[string]interface{}{
+			"pk_script": hex.EncodeToString(pkScript),
+		}
+	}
+	if opts.RedeemScriptClass && op.Type == OpTypeDebit {
+		class, ok := redeemScriptClass(op.PrevInput, op.In.SignatureScript)
+		if ok {
+			rop.Metadata["redeem_script_class"] = class.String()
+		}
+	}
+	tx.Operations = append(tx.Operations, rop)
+	return rop, nil
+}
+
+// appendFeeOp appends a fee operation crediting FeeAccount with the fee of
+// tx. The fee is derived from the sum of the amounts of the operations already
+// in tx, which is passed in total: debits and subsidies are negative and
+// credits positive for successful txs (and the opposite for reversed ones), so
+// the fee operation balances the operations of the transaction.
+func appendFeeOp(tx *rtypes.Transaction, status OpStatus, total dcrutil.Amount) {
+	tx.Operations = append(tx.Operations, &rtypes.Operation{
+		OperationIdentifier: &rtypes.OperationIdentifier{
+			Index: int64(len(tx.Operations)),
+		},
+		Type:   OpTypeFee.RType(),
+		Status: string(status),
+		Account: &rtypes.AccountIdentifier{
+			Address: FeeAccount,
+		},
+		Amount:   DcrAmountToRosetta(-total),
+		Metadata: map[string]interface{}{},
+	})
+}
+
+// addRawTx adds the hex-encoded serialization of tx to the metadata of rtx.
+func addRawTx(rtx *rtypes.Transaction, tx *wire.MsgTx) error {
+	rawTx, err := tx.Bytes()
+	if err != nil {
+		return err
+	}
+	rtx.Metadata["raw_tx"] = hex.EncodeToString(rawTx)
 	return nil
 }
 
@@ -332,42 +764,271 @@ func txMetaToRosetta(tx *wire.MsgTx) *rtypes.Transaction {
 
 }
 
-// WireBlockToRosetta converts the given block in wire representation to the
-// block in rosetta representation. The previous block is needed when the
-// current block disapproved the regular transactions of the previous one, in
-// which case it must be specified or this function errors.
-func WireBlockToRosetta(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, chainParams *chaincfg.Params) (*rtypes.Block, error) {
+// ConvertOpts are options that modify how blocks and transactions are
+// converted to their rosetta representation.
+type ConvertOpts struct {
+	// IncludeHeaderHex includes the serialized block header as a hex
+	// string in the block metadata.
+	IncludeHeaderHex bool
 
-	approvesParent := VoteBitsApprovesParent(b.Header.VoteBits) || b.Header.Height == 0
-	if !approvesParent && prev == nil {
-		return nil, ErrNeedsPreviousBlock
+	// LikelyChange flags outputs of regular transactions that are likely
+	// to be change with the likely_change metadata.
+	LikelyChange bool
+
+	// RelatedOps links every operation of a transaction to all other
+	// operations of the same transaction through related_operations.
+	RelatedOps bool
+
+	// OmitOpMetadata lists operation metadata keys that are removed from
+	// the converted operations.
+	OmitOpMetadata []string
+
+	// StakedSubAccount sets the sub-account of operations that lock or
+	// unlock funds in tickets to SubAccountStaked.
+	StakedSubAccount bool
+
+	// RedeemScriptClass includes the class of the redeem script (e.g.
+	// multisig) in the redeem_script_class metadata of debits spending
+	// P2SH outputs.
+	RedeemScriptClass bool
+
+	// AccountPkScript includes the hex-encoded pkScript of the output
+	// created or spent by each operation in the pk_script metadata of its
+	// account identifier.
+	AccountPkScript bool
+
+	// IncludeEmptyTxs includes transactions of a block that do not
+	// generate any operations (for example, ones with only OP_RETURN or
+	// non-standard outputs) in its list of transactions. By default,
+	// such transactions are omitted.
+	IncludeEmptyTxs bool
+
+	// IncludeRawTx includes the hex-encoded serialized transaction in the
+	// raw_tx metadata of every transaction.
+	IncludeRawTx bool
+
+	// FeeOps appends a synthetic fee operation crediting FeeAccount with
+	// the fee (total input value minus total output value) of every
+	// transaction other than coinbases that pays a non-zero fee.
+	FeeOps bool
+
+	// Concurrency is the maximum number of transactions of a block that
+	// are converted concurrently. Values lower than 2 convert the
+	// transactions serially. When converting concurrently, the inputs
+	// fetcher must be safe for concurrent access.
+	Concurrency int
+}
+
+// omitOpMetadata removes the given keys from the metadata of every operation
+// of tx.
+func omitOpMetadata(tx *rtypes.Transaction, keys []string) {
+	for _, op := range tx.Operations {
+		for _, k := range keys {
+			delete(op.Metadata, k)
+		}
 	}
+}
 
-	var txs []*rtypes.Transaction
-	nbTxs := len(b.Transactions) + len(b.STransactions)
-	if !approvesParent {
-		nbTxs += len(prev.Transactions) + len(prev.STransactions)
+// linkRelatedOps fills the related operations of every operation of tx with
+// the identifiers of all other operations of the transaction.
+func linkRelatedOps(tx *rtypes.Transaction) {
+	for _, op := range tx.Operations {
+		related := make([]*rtypes.OperationIdentifier, 0, len(tx.Operations)-1)
+		for _, other := range tx.Operations {
+			if other == op {
+				continue
+			}
+			related = append(related, &rtypes.OperationIdentifier{
+				Index: other.OperationIdentifier.Index,
+			})
+		}
+		op.RelatedOperations = related
 	}
-	txs = make([]*rtypes.Transaction, 0, nbTxs)
+}
+
+// markLikelyChange flags the credit of tx that is likely to be a change
+// output.
+//
+// This is a conservative heuristic: an output is only flagged when it is the
+// single credit paying back to an account that is also debited by the
+// transaction and the transaction has credits to at least one other account.
+func markLikelyChange(tx *rtypes.Transaction) {
+	debited := make(map[string]struct{})
+	for _, op := range tx.Operations {
+		if op.Type == OpTypeDebit.RType() {
+			debited[op.Account.Address] = struct{}{}
+		}
+	}
+
+	var change *rtypes.Operation
+	var nbCredits int
+	for _, op := range tx.Operations {
+		if op.Type != OpTypeCredit.RType() {
+			continue
+		}
+		nbCredits++
+		if _, ok := debited[op.Account.Address]; !ok {
+			continue
+		}
+		if change != nil {
+			// More than one candidate, so we can't reliably tell
+			// which one is change.
+			return
+		}
+		change = op
+	}
+
+	if change != nil && nbCredits > 1 {
+		change.Metadata["likely_change"] = true
+	}
+}
 
-	// Closure that builds the list of transactions/ops by iterating over
-	// the block's transactions.
+// addSubsidyType identifies which portion of the subsidy of block b is paid
+// by rop when it is a credit of the coinbase.
+func addSubsidyType(b *wire.MsgBlock, op *Op, rop *rtypes.Operation) {
+	if op.Tree != wire.TxTreeRegular || op.TxIndex != 0 || op.Type != OpTypeCredit {
+		return
+	}
+	height := int64(b.Header.Height)
+	if op.Status == OpStatusReversed {
+		height--
+	}
+	rop.Metadata["subsidy_type"] = coinbaseSubsidyType(height, op.IOIndex)
+}
+
+// StreamBlockOps calls cb for every operation of the given block in its
+// rosetta representation, in the same order and with the same contents as the
+// transactions returned by WireBlockToRosetta when using the default options.
+//
+// Unlike WireBlockToRosetta, operations are not accumulated: the tx passed to
+// cb only includes the identifier and metadata of the transaction, so callers
+// that only need to scan the operations of a block can do so with bounded
+// memory. The same tx is passed for every operation of a given transaction.
+func StreamBlockOps(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, cb func(tx *rtypes.Transaction, op *rtypes.Operation) error, chainParams *chaincfg.Params) error {
 	var tx *rtypes.Transaction
 	applyOp := func(op *Op) error {
 		if op.OpIndex == 0 {
 			// Starting a new transaction.
 			tx = txMetaToRosetta(op.Tx)
-			txs = append(txs, tx)
 		}
-		tx.Operations = append(tx.Operations, op.ROp())
-		return nil
+		rop := op.ROp()
+		addSubsidyType(b, op, rop)
+		return cb(tx, rop)
+	}
+	return IterateBlockOps(b, prev, fetchInputs, applyOp, chainParams)
+}
+
+// WireBlockToRosetta converts the given block in wire representation to the
+// block in rosetta representation. The previous block is needed when the
+// current block disapproved the regular transactions of the previous one, in
+// which case it must be specified or this function errors.
+//
+// A nil opts converts the block using the default options.
+func WireBlockToRosetta(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, chainParams *chaincfg.Params, opts *ConvertOpts) (*rtypes.Block, error) {
+	if opts == nil {
+		opts = &ConvertOpts{}
 	}
 
-	// Build the list of transactions.
-	err := IterateBlockOps(b, prev, fetchInputs, applyOp, chainParams)
+	approvesParent := VoteBitsApprovesParent(b.Header.VoteBits) || b.Header.Height == 0
+	txOps, err := blockTxOps(b, prev)
 	if err != nil {
 		return nil, err
 	}
+	fetchInputs, err = prefetchBlockInputs(txOps, fetchInputs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closure that converts a single transaction of the block. It returns
+	// nil if the transaction does not have any ops, unless empty txs are
+	// included.
+	convertTx := func(op *Op) (*rtypes.Transaction, error) {
+		var tx *rtypes.Transaction
+		var total dcrutil.Amount
+		applyOp := func(op *Op) error {
+			if op.OpIndex == 0 {
+				// Starting a new transaction.
+				tx = txMetaToRosetta(op.Tx)
+			}
+			if op.Type != OpTypeCommitment {
+				total += op.Amount
+			}
+			rop, err := appendROp(tx, op, opts)
+			if err != nil {
+				return err
+			}
+
+			addSubsidyType(b, op, rop)
+			return nil
+		}
+
+		err := iterateBlockOpsInTx(op, fetchInputs, applyOp, chainParams)
+		if err != nil {
+			return nil, err
+		}
+		if tx == nil && opts.IncludeEmptyTxs {
+			tx = txMetaToRosetta(op.Tx)
+		}
+
+		if tx != nil && opts.IncludeRawTx {
+			if err := addRawTx(tx, op.Tx); err != nil {
+				return nil, err
+			}
+		}
+
+		isCoinbase := op.Tree == wire.TxTreeRegular && op.TxIndex == 0
+		if tx != nil && opts.FeeOps && !isCoinbase && total != 0 {
+			appendFeeOp(tx, op.Status, total)
+		}
+
+		if tx != nil && opts.LikelyChange && op.Tree == wire.TxTreeRegular && op.TxIndex > 0 {
+			markLikelyChange(tx)
+		}
+		if tx != nil && opts.RelatedOps && len(tx.Operations) > 1 {
+			linkRelatedOps(tx)
+		}
+		if tx != nil && len(opts.OmitOpMetadata) > 0 {
+			omitOpMetadata(tx, opts.OmitOpMetadata)
+		}
+		return tx, nil
+	}
+
+	// Convert the transactions. Each transaction is independent of the
+	// others, so they can be converted concurrently as long as the
+	// original order is preserved when assembling the final list.
+	convTxs := make([]*rtypes.Transaction, len(txOps))
+	if opts.Concurrency > 1 {
+		g := new(errgroup.Group)
+		sem := make(chan struct{}, opts.Concurrency)
+		for i := range txOps {
+			i := i
+			sem <- struct{}{}
+			g.Go(func() error {
+				defer func() { <-sem }()
+				var err error
+				convTxs[i], err = convertTx(&txOps[i])
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := range txOps {
+			if convTxs[i], err = convertTx(&txOps[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Build the list of transactions, skipping the ones that were not
+	// converted.
+	txs := make([]*rtypes.Transaction, 0, len(convTxs))
+	for _, tx := range convTxs {
+		if tx != nil {
+			txs = append(txs, tx)
+		}
+	}
 
 	blockHash := b.Header.BlockHash()
 	prevHeight := b.Header.Height - 1
@@ -400,18 +1061,45 @@ func WireBlockToRosetta(b, prev *wire.MsgBlock, fetchInputs PrevInputsFetcher, c
 			"vote_bits":       b.Header.VoteBits,
 			"bits":            b.Header.Bits,
 			"sbits":           b.Header.SBits,
+			"subsidy":         blockSubsidyMeta(&b.Header, chainParams),
 		},
 	}
+	if !approvesParent {
+		// List the regular transactions of the parent that were
+		// reversed by this block.
+		disapproved := make([]string, len(prev.Transactions))
+		for i, tx := range prev.Transactions {
+			disapproved[i] = tx.TxHash().String()
+		}
+		r.Metadata["disapproved_txs"] = disapproved
+	}
+	if opts.IncludeHeaderHex {
+		header, err := b.Header.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		r.Metadata["header"] = hex.EncodeToString(header)
+	}
 	return r, nil
 }
 
 // MempoolTxToRosetta converts a wire tx that is known to be on the mempool to
 // a rosetta tx.
-func MempoolTxToRosetta(tx *wire.MsgTx, fetchInputs PrevInputsFetcher, chainParams *chaincfg.Params) (*rtypes.Transaction, error) {
+//
+// A nil opts converts the tx using the default options.
+func MempoolTxToRosetta(tx *wire.MsgTx, fetchInputs PrevInputsFetcher, chainParams *chaincfg.Params, opts *ConvertOpts) (*rtypes.Transaction, error) {
+	if opts == nil {
+		opts = &ConvertOpts{}
+	}
+
 	rtx := txMetaToRosetta(tx)
+	var total dcrutil.Amount
 	applyOp := func(op *Op) error {
-		rtx.Operations = append(rtx.Operations, op.ROp())
-		return nil
+		if op.Type != OpTypeCommitment {
+			total += op.Amount
+		}
+		_, err := appendROp(rtx, op, opts)
+		return err
 	}
 
 	txType := stake.DetermineTxType(tx)
@@ -423,6 +1111,7 @@ func MempoolTxToRosetta(tx *wire.MsgTx, fetchInputs PrevInputsFetcher, chainPara
 	op := Op{
 		Tree:   tree,
 		Status: OpStatusSuccess,
+		Tx:     tx,
 
 		// Coinbase txs are never seen on the mempool so it's safe to
 		// use a negative txidx.
@@ -434,5 +1123,17 @@ func MempoolTxToRosetta(tx *wire.MsgTx, fetchInputs PrevInputsFetcher, chainPara
 		return nil, err
 	}
 
+	if opts.IncludeRawTx {
+		if err := addRawTx(rtx, tx); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FeeOps && total != 0 {
+		appendFeeOp(rtx, OpStatusSuccess, total)
+	}
+	if len(opts.OmitOpMetadata) > 0 {
+		omitOpMetadata(rtx, opts.OmitOpMetadata)
+	}
+
 	return rtx, nil
 }
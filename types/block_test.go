@@ -0,0 +1,2213 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/blockchain/stake/v3"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/txscript/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// testAccount returns the address of a test account identified by id.
+func testAccount(tb testing.TB, id uint16, params *chaincfg.Params) dcrutil.Address {
+	tb.Helper()
+	hash := make([]byte, 20)
+	binary.LittleEndian.PutUint16(hash, id)
+	addr, err := dcrutil.NewAddressScriptHashFromHash(hash, params)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return addr
+}
+
+// testPkScript returns a script that pays to the test account identified by
+// id.
+func testPkScript(tb testing.TB, id uint16, params *chaincfg.Params) []byte {
+	tb.Helper()
+	pkScript, err := txscript.PayToAddrScript(testAccount(tb, id, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pkScript
+}
+
+// testCoinbase returns a coinbase for a block at the given height that pays
+// value to the test account identified by payTo.
+func testCoinbase(tb testing.TB, height uint32, payTo uint16, value int64, params *chaincfg.Params) *wire.MsgTx {
+	tb.Helper()
+	sigScript := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sigScript, height)
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex, wire.TxTreeRegular), value, sigScript))
+	tx.AddTxOut(wire.NewTxOut(value, testPkScript(tb, payTo, params)))
+	return tx
+}
+
+// testInputs tracks the outputs that test txs may spend and serves them as
+// the previous inputs of blocks.
+type testInputs map[wire.OutPoint]*PrevInput
+
+// fund adds an output of value paying to the test account identified by id,
+// which is not created by any tx of the test blocks, and returns its
+// outpoint.
+func (ti testInputs) fund(tb testing.TB, id uint16, value int64, params *chaincfg.Params) wire.OutPoint {
+	tb.Helper()
+	var hash chainhash.Hash
+	binary.LittleEndian.PutUint32(hash[:], uint32(len(ti)+1))
+	outp := *wire.NewOutPoint(&hash, 0, wire.TxTreeRegular)
+	ti[outp] = &PrevInput{
+		PkScript: testPkScript(tb, id, params),
+		Amount:   dcrutil.Amount(value),
+	}
+	return outp
+}
+
+func (ti testInputs) fetch(outpoints ...*wire.OutPoint) (map[wire.OutPoint]*PrevInput, error) {
+	res := make(map[wire.OutPoint]*PrevInput, len(outpoints))
+	for _, outp := range outpoints {
+		if prevInput, ok := ti[*outp]; ok {
+			res[*outp] = prevInput
+		}
+	}
+	return res, nil
+}
+
+// testSpendTx returns a tx spending the given outpoint and paying the given
+// values to the test accounts identified by payTo.
+func testSpendTx(tb testing.TB, outp wire.OutPoint, payTo []uint16, values []int64, params *chaincfg.Params) *wire.MsgTx {
+	tb.Helper()
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&outp, 0, nil))
+	for i, id := range payTo {
+		tx.AddTxOut(wire.NewTxOut(values[i], testPkScript(tb, id, params)))
+	}
+	return tx
+}
+
+// testTicketTx returns a ticket spending the given outpoint, which locks
+// value in a stake submission output paying to the test account identified by
+// submitTo and commits the full amount of the input to the test account
+// identified by commitTo.
+func testTicketTx(tb testing.TB, outp wire.OutPoint, inValue, value int64, submitTo, commitTo uint16, params *chaincfg.Params) *wire.MsgTx {
+	tb.Helper()
+	submission, err := txscript.PayToSStx(testAccount(tb, submitTo, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	commitment, err := txscript.GenerateSStxAddrPush(testAccount(tb,
+		commitTo, params), dcrutil.Amount(inValue), 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	change, err := txscript.PayToSStxChange(testAccount(tb, commitTo, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&outp, inValue, nil))
+	tx.AddTxOut(wire.NewTxOut(value, submission))
+	tx.AddTxOut(wire.NewTxOut(0, commitment))
+	tx.AddTxOut(wire.NewTxOut(0, change))
+	return tx
+}
+
+// testVoteTx returns a vote of the given ticket on the block with the given
+// hash and height, which pays value to the test account identified by payTo.
+func testVoteTx(tb testing.TB, ticket wire.OutPoint, votedHash chainhash.Hash, votedHeight uint32, payTo uint16, value int64, params *chaincfg.Params) *wire.MsgTx {
+	tb.Helper()
+	blockRef, err := txscript.GenerateSSGenBlockRef(votedHash, votedHeight)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	votes, err := txscript.GenerateSSGenVotes(1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	payment, err := txscript.PayToSSGen(testAccount(tb, payTo, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex, wire.TxTreeRegular), 0, nil))
+	tx.AddTxIn(wire.NewTxIn(&ticket, 0, nil))
+	tx.AddTxOut(wire.NewTxOut(0, blockRef))
+	tx.AddTxOut(wire.NewTxOut(0, votes))
+	tx.AddTxOut(wire.NewTxOut(value, payment))
+	return tx
+}
+
+// testRevokeTx returns a revocation of the given ticket, which pays value to
+// the test account identified by payTo.
+func testRevokeTx(tb testing.TB, ticket wire.OutPoint, payTo uint16, value int64, params *chaincfg.Params) *wire.MsgTx {
+	tb.Helper()
+	payment, err := txscript.PayToSSRtx(testAccount(tb, payTo, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&ticket, 0, nil))
+	tx.AddTxOut(wire.NewTxOut(value, payment))
+	return tx
+}
+
+// fundTicket adds a stake submission output of value paying to the test
+// account identified by id, which may be spent by votes and revocations, and
+// returns its outpoint.
+func (ti testInputs) fundTicket(tb testing.TB, id uint16, value int64, params *chaincfg.Params) wire.OutPoint {
+	tb.Helper()
+	pkScript, err := txscript.PayToSStx(testAccount(tb, id, params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var hash chainhash.Hash
+	binary.LittleEndian.PutUint32(hash[:], uint32(len(ti)+1))
+	outp := *wire.NewOutPoint(&hash, 0, wire.TxTreeStake)
+	ti[outp] = &PrevInput{
+		PkScript: pkScript,
+		Amount:   dcrutil.Amount(value),
+	}
+	return outp
+}
+
+// testBlock returns a block at the given height with the given regular txs.
+// The parent is set to prev, when specified.
+func testBlock(height uint32, prev *wire.MsgBlock, approvesParent bool, txs ...*wire.MsgTx) *wire.MsgBlock {
+	var voteBits uint16
+	if approvesParent {
+		voteBits = 1
+	}
+	b := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   1,
+			VoteBits:  voteBits,
+			Height:    height,
+			Timestamp: time.Unix(1600000000+int64(height)*300, 0),
+		},
+		Transactions: txs,
+	}
+	if prev != nil {
+		b.Header.PrevBlock = prev.BlockHash()
+	}
+	return b
+}
+
+// testDenseBlocks returns a block with nbTxs fee-paying txs followed by a
+// block that disapproves it and includes nbTxs other fee-paying txs.
+func testDenseBlocks(tb testing.TB, nbTxs int, params *chaincfg.Params) (prev, b *wire.MsgBlock, inputs testInputs) {
+	tb.Helper()
+	inputs = make(testInputs)
+	makeTxs := func(height uint32) []*wire.MsgTx {
+		txs := []*wire.MsgTx{testCoinbase(tb, height, 0, 10e8, params)}
+		for i := 0; i < nbTxs; i++ {
+			id := uint16(i + 1)
+			outp := inputs.fund(tb, id, 10e8, params)
+			txs = append(txs, testSpendTx(tb, outp,
+				[]uint16{id + 1000, id}, []int64{6e8, 3e8}, params))
+		}
+		return txs
+	}
+	prev = testBlock(2, nil, true, makeTxs(2)...)
+	b = testBlock(3, prev, false, makeTxs(3)...)
+	return prev, b, inputs
+}
+
+// TestWireBlockToRosettaConcurrency ensures blocks converted concurrently are
+// identical to blocks converted serially, including blocks that disapprove
+// their parent.
+func TestWireBlockToRosettaConcurrency(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	prev, b, inputs := testDenseBlocks(t, 50, params)
+
+	// Enable every option that changes the converted txs.
+	opts := ConvertOpts{
+		LikelyChange:      true,
+		RelatedOps:        true,
+		StakedSubAccount:  true,
+		RedeemScriptClass: true,
+		AccountPkScript:   true,
+		IncludeEmptyTxs:   true,
+		IncludeRawTx:      true,
+		FeeOps:            true,
+	}
+
+	serialOpts := opts
+	serialOpts.Concurrency = 1
+	want, err := WireBlockToRosetta(b, prev, inputs.fetch, params, &serialOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reversed txs of the parent, then the regular txs of the block.
+	if len(want.Transactions) != 2*(50+1) {
+		t.Fatalf("unexpected number of txs: got %d, want %d",
+			len(want.Transactions), 2*(50+1))
+	}
+
+	for _, concurrency := range []int{2, 4, 16, 200} {
+		concurrentOpts := opts
+		concurrentOpts.Concurrency = concurrency
+		got, err := WireBlockToRosetta(b, prev, inputs.fetch, params,
+			&concurrentOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("concurrency %d: converted block differs from "+
+				"the serially converted block", concurrency)
+		}
+	}
+}
+
+// BenchmarkWireBlockToRosetta benchmarks converting a dense block that
+// disapproves its parent, serially and concurrently.
+func BenchmarkWireBlockToRosetta(b *testing.B) {
+	params := chaincfg.RegNetParams()
+	prev, blk, inputs := testDenseBlocks(b, 1000, params)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		opts := &ConvertOpts{
+			RelatedOps:  true,
+			Concurrency: concurrency,
+		}
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := WireBlockToRosetta(blk, prev, inputs.fetch,
+					params, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPrevInputsFetch benchmarks iterating over the ops of a dense block
+// that disapproves its parent when fetching the previous inputs of the whole
+// block in a single batch, compared to fetching them separately for each tx,
+// with a fixed latency per fetch.
+func BenchmarkPrevInputsFetch(b *testing.B) {
+	const latency = 100 * time.Microsecond
+	params := chaincfg.RegNetParams()
+	prev, blk, inputs := testDenseBlocks(b, 100, params)
+
+	var nbFetches int
+	fetchInputs := func(outpoints ...*wire.OutPoint) (map[wire.OutPoint]*PrevInput, error) {
+		nbFetches++
+		time.Sleep(latency)
+		return inputs.fetch(outpoints...)
+	}
+	applyOp := func(*Op) error { return nil }
+
+	tests := []struct {
+		name    string
+		iterate func() error
+	}{{
+		name: "batch",
+		iterate: func() error {
+			return IterateBlockOps(blk, prev, fetchInputs, applyOp,
+				params)
+		},
+	}, {
+		name: "per tx",
+		iterate: func() error {
+			txOps, err := blockTxOps(blk, prev)
+			if err != nil {
+				return err
+			}
+			for i := range txOps {
+				err := iterateBlockOpsInTx(&txOps[i], fetchInputs,
+					applyOp, params)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}}
+
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			nbFetches = 0
+			for i := 0; i < b.N; i++ {
+				if err := tc.iterate(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(nbFetches)/float64(b.N), "fetches/op")
+		})
+	}
+}
+
+// TestReversedTxOps ensures the operations of the transactions of a
+// disapproved block are reversed in the order their effects must be undone,
+// with contiguous indices and negated amounts, including their fees.
+func TestReversedTxOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	acct := func(id uint16) string {
+		return testAccount(t, id, params).Address()
+	}
+
+	// The parent includes two fee-paying txs: one with a change output
+	// and one spending two inputs.
+	tx1 := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{11, 1}, []int64{6e8, 3e8}, params)
+	tx2 := testSpendTx(t, inputs.fund(t, 2, 5e8, params),
+		[]uint16{22}, []int64{8.5e8}, params)
+	outp := inputs.fund(t, 3, 4e8, params)
+	tx2.AddTxIn(wire.NewTxIn(&outp, 0, nil))
+
+	// Subsidy of regnet blocks before stake validation height, which
+	// includes the work and treasury portions.
+	const subsidy = 30000000000 + 5000000000
+	prev := testBlock(2, nil, true, testCoinbase(t, 2, 0, subsidy, params),
+		tx1, tx2)
+	b := testBlock(3, prev, false, testCoinbase(t, 3, 0, subsidy, params))
+
+	type testOp struct {
+		opType  OpType
+		status  OpStatus
+		account string
+		amount  int64
+	}
+	wantTxs := [][]testOp{{
+		// Parent coinbase.
+		{OpTypeCredit, OpStatusReversed, acct(0), -subsidy},
+		{OpTypeSubsidy, OpStatusReversed, "", subsidy},
+	}, {
+		// Outputs are reversed before inputs.
+		{OpTypeCredit, OpStatusReversed, acct(11), -6e8},
+		{OpTypeCredit, OpStatusReversed, acct(1), -3e8},
+		{OpTypeDebit, OpStatusReversed, acct(1), 10e8},
+		{OpTypeFee, OpStatusReversed, FeeAccount, -1e8},
+	}, {
+		{OpTypeCredit, OpStatusReversed, acct(22), -8.5e8},
+		{OpTypeDebit, OpStatusReversed, acct(2), 5e8},
+		{OpTypeDebit, OpStatusReversed, acct(3), 4e8},
+		{OpTypeFee, OpStatusReversed, FeeAccount, -0.5e8},
+	}, {
+		// Coinbase of the disapproving block.
+		{OpTypeCredit, OpStatusSuccess, acct(0), subsidy},
+		{OpTypeSubsidy, OpStatusSuccess, "", -subsidy},
+	}}
+	wantHashes := []chainhash.Hash{
+		prev.Transactions[0].TxHash(),
+		tx1.TxHash(),
+		tx2.TxHash(),
+		b.Transactions[0].TxHash(),
+	}
+
+	opts := &ConvertOpts{FeeOps: true}
+	rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rb.Transactions) != len(wantTxs) {
+		t.Fatalf("unexpected number of txs: got %d, want %d",
+			len(rb.Transactions), len(wantTxs))
+	}
+
+	for i, tx := range rb.Transactions {
+		if tx.TransactionIdentifier.Hash != wantHashes[i].String() {
+			t.Fatalf("tx %d: unexpected hash: got %s, want %s", i,
+				tx.TransactionIdentifier.Hash, wantHashes[i])
+		}
+		wantOps := wantTxs[i]
+		if len(tx.Operations) != len(wantOps) {
+			t.Fatalf("tx %d: unexpected number of ops: got %d, "+
+				"want %d", i, len(tx.Operations), len(wantOps))
+		}
+
+		var total int64
+		for j, op := range tx.Operations {
+			want := wantOps[j]
+			if op.OperationIdentifier.Index != int64(j) {
+				t.Fatalf("tx %d op %d: unexpected index %d", i, j,
+					op.OperationIdentifier.Index)
+			}
+			if op.Type != want.opType.RType() {
+				t.Fatalf("tx %d op %d: unexpected type: got %s, "+
+					"want %s", i, j, op.Type, want.opType.RType())
+			}
+			if op.Status != string(want.status) {
+				t.Fatalf("tx %d op %d: unexpected status: got %s, "+
+					"want %s", i, j, op.Status, want.status)
+			}
+			var account string
+			if op.Account != nil {
+				account = op.Account.Address
+			}
+			if account != want.account {
+				t.Fatalf("tx %d op %d: unexpected account: got %q, "+
+					"want %q", i, j, account, want.account)
+			}
+			wantAmount := fmt.Sprintf("%d", want.amount)
+			if op.Amount.Value != wantAmount {
+				t.Fatalf("tx %d op %d: unexpected amount: got %s, "+
+					"want %s", i, j, op.Amount.Value, wantAmount)
+			}
+			total += want.amount
+		}
+
+		// The operations of every tx, including the fee, balance out.
+		if total != 0 {
+			t.Fatalf("tx %d: unbalanced ops: total %d", i, total)
+		}
+	}
+
+	// Applying the ops of the block must undo the balance changes of
+	// the parent txs.
+	balances := make(map[string]dcrutil.Amount)
+	applyOp := func(op *Op) error {
+		if op.Type != OpTypeSubsidy {
+			balances[op.Account] += op.Amount
+		}
+		return nil
+	}
+	err = IterateBlockOps(prev, nil, inputs.fetch, applyOp, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IterateBlockOps(b, prev, inputs.fetch, applyOp, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBalances := map[string]dcrutil.Amount{
+		acct(0): subsidy, acct(1): 0, acct(2): 0, acct(3): 0,
+		acct(11): 0, acct(22): 0,
+	}
+	if !reflect.DeepEqual(balances, wantBalances) {
+		t.Fatalf("unexpected balances: got %v, want %v", balances,
+			wantBalances)
+	}
+}
+
+// TestOpOrderGolden pins the order and indices of the operations generated
+// for every kind of transaction, which clients persist keyed by transaction
+// hash and operation index and therefore must not change across versions.
+func TestOpOrderGolden(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	// The parent includes a tx with a zero-valued output between its
+	// credits, which is reversed by the disapproving block.
+	nullData := []byte{txscript.OP_RETURN, txscript.OP_DATA_4, 0xde, 0xad,
+		0xbe, 0xef}
+	txA := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{11, 12}, []int64{6e8, 3e8}, params)
+	txA.TxOut = append([]*wire.TxOut{wire.NewTxOut(0, nullData)}, txA.TxOut...)
+	outp := inputs.fund(t, 2, 5e8, params)
+	txA.AddTxIn(wire.NewTxIn(&outp, 0, nil))
+	prev := testBlock(199, nil, true, testCoinbase(t, 199, 0, 1e8, params),
+		txA)
+
+	txB := testSpendTx(t, inputs.fund(t, 3, 4e8, params), []uint16{13},
+		[]int64{3.5e8}, params)
+	ticket := testTicketTx(t, inputs.fund(t, 4, 5e8, params), 5e8, 4.9e8,
+		21, 22, params)
+	vote := testVoteTx(t, inputs.fundTicket(t, 31, 2e8, params),
+		prev.BlockHash(), 199, 32, 3e8, params)
+	b := testBlock(200, prev, false, testCoinbase(t, 200, 0, 1e8, params),
+		txB)
+	b.STransactions = []*wire.MsgTx{ticket, vote}
+
+	// Every op is described as "index type status io account", where io
+	// is the index of the input or output of the op.
+	acct := func(id uint16) string {
+		return testAccount(t, id, params).Address()
+	}
+	wantTxs := []struct {
+		hash chainhash.Hash
+		ops  []string
+	}{{
+		hash: prev.Transactions[0].TxHash(),
+		ops: []string{
+			"0 credit reversed 0 " + acct(0),
+			"1 subsidy reversed 0 ",
+		},
+	}, {
+		hash: txA.TxHash(),
+		ops: []string{
+			"0 credit reversed 1 " + acct(11),
+			"1 credit reversed 2 " + acct(12),
+			"2 debit reversed 0 " + acct(1),
+			"3 debit reversed 1 " + acct(2),
+		},
+	}, {
+		hash: b.Transactions[0].TxHash(),
+		ops: []string{
+			"0 credit success 0 " + acct(0),
+			"1 subsidy success 0 ",
+		},
+	}, {
+		hash: txB.TxHash(),
+		ops: []string{
+			"0 debit success 0 " + acct(3),
+			"1 credit success 0 " + acct(13),
+		},
+	}, {
+		hash: ticket.TxHash(),
+		ops: []string{
+			"0 debit success 0 " + acct(4),
+			"1 credit success 0 " + acct(21),
+			"2 commitment success 1 " + acct(22),
+		},
+	}, {
+		hash: vote.TxHash(),
+		ops: []string{
+			"0 debit success 1 " + acct(31),
+			"1 credit success 2 " + acct(32),
+			"2 subsidy success 0 ",
+		},
+	}}
+
+	rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rb.Transactions) != len(wantTxs) {
+		t.Fatalf("unexpected number of txs: got %d, want %d",
+			len(rb.Transactions), len(wantTxs))
+	}
+	for i, tx := range rb.Transactions {
+		want := wantTxs[i]
+		if tx.TransactionIdentifier.Hash != want.hash.String() {
+			t.Fatalf("tx %d: unexpected hash: got %s, want %s", i,
+				tx.TransactionIdentifier.Hash, want.hash)
+		}
+		gotOps := make([]string, 0, len(tx.Operations))
+		for _, op := range tx.Operations {
+			io := op.Metadata["output_index"]
+			if op.Type == OpTypeDebit.RType() || op.Type == OpTypeSubsidy.RType() {
+				io = op.Metadata["input_index"]
+			}
+			var account string
+			if op.Account != nil {
+				account = op.Account.Address
+			}
+			gotOps = append(gotOps, fmt.Sprintf("%d %s %s %d %s",
+				op.OperationIdentifier.Index, op.Type, op.Status,
+				io, account))
+		}
+		if !reflect.DeepEqual(gotOps, want.ops) {
+			t.Fatalf("tx %d: unexpected ops:\ngot  %q\nwant %q", i,
+				gotOps, want.ops)
+		}
+	}
+}
+
+// TestRawPkScriptToAccountAddr ensures scripts that can't be represented by a
+// single address are encoded as raw account addresses tagged with their
+// version and script class, while version 0 single address scripts keep
+// using the address.
+func TestRawPkScriptToAccountAddr(t *testing.T) {
+	params := chaincfg.MainNetParams()
+	const (
+		p2pkh   = "76a914000000000000000000000000000000000000000088ac"
+		pubKeyG = "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	)
+	mustHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		version  uint16
+		pkScript string
+		want     string
+	}{{
+		name:     "nulldata",
+		pkScript: "6a04deadbeef",
+		want:     "0x0000056a04deadbeef",
+	}, {
+		name:     "nonstandard",
+		pkScript: "51",
+		want:     "0x00000051",
+	}, {
+		name:     "multisig",
+		pkScript: "5121" + pubKeyG + "51ae",
+		want:     "0x0000045121" + pubKeyG + "51ae",
+	}, {
+		name:     "stake submission",
+		pkScript: "ba" + p2pkh,
+		want:     "0x000006ba" + p2pkh,
+	}, {
+		name:     "stake generation",
+		pkScript: "bb" + p2pkh,
+		want:     "0x000007bb" + p2pkh,
+	}, {
+		name:     "stake revocation",
+		pkScript: "bc" + p2pkh,
+		want:     "0x000008bc" + p2pkh,
+	}, {
+		name:     "stake change",
+		pkScript: "bd" + p2pkh,
+		want:     "0x000009bd" + p2pkh,
+	}, {
+		name:     "version 1 p2pkh",
+		version:  1,
+		pkScript: p2pkh,
+		want:     "0x000100" + p2pkh,
+	}}
+
+	for _, tc := range tests {
+		got := rawPkScriptToAccountAddr(tc.version, mustHex(tc.pkScript))
+		if got != tc.want {
+			t.Fatalf("%s: unexpected account: got %s, want %s",
+				tc.name, got, tc.want)
+		}
+		if !IsRawAccountAddr(got) {
+			t.Fatalf("%s: account not recognized as raw", tc.name)
+		}
+	}
+
+	// Version 0 scripts that pay to a single address keep using it.
+	pkScript := mustHex(p2pkh)
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(0, pkScript, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dcrPkScriptToAccountAddr(0, pkScript, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := addrs[0].Address(); got != want {
+		t.Fatalf("unexpected p2pkh account: got %s, want %s", got, want)
+	}
+	if IsRawAccountAddr(got) {
+		t.Fatalf("p2pkh account %s recognized as raw", got)
+	}
+
+	// Version 0 scripts that don't pay to a single address use the raw
+	// encoding.
+	got, err = dcrPkScriptToAccountAddr(0, mustHex("6a04deadbeef"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0x0000056a04deadbeef"; got != want {
+		t.Fatalf("unexpected nulldata account: got %s, want %s", got, want)
+	}
+}
+
+// TestMultisigAccountAddr ensures bare multisig scripts are credited to an
+// account derived from their sorted keys, which does not depend on the order
+// of the keys in the script, and that only the canonical encoding of such
+// accounts is accepted.
+func TestMultisigAccountAddr(t *testing.T) {
+	params := chaincfg.MainNetParams()
+	pubKeys := []string{
+		"0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5",
+		"02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+	}
+	keys := make([]*dcrutil.AddressSecpPubKey, len(pubKeys))
+	for i, s := range pubKeys {
+		pk, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i], err = dcrutil.NewAddressSecpPubKey(pk, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Helper to return the account of a 2-of-3 multisig script with the
+	// keys in the given order.
+	account := func(order ...int) string {
+		t.Helper()
+		ordered := make([]*dcrutil.AddressSecpPubKey, len(order))
+		for i, j := range order {
+			ordered[i] = keys[j]
+		}
+		pkScript, err := txscript.MultiSigScript(ordered, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := dcrPkScriptToAccountAddr(0, pkScript, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	saddrs := make([]string, len(keys))
+	for i, key := range keys {
+		saddrs[i] = key.Address()
+	}
+	sort.Strings(saddrs)
+	want := "multisig:2-of-3:" + strings.Join(saddrs, ",")
+	got := account(0, 1, 2)
+	if got != want {
+		t.Fatalf("unexpected account: got %s, want %s", got, want)
+	}
+	parts := strings.Split(strings.TrimPrefix(got, "multisig:2-of-3:"), ",")
+	if !sort.StringsAreSorted(parts) {
+		t.Fatalf("account addresses are not sorted: %s", got)
+	}
+	if !IsMultisigAccountAddr(got, params) {
+		t.Fatalf("account %s not recognized as multisig", got)
+	}
+
+	// The order of the keys doesn't change the account.
+	orders := [][]int{{0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	for _, order := range orders {
+		if got := account(order...); got != want {
+			t.Fatalf("unexpected account with keys in order %v: got "+
+				"%s, want %s", order, got, want)
+		}
+	}
+
+	// Non-canonical or invalid encodings are rejected.
+	unsorted := []string{saddrs[1], saddrs[0], saddrs[2]}
+	invalid := []struct {
+		name string
+		addr string
+	}{
+		{"unsorted", "multisig:2-of-3:" + strings.Join(unsorted, ",")},
+		{"padded counts", "multisig:02-of-3:" + strings.Join(saddrs, ",")},
+		{"wrong key count", "multisig:2-of-4:" + strings.Join(saddrs, ",")},
+		{"missing key", "multisig:2-of-3:" + strings.Join(saddrs[:2], ",")},
+		{"too many sigs", "multisig:4-of-3:" + strings.Join(saddrs, ",")},
+		{"no sigs", "multisig:0-of-3:" + strings.Join(saddrs, ",")},
+		{"trailing data", want + ","},
+		{"invalid address", "multisig:1-of-1:Dk000"},
+		{"missing prefix", strings.TrimPrefix(want, "multisig:")},
+		{"other network", "multisig:1-of-1:" + testAccount(t, 1,
+			chaincfg.TestNet3Params()).Address()},
+	}
+	for _, tc := range invalid {
+		if IsMultisigAccountAddr(tc.addr, params) {
+			t.Fatalf("%s: non-canonical account %s accepted", tc.name,
+				tc.addr)
+		}
+	}
+}
+
+// TestAppendROpNonContiguous ensures operations are only appended to a
+// transaction when their index follows the last operation of the transaction.
+func TestAppendROpNonContiguous(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	tx := testSpendTx(t, wire.OutPoint{}, []uint16{1, 2, 3},
+		[]int64{1e8, 2e8, 3e8}, params)
+
+	tests := []struct {
+		name     string
+		existing int
+		opIndex  int64
+		wantErr  error
+	}{{
+		name:    "first op",
+		opIndex: 0,
+	}, {
+		name:     "next op",
+		existing: 2,
+		opIndex:  2,
+	}, {
+		name:    "first op skips index",
+		opIndex: 1,
+		wantErr: ErrNonContiguousOps,
+	}, {
+		name:     "gap after existing ops",
+		existing: 1,
+		opIndex:  2,
+		wantErr:  ErrNonContiguousOps,
+	}, {
+		name:     "repeated index",
+		existing: 2,
+		opIndex:  1,
+		wantErr:  ErrNonContiguousOps,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rtx := txMetaToRosetta(tx)
+			op := &Op{
+				Tx:      tx,
+				Type:    OpTypeCredit,
+				Status:  OpStatusSuccess,
+				Account: testAccount(t, 1, params).Address(),
+			}
+			for i := 0; i < tc.existing; i++ {
+				op.OpIndex = int64(i)
+				op.IOIndex = i
+				op.Out = tx.TxOut[i]
+				if _, err := appendROp(rtx, op, &ConvertOpts{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			op.OpIndex = tc.opIndex
+			op.IOIndex = tc.existing
+			op.Out = tx.TxOut[tc.existing]
+			_, err := appendROp(rtx, op, &ConvertOpts{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err,
+					tc.wantErr)
+			}
+			wantLen := tc.existing
+			if tc.wantErr == nil {
+				wantLen++
+			}
+			if len(rtx.Operations) != wantLen {
+				t.Fatalf("unexpected number of ops: got %d, want %d",
+					len(rtx.Operations), wantLen)
+			}
+		})
+	}
+}
+
+// TestTxTreeMismatch ensures blocks with stake transactions in the regular
+// tree or regular transactions in the stake tree are rejected.
+func TestTxTreeMismatch(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	regular := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2}, []int64{9e8}, params)
+	ticket := testTicketTx(t, inputs.fund(t, 3, 5e8, params), 5e8, 4.9e8,
+		4, 5, params)
+
+	tests := []struct {
+		name    string
+		txs     []*wire.MsgTx
+		stxs    []*wire.MsgTx
+		wantErr error
+	}{{
+		name: "txs in their trees",
+		txs:  []*wire.MsgTx{regular},
+		stxs: []*wire.MsgTx{ticket},
+	}, {
+		name:    "ticket in regular tree",
+		txs:     []*wire.MsgTx{regular, ticket},
+		wantErr: ErrTxTreeMismatch,
+	}, {
+		name:    "regular tx in stake tree",
+		stxs:    []*wire.MsgTx{ticket, regular},
+		wantErr: ErrTxTreeMismatch,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			txs := append([]*wire.MsgTx{testCoinbase(t, 2, 0, 1e8, params)},
+				tc.txs...)
+			b := testBlock(2, nil, true, txs...)
+			b.STransactions = tc.stxs
+
+			applyOp := func(*Op) error { return nil }
+			err := IterateBlockOps(b, nil, inputs.fetch, applyOp, params)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected iteration error: got %v, "+
+					"want %v", err, tc.wantErr)
+			}
+			_, err = WireBlockToRosetta(b, nil, inputs.fetch, params, nil)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("unexpected conversion error: got %v, "+
+					"want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestVoteOps ensures votes debit the ticket from the staked sub-account,
+// credit the vote payment and redeem the stakebase subsidy of the voted block
+// as their last operation.
+func TestVoteOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	ticketOut := inputs.fundTicket(t, 1, 2e8, params)
+
+	tests := []struct {
+		name        string
+		height      uint32
+		wantSubsidy dcrutil.Amount
+	}{{
+		name:        "before stake validation height",
+		height:      10,
+		wantSubsidy: 0,
+	}, {
+		name:        "after stake validation height",
+		height:      200,
+		wantSubsidy: calcStakeVoteSubsidy(200, params),
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prev := testBlock(tc.height-1, nil, true,
+				testCoinbase(t, tc.height-1, 0, 1e8, params))
+			vote := testVoteTx(t, ticketOut, prev.BlockHash(),
+				tc.height-1, 2, 3e8, params)
+			b := testBlock(tc.height, prev, true,
+				testCoinbase(t, tc.height, 0, 1e8, params))
+			b.STransactions = []*wire.MsgTx{vote}
+
+			opts := &ConvertOpts{StakedSubAccount: true}
+			rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rtx := rb.Transactions[len(rb.Transactions)-1]
+			if rtx.TransactionIdentifier.Hash != vote.TxHash().String() {
+				t.Fatalf("vote is not the last tx of the block")
+			}
+			if len(rtx.Operations) != 3 {
+				t.Fatalf("unexpected number of ops: got %d, want 3",
+					len(rtx.Operations))
+			}
+
+			debit, credit, subsidy := rtx.Operations[0],
+				rtx.Operations[1], rtx.Operations[2]
+			ticketHash := ticketOut.Hash.String()
+			if debit.Type != OpTypeDebit.RType() ||
+				debit.Account.Address != testAccount(t, 1, params).Address() ||
+				debit.Account.SubAccount == nil ||
+				debit.Account.SubAccount.Address != SubAccountStaked ||
+				debit.Amount.Value != "-200000000" ||
+				debit.Metadata["ticket_hash"] != ticketHash {
+				t.Fatalf("unexpected ticket debit: %+v %+v", debit,
+					debit.Account)
+			}
+			if credit.Type != OpTypeCredit.RType() ||
+				credit.Account.Address != testAccount(t, 2, params).Address() ||
+				credit.Account.SubAccount != nil ||
+				credit.Amount.Value != "300000000" {
+				t.Fatalf("unexpected vote payment: %+v %+v", credit,
+					credit.Account)
+			}
+			wantAmount := fmt.Sprintf("%d", -tc.wantSubsidy)
+			if subsidy.Type != OpTypeSubsidy.RType() ||
+				subsidy.Account != nil ||
+				subsidy.Amount.Value != wantAmount ||
+				subsidy.Metadata["subsidy_source"] != "stakebase" ||
+				subsidy.Metadata["input_index"] != 0 {
+				t.Fatalf("unexpected subsidy: got %+v, want amount %s",
+					subsidy, wantAmount)
+			}
+		})
+	}
+}
+
+// TestCoinbaseSubsidyOps ensures coinbases redeem the work and treasury
+// portions of the subsidy of their block, reduced by missing voters once
+// voting begins, as their last operation.
+func TestCoinbaseSubsidyOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+
+	tests := []struct {
+		name        string
+		height      uint32
+		voters      uint16
+		wantSubsidy int64 // Zero when no subsidy op is expected.
+	}{{
+		name:   "genesis",
+		height: 0,
+	}, {
+		name:        "block one",
+		height:      1,
+		wantSubsidy: params.BlockOneSubsidy(),
+	}, {
+		name:        "before stake validation height",
+		height:      2,
+		wantSubsidy: 30000000000 + 5000000000,
+	}, {
+		name:        "all voters",
+		height:      200,
+		voters:      5,
+		wantSubsidy: 29702970297 + 4950495049,
+	}, {
+		name:        "missing voters",
+		height:      200,
+		voters:      3,
+		wantSubsidy: 17821782178 + 2970297029,
+	}, {
+		name:        "not enough voters",
+		height:      200,
+		voters:      2,
+		wantSubsidy: 0,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			coinbase := testCoinbase(t, tc.height, 1, 1e8, params)
+			b := testBlock(tc.height, nil, true, coinbase)
+			b.Header.Voters = tc.voters
+
+			rb, err := WireBlockToRosetta(b, nil, nil, params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := rb.Transactions[0].Operations
+			last := ops[len(ops)-1]
+			if tc.height == 0 {
+				if last.Type == OpTypeSubsidy.RType() {
+					t.Fatal("genesis coinbase redeemed a subsidy")
+				}
+				return
+			}
+
+			wantAmount := fmt.Sprintf("%d", -tc.wantSubsidy)
+			if last.Type != OpTypeSubsidy.RType() ||
+				last.Account != nil ||
+				last.Amount.Value != wantAmount ||
+				last.Metadata["subsidy_source"] != "coinbase" ||
+				last.Metadata["subsidy_height"] != tc.height {
+				t.Fatalf("unexpected subsidy op: got %+v, want "+
+					"amount %s", last, wantAmount)
+			}
+		})
+	}
+}
+
+// TestTicketCommitmentOps ensures the commitments of tickets are decoded into
+// commitment operations for the committed address and amount, which are
+// listed after the regular outputs and don't carry an amount.
+func TestTicketCommitmentOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	// A pay-to-pubkey-hash commitment address, using the secp256k1
+	// generator point as the pubkey.
+	pubKey, err := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkAddr, err := dcrutil.NewAddressSecpPubKey(pubKey, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2pkh := pkAddr.AddressPubKeyHash()
+	p2sh := testAccount(t, 2, params)
+
+	// Helper to add a commitment and its change output to a ticket.
+	addCommitment := func(tx *wire.MsgTx, addr dcrutil.Address, amount int64) {
+		commitment, err := txscript.GenerateSStxAddrPush(addr,
+			dcrutil.Amount(amount), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change, err := txscript.PayToSStxChange(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.AddTxOut(wire.NewTxOut(0, commitment))
+		tx.AddTxOut(wire.NewTxOut(0, change))
+	}
+	newTicket := func(ins ...wire.OutPoint) *wire.MsgTx {
+		submission, err := txscript.PayToSStx(testAccount(t, 1, params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := wire.NewMsgTx()
+		for i := range ins {
+			tx.AddTxIn(wire.NewTxIn(&ins[i], 0, nil))
+		}
+		tx.AddTxOut(wire.NewTxOut(4.9e8, submission))
+		return tx
+	}
+
+	singleP2SH := newTicket(inputs.fund(t, 3, 5e8, params))
+	addCommitment(singleP2SH, p2sh, 5e8)
+
+	singleP2PKH := newTicket(inputs.fund(t, 4, 5e8, params))
+	addCommitment(singleP2PKH, p2pkh, 5e8)
+
+	multi := newTicket(inputs.fund(t, 5, 3e8, params),
+		inputs.fund(t, 6, 2e8, params))
+	addCommitment(multi, p2sh, 3e8)
+	addCommitment(multi, p2pkh, 2e8)
+
+	type commitment struct {
+		opIndex int64
+		account string
+		amount  int64
+		outIdx  int
+	}
+	tests := []struct {
+		name   string
+		ticket *wire.MsgTx
+		want   []commitment
+	}{{
+		name:   "p2sh commitment",
+		ticket: singleP2SH,
+		want:   []commitment{{2, p2sh.Address(), 5e8, 1}},
+	}, {
+		name:   "p2pkh commitment",
+		ticket: singleP2PKH,
+		want:   []commitment{{2, p2pkh.Address(), 5e8, 1}},
+	}, {
+		name:   "multiple commitments",
+		ticket: multi,
+		want: []commitment{
+			{3, p2sh.Address(), 3e8, 1},
+			{4, p2pkh.Address(), 2e8, 3},
+		},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if !stake.IsSStx(tc.ticket) {
+				t.Fatal("test ticket is not a ticket")
+			}
+			b := testBlock(2, nil, true, testCoinbase(t, 2, 0, 1e8, params))
+			b.STransactions = []*wire.MsgTx{tc.ticket}
+
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := rb.Transactions[len(rb.Transactions)-1].Operations
+			nbCommitments := len(ops) - len(tc.ticket.TxIn) - 1
+			if nbCommitments != len(tc.want) {
+				t.Fatalf("unexpected number of commitments: got "+
+					"%d, want %d", nbCommitments, len(tc.want))
+			}
+			for _, want := range tc.want {
+				op := ops[want.opIndex]
+				if op.Type != OpTypeCommitment.RType() ||
+					op.Account.Address != want.account ||
+					op.Amount != nil ||
+					op.Metadata["commitment_amount"] != want.amount ||
+					op.Metadata["output_index"] != want.outIdx {
+					t.Fatalf("op %d: unexpected commitment: %+v",
+						want.opIndex, op)
+				}
+			}
+		})
+	}
+}
+
+// TestFeeOps ensures transactions only include a fee operation when enabled,
+// crediting the fees account with the total input value minus the total
+// output value of the transaction.
+func TestFeeOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	// The vote pays out exactly the ticket and the stakebase subsidy.
+	voteSubsidy := int64(calcStakeVoteSubsidy(200, params))
+	prev := testBlock(199, nil, true, testCoinbase(t, 199, 0, 1e8, params))
+	vote := testVoteTx(t, inputs.fundTicket(t, 1, 2e8, params),
+		prev.BlockHash(), 199, 2, 2e8+voteSubsidy, params)
+
+	twoIns := testSpendTx(t, inputs.fund(t, 3, 10e8, params),
+		[]uint16{4, 3}, []int64{6e8, 3.5e8}, params)
+	outp := inputs.fund(t, 5, 2e8, params)
+	twoIns.AddTxIn(wire.NewTxIn(&outp, 0, nil))
+
+	tests := []struct {
+		name    string
+		tx      *wire.MsgTx
+		stake   bool
+		feeOps  bool
+		wantFee int64 // Zero when no fee op is expected.
+	}{{
+		name:    "regular tx",
+		tx:      twoIns,
+		feeOps:  true,
+		wantFee: 10e8 + 2e8 - 6e8 - 3.5e8,
+	}, {
+		name: "regular tx without fee ops",
+		tx:   twoIns,
+	}, {
+		name: "zero fee tx",
+		tx: testSpendTx(t, inputs.fund(t, 6, 1e8, params),
+			[]uint16{7}, []int64{1e8}, params),
+		feeOps: true,
+	}, {
+		name: "ticket",
+		tx: testTicketTx(t, inputs.fund(t, 8, 5e8, params), 5e8,
+			4.9e8, 9, 10, params),
+		stake:   true,
+		feeOps:  true,
+		wantFee: 5e8 - 4.9e8,
+	}, {
+		name:   "vote",
+		tx:     vote,
+		stake:  true,
+		feeOps: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(200, prev, true,
+				testCoinbase(t, 200, 0, 1e8, params))
+			if tc.stake {
+				b.STransactions = []*wire.MsgTx{tc.tx}
+			} else {
+				b.Transactions = append(b.Transactions, tc.tx)
+			}
+
+			opts := &ConvertOpts{FeeOps: tc.feeOps}
+			rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Coinbases never pay fees.
+			for _, op := range rb.Transactions[0].Operations {
+				if op.Type == OpTypeFee.RType() {
+					t.Fatal("coinbase includes a fee op")
+				}
+			}
+
+			ops := rb.Transactions[1].Operations
+			var fees []*rtypes.Operation
+			for _, op := range ops {
+				if op.Type == OpTypeFee.RType() {
+					fees = append(fees, op)
+				}
+			}
+			if tc.wantFee == 0 {
+				if len(fees) != 0 {
+					t.Fatalf("unexpected fee op: %+v", fees[0])
+				}
+				return
+			}
+			if len(fees) != 1 || fees[0] != ops[len(ops)-1] {
+				t.Fatalf("expected a single fee op as the last op, "+
+					"got %d fee ops", len(fees))
+			}
+			fee := fees[0]
+			wantAmount := fmt.Sprintf("%d", tc.wantFee)
+			if fee.Account.Address != FeeAccount ||
+				fee.Amount.Value != wantAmount ||
+				fee.Status != string(OpStatusSuccess) ||
+				fee.OperationIdentifier.Index != int64(len(ops)-1) {
+				t.Fatalf("unexpected fee op: got %+v %s, want "+
+					"amount %s", fee, fee.Amount.Value, wantAmount)
+			}
+		})
+	}
+}
+
+// TestTicketHashOps ensures every operation of votes and revocations links to
+// the ticket they spend through the ticket_hash metadata, while operations of
+// other transactions do not.
+func TestTicketHashOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	prev := testBlock(199, nil, true, testCoinbase(t, 199, 0, 1e8, params))
+	voteTicket := inputs.fundTicket(t, 1, 2e8, params)
+	revokeTicket := inputs.fundTicket(t, 2, 2e8, params)
+
+	tests := []struct {
+		name           string
+		tx             *wire.MsgTx
+		stake          bool
+		wantTicketHash string // Empty when no ticket link is expected.
+	}{{
+		name: "vote",
+		tx: testVoteTx(t, voteTicket, prev.BlockHash(), 199, 3,
+			3e8, params),
+		stake:          true,
+		wantTicketHash: voteTicket.Hash.String(),
+	}, {
+		name:           "revocation",
+		tx:             testRevokeTx(t, revokeTicket, 4, 2e8, params),
+		stake:          true,
+		wantTicketHash: revokeTicket.Hash.String(),
+	}, {
+		name: "ticket",
+		tx: testTicketTx(t, inputs.fund(t, 5, 5e8, params), 5e8,
+			4.9e8, 6, 7, params),
+		stake: true,
+	}, {
+		name: "regular tx",
+		tx: testSpendTx(t, inputs.fund(t, 8, 1e8, params),
+			[]uint16{9}, []int64{1e8}, params),
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(200, prev, true,
+				testCoinbase(t, 200, 0, 1e8, params))
+			if tc.stake {
+				b.STransactions = []*wire.MsgTx{tc.tx}
+			} else {
+				b.Transactions = append(b.Transactions, tc.tx)
+			}
+
+			rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rtx := rb.Transactions[1]
+			if len(rtx.Operations) == 0 {
+				t.Fatal("tx does not have any ops")
+			}
+			for _, op := range rtx.Operations {
+				got, ok := op.Metadata["ticket_hash"]
+				if tc.wantTicketHash == "" {
+					if ok {
+						t.Fatalf("unexpected ticket_hash in op %d: %v",
+							op.OperationIdentifier.Index, got)
+					}
+					continue
+				}
+				if got != tc.wantTicketHash {
+					t.Fatalf("unexpected ticket_hash in op %d: got %v, "+
+						"want %s", op.OperationIdentifier.Index, got,
+						tc.wantTicketHash)
+				}
+			}
+		})
+	}
+}
+
+// TestHeaderHexMeta ensures the serialized block header is only included in
+// the block metadata when enabled and that it decodes back to the header of
+// the block.
+func TestHeaderHexMeta(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	b := testBlock(2, nil, true, testCoinbase(t, 2, 0, 1e8, params))
+	b.Header.Voters = 5
+	b.Header.Nonce = 0xdeadbeef
+
+	tests := []struct {
+		name       string
+		headerHex  bool
+		wantHeader bool
+	}{{
+		name:       "enabled",
+		headerHex:  true,
+		wantHeader: true,
+	}, {
+		name: "disabled",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ConvertOpts{IncludeHeaderHex: tc.headerHex}
+			rb, err := WireBlockToRosetta(b, nil, nil, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headerHex, ok := rb.Metadata["header"]
+			if ok != tc.wantHeader {
+				t.Fatalf("unexpected header meta: got %v, want %v",
+					ok, tc.wantHeader)
+			}
+			if !tc.wantHeader {
+				return
+			}
+
+			rawHeader, err := hex.DecodeString(headerHex.(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var header wire.BlockHeader
+			if err := header.FromBytes(rawHeader); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(header, b.Header) {
+				t.Fatalf("unexpected decoded header: got %+v, want %+v",
+					header, b.Header)
+			}
+			if header.BlockHash().String() != rb.BlockIdentifier.Hash {
+				t.Fatalf("unexpected decoded header hash: got %s, "+
+					"want %s", header.BlockHash(),
+					rb.BlockIdentifier.Hash)
+			}
+		})
+	}
+}
+
+// TestLikelyChangeOps ensures only the credit paying back to the single
+// account debited by a transaction is flagged as likely change, and only when
+// enabled.
+func TestLikelyChangeOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	changeTx := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2, 1}, []int64{6e8, 3e8}, params)
+
+	tests := []struct {
+		name         string
+		tx           *wire.MsgTx
+		likelyChange bool
+		wantChange   int64 // Index of the change op or -1 if none.
+	}{{
+		name:         "change output",
+		tx:           changeTx,
+		likelyChange: true,
+		wantChange:   2,
+	}, {
+		name:       "change output when disabled",
+		tx:         changeTx,
+		wantChange: -1,
+	}, {
+		name: "no output to a debited account",
+		tx: testSpendTx(t, inputs.fund(t, 3, 10e8, params),
+			[]uint16{4, 5}, []int64{6e8, 3e8}, params),
+		likelyChange: true,
+		wantChange:   -1,
+	}, {
+		name: "single output to the debited account",
+		tx: testSpendTx(t, inputs.fund(t, 6, 10e8, params),
+			[]uint16{6}, []int64{9e8}, params),
+		likelyChange: true,
+		wantChange:   -1,
+	}, {
+		name: "multiple outputs to the debited account",
+		tx: testSpendTx(t, inputs.fund(t, 7, 10e8, params),
+			[]uint16{7, 8, 7}, []int64{3e8, 3e8, 3e8}, params),
+		likelyChange: true,
+		wantChange:   -1,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(2, nil, true,
+				testCoinbase(t, 2, 1, 1e8, params), tc.tx)
+
+			opts := &ConvertOpts{LikelyChange: tc.likelyChange}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The coinbase is never flagged, even though it pays
+			// to an account debited by the other tx.
+			for _, rtx := range rb.Transactions {
+				for _, op := range rtx.Operations {
+					_, flagged := op.Metadata["likely_change"]
+					idx := op.OperationIdentifier.Index
+					want := rtx == rb.Transactions[1] && idx == tc.wantChange
+					if flagged != want {
+						t.Fatalf("unexpected likely_change in op %d "+
+							"of tx %s: got %v, want %v", idx,
+							rtx.TransactionIdentifier.Hash,
+							flagged, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestRelatedOps ensures every operation of a transaction is linked to all
+// other operations of the same transaction when enabled, without any self
+// references or invalid indices.
+func TestRelatedOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	multiIO := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2, 3, 1}, []int64{3e8, 3e8, 3e8}, params)
+	outp := inputs.fund(t, 4, 2e8, params)
+	multiIO.AddTxIn(wire.NewTxIn(&outp, 0, nil))
+
+	tests := []struct {
+		name       string
+		tx         *wire.MsgTx
+		relatedOps bool
+		wantLinked bool
+	}{{
+		name:       "multiple inputs and outputs",
+		tx:         multiIO,
+		relatedOps: true,
+		wantLinked: true,
+	}, {
+		name: "multiple inputs and outputs when disabled",
+		tx:   multiIO,
+	}, {
+		name: "single op",
+		tx: testSpendTx(t, inputs.fund(t, 5, 1e8, params), nil, nil,
+			params),
+		relatedOps: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(2, nil, true,
+				testCoinbase(t, 2, 0, 1e8, params), tc.tx)
+
+			opts := &ConvertOpts{RelatedOps: tc.relatedOps}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := rb.Transactions[1].Operations
+			if len(ops) == 0 {
+				t.Fatal("tx does not have any ops")
+			}
+			for _, op := range ops {
+				idx := op.OperationIdentifier.Index
+				if !tc.wantLinked {
+					if op.RelatedOperations != nil {
+						t.Fatalf("unexpected related ops in op %d: %v",
+							idx, op.RelatedOperations)
+					}
+					continue
+				}
+
+				if len(op.RelatedOperations) != len(ops)-1 {
+					t.Fatalf("unexpected number of related ops in op "+
+						"%d: got %d, want %d", idx,
+						len(op.RelatedOperations), len(ops)-1)
+				}
+				seen := make(map[int64]bool)
+				for _, rel := range op.RelatedOperations {
+					switch {
+					case rel.Index == idx:
+						t.Fatalf("op %d is related to itself", idx)
+					case rel.Index < 0 || rel.Index >= int64(len(ops)):
+						t.Fatalf("op %d is related to invalid op %d",
+							idx, rel.Index)
+					case seen[rel.Index]:
+						t.Fatalf("op %d is related to op %d more "+
+							"than once", idx, rel.Index)
+					}
+					seen[rel.Index] = true
+				}
+			}
+		})
+	}
+}
+
+// TestOmitOpMetadata ensures only the configured metadata keys are removed
+// from the operations of blocks and mempool txs, leaving every other key
+// untouched.
+func TestOmitOpMetadata(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	tx := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2, 1}, []int64{6e8, 3e8}, params)
+	tx.TxIn[0].SignatureScript = []byte{0x51}
+	b := testBlock(2, nil, true, testCoinbase(t, 2, 0, 1e8, params), tx)
+
+	// Helper that converts the test tx both as part of a block and as a
+	// mempool tx.
+	convert := func(t *testing.T, opts *ConvertOpts) []*rtypes.Transaction {
+		t.Helper()
+		rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rtx, err := MempoolTxToRosetta(tx, inputs.fetch, params, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*rtypes.Transaction{rb.Transactions[1], rtx}
+	}
+	defaults := convert(t, nil)
+	if _, ok := defaults[0].Operations[0].Metadata["signature_script"]; !ok {
+		t.Fatal("debit does not include the signature script by default")
+	}
+
+	tests := []struct {
+		name string
+		omit []string
+	}{{
+		name: "none",
+	}, {
+		name: "signature script",
+		omit: []string{"signature_script"},
+	}, {
+		name: "debit and credit keys",
+		omit: []string{"signature_script", "script_version",
+			"output_index"},
+	}, {
+		name: "unknown key",
+		omit: []string{"no_such_key"},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ConvertOpts{OmitOpMetadata: tc.omit}
+			got := convert(t, opts)
+			for i, rtx := range got {
+				for j, op := range rtx.Operations {
+					want := make(map[string]interface{})
+					for k, v := range defaults[i].Operations[j].Metadata {
+						want[k] = v
+					}
+					for _, k := range tc.omit {
+						delete(want, k)
+					}
+					if !reflect.DeepEqual(op.Metadata, want) {
+						t.Fatalf("unexpected metadata of op %d: "+
+							"got %v, want %v", j, op.Metadata,
+							want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestEmptyTxs ensures transactions that do not generate any operations are
+// only included in the list of transactions of a block when enabled.
+func TestEmptyTxs(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	nullData, err := txscript.GenerateProvablyPruneableOut([]byte("dcrros"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyTx := wire.NewMsgTx()
+	emptyTx.AddTxOut(wire.NewTxOut(0, nullData))
+	coinbase := testCoinbase(t, 2, 0, 1e8, params)
+	spendTx := testSpendTx(t, inputs.fund(t, 1, 1e8, params),
+		[]uint16{2}, []int64{1e8}, params)
+	b := testBlock(2, nil, true, coinbase, emptyTx, spendTx)
+
+	tests := []struct {
+		name     string
+		emptyTxs bool
+		wantTxs  []*wire.MsgTx
+	}{{
+		name:    "omitted by default",
+		wantTxs: []*wire.MsgTx{coinbase, spendTx},
+	}, {
+		name:     "included",
+		emptyTxs: true,
+		wantTxs:  []*wire.MsgTx{coinbase, emptyTx, spendTx},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ConvertOpts{IncludeEmptyTxs: tc.emptyTxs}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rb.Transactions) != len(tc.wantTxs) {
+				t.Fatalf("unexpected number of txs: got %d, want %d",
+					len(rb.Transactions), len(tc.wantTxs))
+			}
+			for i, rtx := range rb.Transactions {
+				wantHash := tc.wantTxs[i].TxHash().String()
+				if rtx.TransactionIdentifier.Hash != wantHash {
+					t.Fatalf("unexpected tx %d: got %s, want %s", i,
+						rtx.TransactionIdentifier.Hash, wantHash)
+				}
+				isEmpty := tc.wantTxs[i] == emptyTx
+				if isEmpty != (len(rtx.Operations) == 0) {
+					t.Fatalf("unexpected number of ops in tx %d: %d",
+						i, len(rtx.Operations))
+				}
+				if isEmpty && rtx.Metadata["version"] != emptyTx.Version {
+					t.Fatalf("unexpected metadata of empty tx: %v",
+						rtx.Metadata)
+				}
+			}
+		})
+	}
+}
+
+// TestRedeemScriptClassOps ensures debits spending P2SH outputs report the
+// class of the redeem script revealed by their signature script only when
+// enabled, and that other debits and credits never report it.
+func TestRedeemScriptClassOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	pubKey, err := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := dcrutil.NewAddressSecpPubKey(pubKey, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisig, err := txscript.MultiSigScript([]*dcrutil.AddressSecpPubKey{key}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2pkh, err := txscript.PayToAddrScript(key.AddressPubKeyHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Helper that returns a tx spending an output with the given pkScript
+	// using a signature script that pushes the given data.
+	spend := func(pkScript []byte, pushes ...[]byte) *wire.MsgTx {
+		t.Helper()
+		var hash chainhash.Hash
+		binary.LittleEndian.PutUint32(hash[:], uint32(len(inputs)+1))
+		outp := *wire.NewOutPoint(&hash, 0, wire.TxTreeRegular)
+		inputs[outp] = &PrevInput{PkScript: pkScript, Amount: 1e8}
+		tx := testSpendTx(t, outp, []uint16{1}, []int64{1e8}, params)
+		builder := txscript.NewScriptBuilder()
+		for _, data := range pushes {
+			builder.AddData(data)
+		}
+		sigScript, err := builder.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.TxIn[0].SignatureScript = sigScript
+		return tx
+	}
+
+	// Helper that returns the P2SH pkScript of the given redeem script.
+	p2sh := func(redeemScript []byte) []byte {
+		t.Helper()
+		addr, err := dcrutil.NewAddressScriptHash(redeemScript, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkScript, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkScript
+	}
+
+	sig := make([]byte, 71)
+	multisigSpend := spend(p2sh(multisig), sig, multisig)
+
+	tests := []struct {
+		name        string
+		tx          *wire.MsgTx
+		redeemClass bool
+		wantClass   string // Empty when no class is expected.
+	}{{
+		name:        "p2sh multisig",
+		tx:          multisigSpend,
+		redeemClass: true,
+		wantClass:   txscript.MultiSigTy.String(),
+	}, {
+		name: "p2sh multisig when disabled",
+		tx:   multisigSpend,
+	}, {
+		name:        "p2sh pubkeyhash",
+		tx:          spend(p2sh(p2pkh), sig, pubKey, p2pkh),
+		redeemClass: true,
+		wantClass:   txscript.PubKeyHashTy.String(),
+	}, {
+		name:        "p2sh without signature script",
+		tx:          spend(p2sh(multisig)),
+		redeemClass: true,
+	}, {
+		name:        "pubkeyhash",
+		tx:          spend(p2pkh, sig, pubKey),
+		redeemClass: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(2, nil, true,
+				testCoinbase(t, 2, 0, 1e8, params), tc.tx)
+
+			opts := &ConvertOpts{RedeemScriptClass: tc.redeemClass}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := rb.Transactions[1].Operations
+			if len(ops) != 2 {
+				t.Fatalf("unexpected number of ops: got %d, want 2",
+					len(ops))
+			}
+			debit, credit := ops[0], ops[1]
+			class, ok := debit.Metadata["redeem_script_class"]
+			if ok != (tc.wantClass != "") || (ok && class != tc.wantClass) {
+				t.Fatalf("unexpected redeem script class: got %v, "+
+					"want %q", class, tc.wantClass)
+			}
+			if class, ok := credit.Metadata["redeem_script_class"]; ok {
+				t.Fatalf("unexpected redeem script class in credit: %v",
+					class)
+			}
+		})
+	}
+}
+
+// TestAccountPkScript ensures the account identifiers of debits and credits
+// include the pkScript of the spent or created output only when enabled.
+func TestAccountPkScript(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	outp := inputs.fund(t, 1, 10e8, params)
+	tx := testSpendTx(t, outp, []uint16{2, 3}, []int64{6e8, 3e8}, params)
+	b := testBlock(2, nil, true, testCoinbase(t, 2, 0, 1e8, params), tx)
+
+	tests := []struct {
+		name     string
+		pkScript bool
+	}{{
+		name:     "enabled",
+		pkScript: true,
+	}, {
+		name: "disabled",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ConvertOpts{AccountPkScript: tc.pkScript}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rtx, err := MempoolTxToRosetta(tx, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The pkScripts of the ops of the coinbase (whose
+			// subsidy op has no account) and of the spending tx.
+			wantPkScripts := [][][]byte{{
+				b.Transactions[0].TxOut[0].PkScript, nil,
+			}, {
+				inputs[outp].PkScript, tx.TxOut[0].PkScript,
+				tx.TxOut[1].PkScript,
+			}}
+			rtxs := append(rb.Transactions, rtx)
+			wantPkScripts = append(wantPkScripts, wantPkScripts[1])
+
+			for i, rtx := range rtxs {
+				if len(rtx.Operations) != len(wantPkScripts[i]) {
+					t.Fatalf("unexpected number of ops in tx %d: "+
+						"got %d, want %d", i,
+						len(rtx.Operations),
+						len(wantPkScripts[i]))
+				}
+				for j, op := range rtx.Operations {
+					if op.Account == nil {
+						continue
+					}
+					var want map[string]interface{}
+					if tc.pkScript {
+						want = map[string]interface{}{
+							"pk_script": hex.EncodeToString(
+								wantPkScripts[i][j]),
+						}
+					}
+					if !reflect.DeepEqual(op.Account.Metadata, want) {
+						t.Fatalf("unexpected account metadata of "+
+							"op %d of tx %d: got %v, want %v", j,
+							i, op.Account.Metadata, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestStreamBlockOps ensures the operations streamed by StreamBlockOps match
+// the transactions returned by WireBlockToRosetta with the default options
+// and that errors returned by the callback abort the iteration.
+func TestStreamBlockOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	prev, b, inputs := testDenseBlocks(t, 4, params)
+	b.STransactions = []*wire.MsgTx{
+		testTicketTx(t, inputs.fund(t, 100, 5e8, params), 5e8, 4.9e8,
+			101, 102, params),
+		testVoteTx(t, inputs.fundTicket(t, 103, 2e8, params),
+			prev.BlockHash(), prev.Header.Height, 104, 3e8, params),
+	}
+
+	approving := testBlock(b.Header.Height+1, b, true,
+		testCoinbase(t, b.Header.Height+1, 0, 1e8, params))
+
+	tests := []struct {
+		name    string
+		b, prev *wire.MsgBlock
+	}{{
+		name: "approving block",
+		b:    approving,
+		prev: b,
+	}, {
+		name: "disapproving block with stake txs",
+		b:    b,
+		prev: prev,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := WireBlockToRosetta(tc.b, tc.prev, inputs.fetch,
+				params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Rebuild the list of transactions from the streamed
+			// ops.
+			var got []*rtypes.Transaction
+			err = StreamBlockOps(tc.b, tc.prev, inputs.fetch, func(tx *rtypes.Transaction, op *rtypes.Operation) error {
+				if len(got) == 0 || got[len(got)-1] != tx {
+					got = append(got, tx)
+				}
+				tx.Operations = append(tx.Operations, op)
+				return nil
+			}, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want.Transactions) {
+				t.Fatal("streamed ops do not match the converted block")
+			}
+		})
+	}
+
+	// Errors returned by the callback abort the iteration.
+	errStop := errors.New("stop")
+	var calls int
+	err := StreamBlockOps(b, prev, inputs.fetch, func(tx *rtypes.Transaction, op *rtypes.Operation) error {
+		calls++
+		if calls == 3 {
+			return errStop
+		}
+		return nil
+	}, params)
+	if !errors.Is(err, errStop) {
+		t.Fatalf("unexpected error: got %v, want %v", err, errStop)
+	}
+	if calls != 3 {
+		t.Fatalf("unexpected number of calls: got %d, want 3", calls)
+	}
+}
+
+// TestDisapprovedTxsMeta ensures blocks that disapprove their parent list the
+// hashes of the reversed regular transactions of the parent in their
+// metadata, while approving blocks do not include the list.
+func TestDisapprovedTxsMeta(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	prev, disapproving, inputs := testDenseBlocks(t, 3, params)
+	approving := testBlock(disapproving.Header.Height, prev, true,
+		disapproving.Transactions...)
+
+	var prevHashes []string
+	for _, tx := range prev.Transactions {
+		prevHashes = append(prevHashes, tx.TxHash().String())
+	}
+
+	tests := []struct {
+		name string
+		b    *wire.MsgBlock
+		want []string // Nil when the list is not expected.
+	}{{
+		name: "approving block",
+		b:    approving,
+	}, {
+		name: "disapproving block",
+		b:    disapproving,
+		want: prevHashes,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rb, err := WireBlockToRosetta(tc.b, prev, inputs.fetch,
+				params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rb.Metadata["approves_parent"] != (tc.want == nil) {
+				t.Fatalf("unexpected approves_parent: got %v",
+					rb.Metadata["approves_parent"])
+			}
+			got, ok := rb.Metadata["disapproved_txs"]
+			if tc.want == nil {
+				if ok {
+					t.Fatalf("unexpected disapproved txs: %v", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected disapproved txs: got %v, want %v",
+					got, tc.want)
+			}
+		})
+	}
+}
+
+// TestRawTxMeta ensures the serialized transaction is only included in the
+// metadata of block and mempool transactions when enabled and that it decodes
+// back to the original transaction.
+func TestRawTxMeta(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	coinbase := testCoinbase(t, 2, 0, 1e8, params)
+	tx := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2, 3}, []int64{6e8, 3e8}, params)
+	tx.TxIn[0].SignatureScript = []byte{0x51}
+	b := testBlock(2, nil, true, coinbase, tx)
+
+	tests := []struct {
+		name  string
+		rawTx bool
+	}{{
+		name:  "enabled",
+		rawTx: true,
+	}, {
+		name: "disabled",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &ConvertOpts{IncludeRawTx: tc.rawTx}
+			rb, err := WireBlockToRosetta(b, nil, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rtx, err := MempoolTxToRosetta(tx, inputs.fetch, params, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rtxs := []*rtypes.Transaction{rb.Transactions[0],
+				rb.Transactions[1], rtx}
+			wantTxs := []*wire.MsgTx{coinbase, tx, tx}
+			for i, rtx := range rtxs {
+				rawTx, ok := rtx.Metadata["raw_tx"]
+				if ok != tc.rawTx {
+					t.Fatalf("unexpected raw tx meta in tx %d: got "+
+						"%v, want %v", i, ok, tc.rawTx)
+				}
+				if !tc.rawTx {
+					continue
+				}
+
+				serialized, err := hex.DecodeString(rawTx.(string))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got wire.MsgTx
+				if err := got.FromBytes(serialized); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(&got, wantTxs[i]) {
+					t.Fatalf("unexpected decoded tx %d: got %+v, "+
+						"want %+v", i, got, wantTxs[i])
+				}
+				if got.TxHash().String() != rtx.TransactionIdentifier.Hash {
+					t.Fatalf("unexpected decoded tx %d hash: got "+
+						"%s, want %s", i, got.TxHash(),
+						rtx.TransactionIdentifier.Hash)
+				}
+			}
+		})
+	}
+}
+
+// TestDebitPrevTreeMeta ensures debits report the documented outpoint
+// metadata, with prev_tree set to the tree of the spent output regardless of
+// the tree of the spending transaction, and that credits report the documented
+// output metadata.
+func TestDebitPrevTreeMeta(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+
+	// Output of the stake tree (such as the payout of a vote) spendable
+	// by a regular tx.
+	stakeOut := inputs.fund(t, 1, 2e8, params)
+	prevInput := inputs[stakeOut]
+	delete(inputs, stakeOut)
+	stakeOut.Tree = wire.TxTreeStake
+	inputs[stakeOut] = prevInput
+
+	mixed := testSpendTx(t, inputs.fund(t, 2, 3e8, params), []uint16{3},
+		[]int64{5e8}, params)
+	mixed.AddTxIn(wire.NewTxIn(&stakeOut, 0, nil))
+
+	prev := testBlock(199, nil, true, testCoinbase(t, 199, 0, 1e8, params))
+	ticket := testTicketTx(t, inputs.fund(t, 4, 5e8, params), 5e8, 4.9e8,
+		5, 6, params)
+	vote := testVoteTx(t, inputs.fundTicket(t, 7, 2e8, params),
+		prev.BlockHash(), 199, 8, 3e8, params)
+	revocation := testRevokeTx(t, inputs.fundTicket(t, 9, 2e8, params), 10,
+		2e8, params)
+
+	tests := []struct {
+		name          string
+		tx            *wire.MsgTx
+		stake         bool
+		wantPrevTrees []int8
+	}{{
+		name:          "regular tx spending both trees",
+		tx:            mixed,
+		wantPrevTrees: []int8{wire.TxTreeRegular, wire.TxTreeStake},
+	}, {
+		name:          "ticket spending regular output",
+		tx:            ticket,
+		stake:         true,
+		wantPrevTrees: []int8{wire.TxTreeRegular},
+	}, {
+		name:          "vote",
+		tx:            vote,
+		stake:         true,
+		wantPrevTrees: []int8{wire.TxTreeStake},
+	}, {
+		name:          "revocation",
+		tx:            revocation,
+		stake:         true,
+		wantPrevTrees: []int8{wire.TxTreeStake},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBlock(200, prev, true,
+				testCoinbase(t, 200, 0, 1e8, params))
+			if tc.stake {
+				b.STransactions = []*wire.MsgTx{tc.tx}
+			} else {
+				b.Transactions = append(b.Transactions, tc.tx)
+			}
+
+			rb, err := WireBlockToRosetta(b, prev, inputs.fetch, params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var prevTrees []int8
+			for _, op := range rb.Transactions[1].Operations {
+				meta := op.Metadata
+				switch op.Type {
+				case OpTypeDebit.RType():
+					in := tc.tx.TxIn[meta["input_index"].(int)]
+					outp := in.PreviousOutPoint
+					if meta["prev_hash"] != outp.Hash.String() ||
+						meta["prev_index"] != outp.Index ||
+						meta["prev_tree"] != outp.Tree ||
+						meta["sequence"] != in.Sequence ||
+						meta["block_height"] != in.BlockHeight ||
+						meta["block_index"] != in.BlockIndex ||
+						meta["script_version"] != inputs[outp].Version {
+						t.Fatalf("unexpected debit metadata: %v", meta)
+					}
+					if _, ok := meta["signature_script"]; !ok {
+						t.Fatalf("debit does not include the "+
+							"signature script: %v", meta)
+					}
+					prevTrees = append(prevTrees, meta["prev_tree"].(int8))
+
+				case OpTypeCredit.RType():
+					out := tc.tx.TxOut[meta["output_index"].(int)]
+					if meta["script_version"] != out.Version {
+						t.Fatalf("unexpected credit metadata: %v", meta)
+					}
+				}
+			}
+			if !reflect.DeepEqual(prevTrees, tc.wantPrevTrees) {
+				t.Fatalf("unexpected prev trees: got %v, want %v",
+					prevTrees, tc.wantPrevTrees)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/txscript/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// sigScriptSigner returns the address of the P2PKH signer of the given
+// signature script. The signer is identified by the public key pushed last by
+// the script. It returns nil if the script does not end with a push of a
+// valid secp256k1 public key.
+func sigScriptSigner(sigScript []byte, chainParams *chaincfg.Params) dcrutil.Address {
+	pushes, err := txscript.PushedData(sigScript)
+	if err != nil || len(pushes) < 2 {
+		return nil
+	}
+	addr, err := dcrutil.NewAddressSecpPubKey(pushes[len(pushes)-1], chainParams)
+	if err != nil {
+		return nil
+	}
+	return addr.AddressPubKeyHash()
+}
+
+// ParseTx returns the rosetta operations of the given transaction, as they
+// would be returned for the transaction once it is in the mempool. The
+// outputs spent by the transaction are fetched with fetchInputs.
+//
+// When signed is true, it also returns the account of every signer of the
+// transaction, extracted from the signature scripts of its inputs. Only
+// P2PKH signatures are currently recognized. Signers are returned in the
+// order of their first input and are not verified against the spent outputs.
+func ParseTx(tx *wire.MsgTx, signed bool, fetchInputs PrevInputsFetcher, chainParams *chaincfg.Params) ([]*rtypes.Operation, []*rtypes.AccountIdentifier, error) {
+	rtx, err := MempoolTxToRosetta(tx, fetchInputs, chainParams, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !signed {
+		return rtx.Operations, nil, nil
+	}
+
+	signers := make([]*rtypes.AccountIdentifier, 0, len(tx.TxIn))
+	seen := make(map[string]struct{}, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		addr := sigScriptSigner(in.SignatureScript, chainParams)
+		if addr == nil {
+			continue
+		}
+		saddr := addr.Address()
+		if _, ok := seen[saddr]; ok {
+			continue
+		}
+		seen[saddr] = struct{}{}
+		signers = append(signers, &rtypes.AccountIdentifier{
+			Address: saddr,
+		})
+	}
+
+	return rtx.Operations, signers, nil
+}
+
+// ValidateOps verifies the given operations describe a sane transaction that
+// can be constructed by clients before signing it.
+//
+// Only debits and credits are accepted. Every operation must have an account
+// and a DCR amount, negative for debits and positive for credits, and the
+// total debited must cover the total credited (the difference being the fee).
+func ValidateOps(ops []*rtypes.Operation) error {
+	var in, out dcrutil.Amount
+	for i, op := range ops {
+		if op.Account == nil || op.Account.Address == "" {
+			return ErrInvalidArgument.Msg(fmt.Sprintf("op %d does not "+
+				"have an account", i))
+		}
+		if op.Amount == nil {
+			return ErrInvalidArgument.Msg(fmt.Sprintf("op %d does not "+
+				"have an amount", i))
+		}
+		cur := op.Amount.Currency
+		if cur == nil || cur.Symbol != CurrencySymbol.Symbol || cur.Decimals != CurrencySymbol.Decimals {
+			return ErrInvalidArgument.Msg(fmt.Sprintf("op %d does not "+
+				"use the DCR currency", i))
+		}
+		amt, err := strconv.ParseInt(op.Amount.Value, 10, 64)
+		if err != nil || amt > int64(dcrutil.MaxAmount) || amt < -int64(dcrutil.MaxAmount) {
+			return ErrInvalidArgument.Msg(fmt.Sprintf("op %d has an "+
+				"invalid amount %q", i, op.Amount.Value))
+		}
+
+		switch OpType(op.Type) {
+		case OpTypeDebit:
+			if amt >= 0 {
+				return ErrInvalidArgument.Msg(fmt.Sprintf("debit "+
+					"op %d does not have a negative amount", i))
+			}
+			in -= dcrutil.Amount(amt)
+		case OpTypeCredit:
+			if amt <= 0 {
+				return ErrInvalidArgument.Msg(fmt.Sprintf("credit "+
+					"op %d does not have a positive amount", i))
+			}
+			out += dcrutil.Amount(amt)
+		default:
+			return ErrInvalidArgument.Msg(fmt.Sprintf("op %d has "+
+				"unsupported type %q", i, op.Type))
+		}
+		if in > dcrutil.MaxAmount || out > dcrutil.MaxAmount {
+			return ErrInvalidArgument.Msg("total amount out of range")
+		}
+	}
+
+	if in < out {
+		return ErrInvalidArgument.Msg(fmt.Sprintf("ops spend %s but "+
+			"only debit %s", out, in))
+	}
+	return nil
+}
+
+// SignedTxHash returns the hash of the given serialized transaction. It
+// returns an error wrapping ErrInvalidTransaction if rawTx is not a valid
+// serialized transaction, including when it has trailing data.
+func SignedTxHash(rawTx []byte) (string, error) {
+	var tx wire.MsgTx
+	r := bytes.NewReader(rawTx)
+	if err := tx.Deserialize(r); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+	if r.Len() != 0 {
+		return "", fmt.Errorf("%w: %d trailing bytes after tx",
+			ErrInvalidTransaction, r.Len())
+	}
+	return tx.TxHash().String(), nil
+}
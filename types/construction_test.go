@@ -0,0 +1,320 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	rtypes "github.com/coinbase/rosetta-sdk-go/types"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/txscript/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestValidateOps ensures only balanced debits and credits with accounts and
+// DCR amounts are accepted.
+func TestValidateOps(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	newOp := func(opType OpType, account uint16, amount string) *rtypes.Operation {
+		return &rtypes.Operation{
+			Type: opType.RType(),
+			Account: &rtypes.AccountIdentifier{
+				Address: testAccount(t, account, params).Address(),
+			},
+			Amount: &rtypes.Amount{
+				Value:    amount,
+				Currency: CurrencySymbol,
+			},
+		}
+	}
+	debit := func(account uint16, amount string) *rtypes.Operation {
+		return newOp(OpTypeDebit, account, amount)
+	}
+	credit := func(account uint16, amount string) *rtypes.Operation {
+		return newOp(OpTypeCredit, account, amount)
+	}
+	with := func(op *rtypes.Operation, f func(op *rtypes.Operation)) *rtypes.Operation {
+		f(op)
+		return op
+	}
+
+	tests := []struct {
+		name  string
+		ops   []*rtypes.Operation
+		valid bool
+	}{{
+		name: "balanced without fee",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			credit(2, "600"),
+			credit(3, "400"),
+		},
+		valid: true,
+	}, {
+		name: "balanced with fee",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			debit(2, "-500"),
+			credit(3, "1400"),
+		},
+		valid: true,
+	}, {
+		name: "over-spend",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			credit(2, "600"),
+			credit(3, "401"),
+		},
+	}, {
+		name: "credits without debits",
+		ops: []*rtypes.Operation{
+			credit(1, "1"),
+		},
+	}, {
+		name: "missing account",
+		ops: []*rtypes.Operation{
+			with(debit(1, "-1000"), func(op *rtypes.Operation) {
+				op.Account = nil
+			}),
+			credit(2, "1000"),
+		},
+	}, {
+		name: "empty account address",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			with(credit(2, "1000"), func(op *rtypes.Operation) {
+				op.Account.Address = ""
+			}),
+		},
+	}, {
+		name: "missing amount",
+		ops: []*rtypes.Operation{
+			with(debit(1, "-1000"), func(op *rtypes.Operation) {
+				op.Amount = nil
+			}),
+			credit(2, "1000"),
+		},
+	}, {
+		name: "wrong currency",
+		ops: []*rtypes.Operation{
+			with(debit(1, "-1000"), func(op *rtypes.Operation) {
+				op.Amount.Currency = &rtypes.Currency{
+					Symbol:   "BTC",
+					Decimals: 8,
+				}
+			}),
+			credit(2, "1000"),
+		},
+	}, {
+		name: "invalid amount",
+		ops: []*rtypes.Operation{
+			debit(1, "-10.00"),
+			credit(2, "1000"),
+		},
+	}, {
+		name: "positive debit",
+		ops: []*rtypes.Operation{
+			debit(1, "1000"),
+			credit(2, "1000"),
+		},
+	}, {
+		name: "negative credit",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			credit(2, "-1000"),
+		},
+	}, {
+		name: "unsupported type",
+		ops: []*rtypes.Operation{
+			debit(1, "-1000"),
+			newOp(OpTypeFee, 2, "1000"),
+		},
+	}}
+
+	for _, tc := range tests {
+		err := ValidateOps(tc.ops)
+		if tc.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: unexpected error: got %v, want %v",
+				tc.name, err, ErrInvalidArgument)
+		}
+	}
+}
+
+// TestSignedTxHash ensures the hash of signed txs is returned and malformed
+// serializations are rejected.
+func TestSignedTxHash(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	tx := testSpendTx(t, inputs.fund(t, 1, 10e8, params),
+		[]uint16{2, 1}, []int64{6e8, 3e8}, params)
+	sigScript, err := txscript.NewScriptBuilder().
+		AddData(make([]byte, 71)).
+		AddData(make([]byte, 33)).
+		Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.TxIn[0].SignatureScript = sigScript
+	rawTx, err := tx.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hash only commits to the prefix of the tx, so it must match
+	// the hash of the unsigned tx.
+	hash, err := SignedTxHash(rawTx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hash != tx.TxHash().String() {
+		t.Fatalf("unexpected hash: got %s, want %s", hash, tx.TxHash())
+	}
+	tx.TxIn[0].SignatureScript = nil
+	if hash != tx.TxHash().String() {
+		t.Fatalf("hash of signed tx %s differs from unsigned tx %s", hash,
+			tx.TxHash())
+	}
+
+	malformed := map[string][]byte{
+		"empty":          {},
+		"garbage":        {0xde, 0xad, 0xbe, 0xef},
+		"trailing bytes": append(append([]byte{}, rawTx...), 0x00),
+	}
+	for i := 1; i < len(rawTx); i++ {
+		malformed[fmt.Sprintf("truncated to %d bytes", i)] = rawTx[:i]
+	}
+	for name, rawTx := range malformed {
+		_, err := SignedTxHash(rawTx)
+		if !errors.Is(err, ErrInvalidTransaction) {
+			t.Fatalf("%s: unexpected error: got %v, want %v", name,
+				err, ErrInvalidTransaction)
+		}
+	}
+}
+
+// TestParseTxSigners ensures the signers of a tx are extracted from the
+// public keys revealed by its P2PKH signature scripts, in the order of their
+// first input and without duplicates.
+func TestParseTxSigners(t *testing.T) {
+	params := chaincfg.RegNetParams()
+	pubKeys := make([][]byte, 0, 2)
+	signers := make([]string, 0, 2)
+	for _, s := range []string{
+		"0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		"02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5",
+	} {
+		pubKey, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := dcrutil.NewAddressSecpPubKey(pubKey, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, pubKey)
+		signers = append(signers, addr.AddressPubKeyHash().Address())
+	}
+
+	// Helper to build a signature script revealing the given pushes.
+	sigScript := func(pushes ...[]byte) []byte {
+		b := txscript.NewScriptBuilder()
+		for _, push := range pushes {
+			b.AddData(push)
+		}
+		script, err := b.Script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+	sig := make([]byte, 71)
+	invalidPubKey := append([]byte{0x02}, make([]byte, 32)...)
+
+	tests := []struct {
+		name        string
+		signed      bool
+		sigScripts  [][]byte
+		wantSigners []string
+	}{{
+		name:       "unsigned",
+		sigScripts: [][]byte{sigScript(sig, pubKeys[0])},
+	}, {
+		name:        "single signer",
+		signed:      true,
+		sigScripts:  [][]byte{sigScript(sig, pubKeys[0])},
+		wantSigners: signers[:1],
+	}, {
+		name:   "repeated signer",
+		signed: true,
+		sigScripts: [][]byte{
+			sigScript(sig, pubKeys[0]),
+			sigScript(sig, pubKeys[0]),
+		},
+		wantSigners: signers[:1],
+	}, {
+		name:   "signers in input order",
+		signed: true,
+		sigScripts: [][]byte{
+			sigScript(sig, pubKeys[1]),
+			sigScript(sig, pubKeys[0]),
+			sigScript(sig, pubKeys[1]),
+		},
+		wantSigners: []string{signers[1], signers[0]},
+	}, {
+		name:   "unrecognized signature scripts",
+		signed: true,
+		sigScripts: [][]byte{
+			nil,
+			sigScript(pubKeys[0]),
+			sigScript(sig, invalidPubKey),
+			sigScript(sig, pubKeys[1]),
+		},
+		wantSigners: signers[1:],
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			inputs := make(testInputs)
+			tx := wire.NewMsgTx()
+			for i, script := range tc.sigScripts {
+				outp := inputs.fund(t, uint16(i+1), 1e8, params)
+				tx.AddTxIn(wire.NewTxIn(&outp, 0, script))
+			}
+			tx.AddTxOut(wire.NewTxOut(1e8, testPkScript(t, 10, params)))
+
+			ops, gotSigners, err := ParseTx(tx, tc.signed, inputs.fetch, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != len(tx.TxIn)+len(tx.TxOut) {
+				t.Fatalf("unexpected number of ops: got %d, want %d",
+					len(ops), len(tx.TxIn)+len(tx.TxOut))
+			}
+			if !tc.signed {
+				if gotSigners != nil {
+					t.Fatalf("unexpected signers of unsigned tx: %v",
+						gotSigners)
+				}
+				return
+			}
+			got := make([]string, 0, len(gotSigners))
+			for _, signer := range gotSigners {
+				got = append(got, signer.Address)
+			}
+			if !reflect.DeepEqual(got, tc.wantSigners) {
+				t.Fatalf("unexpected signers: got %v, want %v", got,
+					tc.wantSigners)
+			}
+		})
+	}
+}
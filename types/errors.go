@@ -31,6 +31,9 @@ const (
 	ErrProcessingTx
 	ErrInvalidAccountIdAddr
 	ErrBlockIndexAfterTip
+	ErrBlockNotInMainchain
+	ErrDcrdTimeout
+	ErrSpendsImmatureOutput
 
 	// This MUST be the last member.
 	nbErrorCodes
@@ -51,6 +54,9 @@ var errorCodeMsgs = map[ErrorCode]string{
 	ErrProcessingTx:         "error processing tx",
 	ErrInvalidAccountIdAddr: "invalid address in account identifier",
 	ErrBlockIndexAfterTip:   "block index after current mainchain tip",
+	ErrBlockNotInMainchain:  "block not in processed mainchain",
+	ErrDcrdTimeout:          "dcrd request timed out",
+	ErrSpendsImmatureOutput: "tx spends immature output",
 }
 
 func (err ErrorCode) Error() string {
@@ -167,6 +173,9 @@ func DcrdError(err error, opts ...ErrorOption) *rtypes.Error {
 	}
 
 	switch {
+	case errors.Is(err, ErrDcrdTimeout):
+		e.Code = int32(ErrDcrdTimeout)
+
 	case errors.Is(err, context.Canceled),
 		errors.Is(err, context.DeadlineExceeded):
 
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/wire"
+)
+
+var (
+	ErrMerkleRootMismatch = errors.New("merkle root mismatch")
+	ErrStakeRootMismatch  = errors.New("stake root mismatch")
+)
+
+// calcMerkleRoot calculates the merkle root of the given leaves. The leaves
+// slice is modified in place.
+func calcMerkleRoot(leaves []chainhash.Hash) chainhash.Hash {
+	if len(leaves) == 0 {
+		return chainhash.Hash{}
+	}
+
+	var buf [chainhash.HashSize * 2]byte
+	for len(leaves) > 1 {
+		// Duplicate the last leaf when there's an odd number of them.
+		if len(leaves)&1 != 0 {
+			leaves = append(leaves, leaves[len(leaves)-1])
+		}
+
+		for i := 0; i < len(leaves)/2; i++ {
+			copy(buf[:chainhash.HashSize], leaves[i*2][:])
+			copy(buf[chainhash.HashSize:], leaves[i*2+1][:])
+			leaves[i] = chainhash.HashH(buf[:])
+		}
+		leaves = leaves[:len(leaves)/2]
+	}
+	return leaves[0]
+}
+
+// calcTxTreeMerkleRoot calculates the merkle root of the given transaction
+// tree, committing to the full hash (prefix and witness) of each tx.
+func calcTxTreeMerkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	leaves := make([]chainhash.Hash, 0, len(txs))
+	for _, tx := range txs {
+		leaves = append(leaves, tx.TxHashFull())
+	}
+	return calcMerkleRoot(leaves)
+}
+
+// VerifyBlockRoots recalculates the merkle roots of the transaction trees of
+// the given block and verifies they match the ones committed to in its
+// header.
+//
+// The header merkle root is accepted both as the root of the regular tree
+// only and as the combined root of the regular and stake trees (as required
+// after the header commitments agenda activates).
+//
+// Genesis blocks are always accepted, since they are not validated by the
+// consensus rules (the testnet3 one commits to the prefix hash of its
+// coinbase).
+func VerifyBlockRoots(b *wire.MsgBlock) error {
+	if b.Header.Height == 0 {
+		return nil
+	}
+
+	regularRoot := calcTxTreeMerkleRoot(b.Transactions)
+	stakeRoot := calcTxTreeMerkleRoot(b.STransactions)
+	combinedRoot := calcMerkleRoot([]chainhash.Hash{regularRoot, stakeRoot})
+
+	header := &b.Header
+	if header.MerkleRoot != regularRoot && header.MerkleRoot != combinedRoot {
+		return fmt.Errorf("%w: block %s has merkle root %s (calculated %s)",
+			ErrMerkleRootMismatch, header.BlockHash(),
+			header.MerkleRoot, combinedRoot)
+	}
+	if header.StakeRoot != stakeRoot {
+		return fmt.Errorf("%w: block %s has stake root %s (calculated %s)",
+			ErrStakeRootMismatch, header.BlockHash(),
+			header.StakeRoot, stakeRoot)
+	}
+	return nil
+}
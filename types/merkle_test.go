@@ -0,0 +1,106 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestVerifyBlockRoots ensures blocks are only accepted when the merkle and
+// stake roots of their headers commit to their transactions.
+func TestVerifyBlockRoots(t *testing.T) {
+	// The genesis blocks of every network are accepted, even though the
+	// testnet3 one does not commit to the full hash of its coinbase.
+	nets := []*chaincfg.Params{
+		chaincfg.MainNetParams(),
+		chaincfg.TestNet3Params(),
+		chaincfg.SimNetParams(),
+		chaincfg.RegNetParams(),
+	}
+	for _, params := range nets {
+		if err := VerifyBlockRoots(params.GenesisBlock); err != nil {
+			t.Fatalf("%s: unexpected error verifying genesis block: %v",
+				params.Name, err)
+		}
+	}
+
+	params := chaincfg.RegNetParams()
+	inputs := make(testInputs)
+	newBlock := func() *wire.MsgBlock {
+		b := testBlock(2, nil, true, testCoinbase(t, 2, 0, 10e8, params))
+		for i := uint16(1); i <= 4; i++ {
+			tx := testSpendTx(t, inputs.fund(t, i, 10e8, params),
+				[]uint16{i}, []int64{9e8}, params)
+			b.Transactions = append(b.Transactions, tx)
+		}
+		ticket := testSpendTx(t, inputs.fund(t, 5, 10e8, params),
+			[]uint16{5}, []int64{9e8}, params)
+		b.STransactions = []*wire.MsgTx{ticket}
+		b.Header.MerkleRoot = calcTxTreeMerkleRoot(b.Transactions)
+		b.Header.StakeRoot = calcTxTreeMerkleRoot(b.STransactions)
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(b *wire.MsgBlock)
+		wantErr error
+	}{{
+		name:   "untampered",
+		tamper: func(b *wire.MsgBlock) {},
+	}, {
+		name: "combined merkle root",
+		tamper: func(b *wire.MsgBlock) {
+			b.Header.MerkleRoot = calcMerkleRoot([]chainhash.Hash{
+				b.Header.MerkleRoot, b.Header.StakeRoot,
+			})
+		},
+	}, {
+		name: "tampered output amount",
+		tamper: func(b *wire.MsgBlock) {
+			b.Transactions[2].TxOut[0].Value++
+		},
+		wantErr: ErrMerkleRootMismatch,
+	}, {
+		name: "tampered signature script",
+		tamper: func(b *wire.MsgBlock) {
+			b.Transactions[3].TxIn[0].SignatureScript = []byte{0x01}
+		},
+		wantErr: ErrMerkleRootMismatch,
+	}, {
+		name: "removed tx",
+		tamper: func(b *wire.MsgBlock) {
+			b.Transactions = b.Transactions[:len(b.Transactions)-1]
+		},
+		wantErr: ErrMerkleRootMismatch,
+	}, {
+		name: "reordered txs",
+		tamper: func(b *wire.MsgBlock) {
+			b.Transactions[1], b.Transactions[2] = b.Transactions[2], b.Transactions[1]
+		},
+		wantErr: ErrMerkleRootMismatch,
+	}, {
+		name: "tampered stake tx",
+		tamper: func(b *wire.MsgBlock) {
+			b.STransactions[0].TxOut[0].Value++
+		},
+		wantErr: ErrStakeRootMismatch,
+	}}
+
+	for _, tc := range tests {
+		b := newBlock()
+		tc.tamper(b)
+		err := VerifyBlockRoots(b)
+		if !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: unexpected error: got %v, want %v", tc.name,
+				err, tc.wantErr)
+		}
+	}
+}
@@ -21,6 +21,22 @@ const (
 
 	OpTypeDebit  OpType = "debit"
 	OpTypeCredit OpType = "credit"
+
+	// OpTypeCommitment identifies ticket commitments. These are not
+	// spendable outputs and do not change the balance of their account:
+	// they record the address and amount that the ticket's vote or
+	// revocation must pay back to.
+	OpTypeCommitment OpType = "commitment"
+
+	// OpTypeSubsidy identifies the newly issued coins redeemed by the
+	// coinbase input of coinbases and the stakebase input of votes. These
+	// operations do not have an account.
+	OpTypeSubsidy OpType = "subsidy"
+
+	// OpTypeFee identifies the synthetic operation that credits the fee
+	// paid by a transaction to FeeAccount. These operations are only
+	// generated when requested in the conversion options.
+	OpTypeFee OpType = "fee"
 )
 
 // AllOpTypes returns all OpTypes in a structure suitable for use in an Allow
@@ -29,6 +45,9 @@ func AllOpTypes() []string {
 	return []string{
 		OpTypeDebit.RType(),
 		OpTypeCredit.RType(),
+		OpTypeCommitment.RType(),
+		OpTypeSubsidy.RType(),
+		OpTypeFee.RType(),
 	}
 }
 
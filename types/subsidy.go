@@ -0,0 +1,127 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// The following functions calculate the subsidy of blocks according to the
+// consensus rules. They mirror the ones provided by dcrd's blockchain
+// standalone package.
+
+// calcBlockSubsidy returns the full subsidy (i.e. before being split into
+// its work, stake and treasury portions) of a block at the given height.
+func calcBlockSubsidy(height int64, params *chaincfg.Params) int64 {
+	// Block 0 is the genesis block and produces no subsidy. Block 1
+	// subsidy is special as it is used for the initial token
+	// distribution.
+	switch {
+	case height <= 0:
+		return 0
+	case height == 1:
+		return params.BlockOneSubsidy()
+	}
+
+	subsidy := params.BaseSubsidyValue()
+	mul := params.SubsidyReductionMultiplier()
+	div := params.SubsidyReductionDivisor()
+	reductions := height / params.SubsidyReductionIntervalBlocks()
+	for i := int64(0); i < reductions && subsidy > 0; i++ {
+		subsidy *= mul
+		subsidy /= div
+	}
+	return subsidy
+}
+
+// enoughVoters returns whether a block at the given height with the given
+// number of voters has enough votes to receive work and treasury subsidy.
+func enoughVoters(height int64, voters uint16, params *chaincfg.Params) bool {
+	minVotes := params.VotesPerBlock()/2 + 1
+	return height < params.StakeValidationBeginHeight() || voters >= minVotes
+}
+
+// calcWorkSubsidy returns the proof-of-work subsidy of a block at the given
+// height with the given number of voters.
+func calcWorkSubsidy(height int64, voters uint16, params *chaincfg.Params) dcrutil.Amount {
+	if height == 1 {
+		return dcrutil.Amount(params.BlockOneSubsidy())
+	}
+	if !enoughVoters(height, voters, params) {
+		return 0
+	}
+
+	subsidy := calcBlockSubsidy(height, params)
+	subsidy *= int64(params.WorkSubsidyProportion())
+	subsidy /= int64(params.TotalSubsidyProportions())
+
+	// The subsidy is only reduced by missing votes once voting begins.
+	if height < params.StakeValidationBeginHeight() {
+		return dcrutil.Amount(subsidy)
+	}
+	return dcrutil.Amount(int64(voters) * subsidy / int64(params.VotesPerBlock()))
+}
+
+// calcStakeVoteSubsidy returns the subsidy of a single vote included in a
+// block at the given height.
+func calcStakeVoteSubsidy(height int64, params *chaincfg.Params) dcrutil.Amount {
+	// Vote subsidy is based on the height being voted on (i.e. the parent
+	// of the block that includes the vote).
+	height--
+	if height < params.StakeValidationBeginHeight()-1 {
+		return 0
+	}
+
+	subsidy := calcBlockSubsidy(height, params)
+	subsidy *= int64(params.StakeSubsidyProportion())
+	subsidy /= int64(params.TotalSubsidyProportions()) * int64(params.VotesPerBlock())
+	return dcrutil.Amount(subsidy)
+}
+
+// calcTreasurySubsidy returns the treasury subsidy of a block at the given
+// height with the given number of voters.
+func calcTreasurySubsidy(height int64, voters uint16, params *chaincfg.Params) dcrutil.Amount {
+	if height <= 1 || !enoughVoters(height, voters, params) {
+		return 0
+	}
+
+	subsidy := calcBlockSubsidy(height, params)
+	subsidy *= int64(params.TreasurySubsidyProportion())
+	subsidy /= int64(params.TotalSubsidyProportions())
+
+	// The subsidy is only reduced by missing votes once voting begins.
+	if height < params.StakeValidationBeginHeight() {
+		return dcrutil.Amount(subsidy)
+	}
+	return dcrutil.Amount(int64(voters) * subsidy / int64(params.VotesPerBlock()))
+}
+
+// coinbaseSubsidyType returns the portion of the block subsidy that is paid
+// by the given output of the coinbase transaction of a block at the given
+// height.
+//
+// The first output of coinbases after block 1 pays the treasury, while the
+// remaining ones (including every output of block 1) pay the miner.
+func coinbaseSubsidyType(height int64, outIndex int) string {
+	if height > 1 && outIndex == 0 {
+		return "treasury"
+	}
+	return "work"
+}
+
+// blockSubsidyMeta returns the metadata describing how the subsidy of the
+// given block was split among its work, stake and treasury portions.
+func blockSubsidyMeta(header *wire.BlockHeader, chainParams *chaincfg.Params) map[string]interface{} {
+	height := int64(header.Height)
+	voters := header.Voters
+	stake := calcStakeVoteSubsidy(height, chainParams) * dcrutil.Amount(voters)
+	return map[string]interface{}{
+		"work":     int64(calcWorkSubsidy(height, voters, chainParams)),
+		"stake":    int64(stake),
+		"treasury": int64(calcTreasurySubsidy(height, voters, chainParams)),
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2020 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/decred/dcrd/wire"
+)
+
+// TestSubsidy ensures the work, vote and treasury subsidies are calculated
+// according to the parameters of each network.
+func TestSubsidy(t *testing.T) {
+	mainnet := chaincfg.MainNetParams()
+	testnet := chaincfg.TestNet3Params()
+	simnet := chaincfg.SimNetParams()
+	regnet := chaincfg.RegNetParams()
+
+	tests := []struct {
+		name     string
+		params   *chaincfg.Params
+		height   int64
+		voters   uint16
+		work     dcrutil.Amount
+		vote     dcrutil.Amount
+		treasury dcrutil.Amount
+	}{{
+		name:   "mainnet block one",
+		params: mainnet,
+		height: 1,
+		work:   168000000000000,
+	}, {
+		name:     "mainnet first regular block",
+		params:   mainnet,
+		height:   2,
+		work:     1871749598,
+		treasury: 311958266,
+	}, {
+		name:     "mainnet last block before voting",
+		params:   mainnet,
+		height:   4095,
+		work:     1871749598,
+		treasury: 311958266,
+	}, {
+		name:     "mainnet stake validation height",
+		params:   mainnet,
+		height:   4096,
+		voters:   5,
+		work:     1871749598,
+		vote:     187174959,
+		treasury: 311958266,
+	}, {
+		name:     "mainnet three voters",
+		params:   mainnet,
+		height:   4096,
+		voters:   3,
+		work:     1123049758,
+		vote:     187174959,
+		treasury: 187174959,
+	}, {
+		name:   "mainnet not enough voters",
+		params: mainnet,
+		height: 4096,
+		voters: 2,
+		vote:   187174959,
+	}, {
+		name:     "mainnet first reduction",
+		params:   mainnet,
+		height:   6144,
+		voters:   5,
+		work:     1853217423,
+		vote:     187174959,
+		treasury: 308869570,
+	}, {
+		name:     "mainnet third reduction",
+		params:   mainnet,
+		height:   22528,
+		voters:   4,
+		work:     1453361374,
+		vote:     181670171,
+		treasury: 242226895,
+	}, {
+		name:   "testnet3 block one",
+		params: testnet,
+		height: 1,
+		work:   10000000000000,
+	}, {
+		name:     "testnet3 first regular block",
+		params:   testnet,
+		height:   2,
+		work:     1500000000,
+		treasury: 250000000,
+	}, {
+		name:     "testnet3 last block before voting",
+		params:   testnet,
+		height:   767,
+		work:     1500000000,
+		treasury: 250000000,
+	}, {
+		name:     "testnet3 stake validation height",
+		params:   testnet,
+		height:   768,
+		voters:   5,
+		work:     1500000000,
+		vote:     150000000,
+		treasury: 250000000,
+	}, {
+		name:     "testnet3 three voters",
+		params:   testnet,
+		height:   768,
+		voters:   3,
+		work:     900000000,
+		vote:     150000000,
+		treasury: 150000000,
+	}, {
+		name:   "testnet3 not enough voters",
+		params: testnet,
+		height: 768,
+		voters: 2,
+		vote:   150000000,
+	}, {
+		name:     "testnet3 first reduction",
+		params:   testnet,
+		height:   2048,
+		voters:   5,
+		work:     1485148514,
+		vote:     150000000,
+		treasury: 247524752,
+	}, {
+		name:     "testnet3 third reduction",
+		params:   testnet,
+		height:   6912,
+		voters:   4,
+		work:     1164708176,
+		vote:     145588522,
+		treasury: 194118028,
+	}, {
+		name:   "simnet block one",
+		params: simnet,
+		height: 1,
+		work:   30000000000000,
+	}, {
+		name:     "simnet first regular block",
+		params:   simnet,
+		height:   2,
+		work:     30000000000,
+		treasury: 5000000000,
+	}, {
+		name:     "simnet first reduction before voting",
+		params:   simnet,
+		height:   128,
+		work:     29702970297,
+		treasury: 4950495049,
+	}, {
+		name:     "simnet last block before voting",
+		params:   simnet,
+		height:   143,
+		work:     29702970297,
+		treasury: 4950495049,
+	}, {
+		name:     "simnet stake validation height",
+		params:   simnet,
+		height:   144,
+		voters:   5,
+		work:     29702970297,
+		vote:     2970297029,
+		treasury: 4950495049,
+	}, {
+		name:     "simnet three voters",
+		params:   simnet,
+		height:   144,
+		voters:   3,
+		work:     17821782178,
+		vote:     2970297029,
+		treasury: 2970297029,
+	}, {
+		name:   "simnet not enough voters",
+		params: simnet,
+		height: 144,
+		voters: 2,
+		vote:   2970297029,
+	}, {
+		name:     "simnet fourth reduction",
+		params:   simnet,
+		height:   528,
+		voters:   4,
+		work:     23063528266,
+		vote:     2882941033,
+		treasury: 3843921377,
+	}, {
+		name:   "regnet block one",
+		params: regnet,
+		height: 1,
+		work:   30000000000000,
+	}, {
+		name:     "regnet first regular block",
+		params:   regnet,
+		height:   2,
+		work:     30000000000,
+		treasury: 5000000000,
+	}, {
+		name:     "regnet stake validation height",
+		params:   regnet,
+		height:   144,
+		voters:   5,
+		work:     29702970297,
+		vote:     2970297029,
+		treasury: 4950495049,
+	}, {
+		name:   "regnet not enough voters",
+		params: regnet,
+		height: 144,
+		voters: 2,
+		vote:   2970297029,
+	}, {
+		name:     "regnet fourth reduction",
+		params:   regnet,
+		height:   528,
+		voters:   4,
+		work:     23063528266,
+		vote:     2882941033,
+		treasury: 3843921377,
+	}}
+
+	for _, tc := range tests {
+		work := calcWorkSubsidy(tc.height, tc.voters, tc.params)
+		if work != tc.work {
+			t.Errorf("%s: unexpected work subsidy: got %d, want %d",
+				tc.name, work, tc.work)
+		}
+		vote := calcStakeVoteSubsidy(tc.height, tc.params)
+		if vote != tc.vote {
+			t.Errorf("%s: unexpected vote subsidy: got %d, want %d",
+				tc.name, vote, tc.vote)
+		}
+		treasury := calcTreasurySubsidy(tc.height, tc.voters, tc.params)
+		if treasury != tc.treasury {
+			t.Errorf("%s: unexpected treasury subsidy: got %d, want %d",
+				tc.name, treasury, tc.treasury)
+		}
+	}
+}
+
+// TestBlockSubsidyMeta ensures the subsidy metadata of blocks splits the block
+// subsidy into its work, stake and treasury portions, accounting for the
+// number of voters, and that it is included in converted blocks.
+func TestBlockSubsidyMeta(t *testing.T) {
+	params := chaincfg.RegNetParams()
+
+	tests := []struct {
+		name     string
+		height   uint32
+		voters   uint16
+		work     int64
+		stake    int64
+		treasury int64
+	}{{
+		name: "genesis",
+	}, {
+		name:   "block one",
+		height: 1,
+		work:   30000000000000,
+	}, {
+		name:     "before stake validation height",
+		height:   2,
+		work:     30000000000,
+		treasury: 5000000000,
+	}, {
+		name:     "last block before voting",
+		height:   143,
+		work:     29702970297,
+		treasury: 4950495049,
+	}, {
+		name:     "all voters",
+		height:   200,
+		voters:   5,
+		work:     29702970297,
+		stake:    5 * 2970297029,
+		treasury: 4950495049,
+	}, {
+		name:     "missing voters",
+		height:   200,
+		voters:   3,
+		work:     17821782178,
+		stake:    3 * 2970297029,
+		treasury: 2970297029,
+	}, {
+		name:   "not enough voters",
+		height: 200,
+		voters: 2,
+		stake:  2 * 2970297029,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := map[string]interface{}{
+				"work":     tc.work,
+				"stake":    tc.stake,
+				"treasury": tc.treasury,
+			}
+			header := &wire.BlockHeader{Height: tc.height, Voters: tc.voters}
+			got := blockSubsidyMeta(header, params)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected subsidy meta: got %v, want %v",
+					got, want)
+			}
+
+			coinbase := testCoinbase(t, tc.height, 1, 1e8, params)
+			b := testBlock(tc.height, nil, true, coinbase)
+			b.Header.Voters = tc.voters
+			rb, err := WireBlockToRosetta(b, nil, nil, params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ = rb.Metadata["subsidy"].(map[string]interface{})
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected block subsidy meta: got %v, want %v",
+					got, want)
+			}
+		})
+	}
+}